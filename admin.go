@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// 管理接口
+// ============================================================================
+
+// AdminServer 管理接口，监听独立端口，使用 ADMIN_TOKEN 鉴权
+type AdminServer struct {
+	gateway *Gateway
+	cfg     *Config
+	mux     *http.ServeMux
+}
+
+func NewAdminServer(gateway *Gateway, cfg *Config) *AdminServer {
+	a := &AdminServer{
+		gateway: gateway,
+		cfg:     cfg,
+		mux:     http.NewServeMux(),
+	}
+
+	a.mux.HandleFunc("/admin/keys", a.handleKeys)
+	a.mux.HandleFunc("/admin/keys/", a.handleKey)
+	a.mux.HandleFunc("/admin/sessions", a.handleSessions)
+	a.mux.HandleFunc("/admin/sessions/", a.handleSession)
+	a.mux.HandleFunc("/admin/requests", a.handleRequests)
+	a.mux.HandleFunc("/admin/config", a.handleConfig)
+	a.mux.HandleFunc("/admin/log-level", a.handleLogLevel)
+	a.mux.HandleFunc("/admin/usage", a.handleUsage)
+	a.mux.HandleFunc("/admin/budgets", a.handleBudgets)
+	a.mux.HandleFunc("/admin/credentials", a.handleCredentials)
+	a.mux.HandleFunc("/admin/pool", a.handlePool)
+	a.mux.HandleFunc("/admin/breakers", a.handleBreakers)
+	a.mux.HandleFunc("/admin/models", a.handleModelHealth)
+	a.mux.HandleFunc("/admin/egress", a.handleEgress)
+	a.mux.HandleFunc("/admin/prompt", a.handlePromptPreview)
+	a.mux.HandleFunc("/admin/cache", a.handleCache)
+	return a
+}
+
+func (a *AdminServer) ListenAndServe() {
+	if a.cfg.AdminToken == "" {
+		logError("管理接口未启动：ADMIN_TOKEN 为空")
+		return
+	}
+	logInfo("管理接口就绪 | 端口: %s", a.cfg.AdminPort)
+	if err := http.ListenAndServe(":"+a.cfg.AdminPort, a); err != nil {
+		logError("管理接口退出: %v", err)
+	}
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.AdminToken)) != 1 {
+		writeAdminError(w, http.StatusUnauthorized, "invalid admin token")
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// ---------------------------------------------------------------------------
+// API Key
+// ---------------------------------------------------------------------------
+
+// handleKeys GET 列出所有 Key，POST 新建 Key
+func (a *AdminServer) handleKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"keys": a.gateway.keys.List()})
+	case http.MethodPost:
+		var k APIKey
+		if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		if k.Key != "" {
+			if _, exists := a.gateway.keys.Get(k.Key); exists {
+				writeAdminError(w, http.StatusConflict, "key already exists")
+				return
+			}
+		}
+		created, err := a.gateway.keys.Put(k)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		logInfo("管理接口 | 创建 Key: %s (%s)", created.Name, maskKey(created.Key))
+		writeAdminJSON(w, http.StatusCreated, created)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleKey GET/PUT/DELETE /admin/keys/{key}
+func (a *AdminServer) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/admin/keys/")
+	if key == "" {
+		writeAdminError(w, http.StatusNotFound, "key not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		k, exists := a.gateway.keys.Get(key)
+		if !exists {
+			writeAdminError(w, http.StatusNotFound, "key not found")
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, k)
+	case http.MethodPut:
+		if _, exists := a.gateway.keys.Get(key); !exists {
+			writeAdminError(w, http.StatusNotFound, "key not found")
+			return
+		}
+		var k APIKey
+		if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		k.Key = key
+		updated, err := a.gateway.keys.Put(k)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		logInfo("管理接口 | 更新 Key: %s (%s)", updated.Name, maskKey(updated.Key))
+		writeAdminJSON(w, http.StatusOK, updated)
+	case http.MethodDelete:
+		deleted, err := a.gateway.keys.Delete(key)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !deleted {
+			writeAdminError(w, http.StatusNotFound, "key not found")
+			return
+		}
+		logInfo("管理接口 | 删除 Key: %s", maskKey(key))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// 上游会话
+// ---------------------------------------------------------------------------
+
+// SessionInfo 上游会话概要
+type SessionInfo struct {
+	Kind       string    `json:"kind"` // account 或 guest
+	Tenant     string    `json:"tenant"`
+	ProxyIndex int       `json:"proxy_index"`
+	Slot       int       `json:"slot"`
+	Container  string    `json:"container,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	InFlight   int       `json:"in_flight"`
+}
+
+// listSessions 返回当前所有账户与游客会话
+func (g *Gateway) listSessions() []SessionInfo {
+	g.sessionMu.RLock()
+	defer g.sessionMu.RUnlock()
+
+	list := make([]SessionInfo, 0, len(g.accounts)+len(g.sessions))
+	for key, account := range g.accounts {
+		account.mu.Lock()
+		list = append(list, SessionInfo{
+			Kind:       "account",
+			Tenant:     key.Tenant,
+			ProxyIndex: key.ProxyIndex,
+			Slot:       key.Slot,
+			Container:  g.proxyMgr.containerName(key.ProxyIndex),
+			Email:      account.Email,
+			CreatedAt:  account.CreatedAt,
+			LastUsedAt: account.LastUsedAt,
+			InFlight:   account.inflight,
+		})
+		account.mu.Unlock()
+	}
+	for key, session := range g.sessions {
+		session.mu.Lock()
+		list = append(list, SessionInfo{
+			Kind:       "guest",
+			Tenant:     key.Tenant,
+			ProxyIndex: key.ProxyIndex,
+			Slot:       key.Slot,
+			Container:  g.proxyMgr.containerName(key.ProxyIndex),
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			InFlight:   session.inflight,
+		})
+		session.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Kind != list[j].Kind {
+			return list[i].Kind < list[j].Kind
+		}
+		if list[i].Tenant != list[j].Tenant {
+			return list[i].Tenant < list[j].Tenant
+		}
+		if list[i].ProxyIndex != list[j].ProxyIndex {
+			return list[i].ProxyIndex < list[j].ProxyIndex
+		}
+		return list[i].Slot < list[j].Slot
+	})
+	return list
+}
+
+// clearAllSessions 清空所有账户与游客会话，返回清除数量
+func (g *Gateway) clearAllSessions() int {
+	g.sessionMu.Lock()
+	defer g.sessionMu.Unlock()
+	n := len(g.accounts) + len(g.sessions)
+	g.accounts = make(map[sessionKey]*Account)
+	g.sessions = make(map[sessionKey]*GuestSession)
+	g.notifyPoolLocked()
+	return n
+}
+
+// clearProxySessions 清除指定代理上的会话，kind/tenant 为空表示不过滤，返回清除数量
+func (g *Gateway) clearProxySessions(proxyIndex int, kind, tenant string) int {
+	g.sessionMu.Lock()
+	defer g.sessionMu.Unlock()
+
+	match := func(key sessionKey) bool {
+		return key.ProxyIndex == proxyIndex && (tenant == "" || key.Tenant == tenant)
+	}
+	n := 0
+	if kind == "" || kind == "account" {
+		for key := range g.accounts {
+			if match(key) {
+				delete(g.accounts, key)
+				n++
+			}
+		}
+	}
+	if kind == "" || kind == "guest" {
+		for key := range g.sessions {
+			if match(key) {
+				delete(g.sessions, key)
+				n++
+			}
+		}
+	}
+	g.notifyPoolLocked()
+	return n
+}
+
+// handleSessions GET 列出会话，DELETE 清空所有会话
+func (a *AdminServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"sessions": a.gateway.listSessions()})
+	case http.MethodDelete:
+		n := a.gateway.clearAllSessions()
+		logInfo("管理接口 | 清空上游会话: %d 个", n)
+		writeAdminJSON(w, http.StatusOK, map[string]int{"dropped": n})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleSession DELETE /admin/sessions/{proxyIndex}?kind=account|guest&tenant=xxx，参数为空时不过滤
+func (a *AdminServer) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	proxyIndex, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/admin/sessions/"))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid proxy index")
+		return
+	}
+
+	kind := r.URL.Query().Get("kind")
+	if kind != "" && kind != "account" && kind != "guest" {
+		writeAdminError(w, http.StatusBadRequest, "kind must be account or guest")
+		return
+	}
+	tenant := r.URL.Query().Get("tenant")
+	n := a.gateway.clearProxySessions(proxyIndex, kind, tenant)
+	logInfo("管理接口 | 清除上游会话 | 代理: [%d], 类型: %s, 租户: %s, 数量: %d", proxyIndex, kind, tenant, n)
+	writeAdminJSON(w, http.StatusOK, map[string]int{"dropped": n})
+}
+
+// ---------------------------------------------------------------------------
+// 运行状态
+// ---------------------------------------------------------------------------
+
+// InflightRequest 处理中的请求概要
+type InflightRequest struct {
+	ID        string    `json:"id"`
+	Endpoint  string    `json:"endpoint"`
+	Model     string    `json:"model"`
+	Stream    bool      `json:"stream"`
+	Key       string    `json:"key,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	ElapsedMs int64     `json:"elapsed_ms"`
+}
+
+func (a *AdminServer) handleRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	g := a.gateway
+	g.inflightMu.Lock()
+	list := make([]InflightRequest, 0, len(g.inflight))
+	for rc := range g.inflight {
+		item := InflightRequest{
+			ID:        rc.ID,
+			Endpoint:  rc.Endpoint,
+			Model:     rc.Model,
+			Stream:    rc.Stream,
+			StartedAt: rc.StartTime,
+			ElapsedMs: time.Since(rc.StartTime).Milliseconds(),
+		}
+		if rc.Key != nil {
+			item.Key = rc.Key.label()
+		}
+		list = append(list, item)
+	}
+	g.inflightMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"requests": list})
+}
+
+// handleConfig 返回生效配置（不含密钥），日志级别取运行时值
+func (a *AdminServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	effective := *a.cfg
+	effective.LogLevel = logger.LevelName()
+	effective.WarpProxies = redactProxyList(effective.WarpProxies)
+	writeAdminJSON(w, http.StatusOK, effective)
+}
+
+// redactProxyList 隐藏代理地址（单个或逗号分隔的列表）中的密码，用于日志和配置输出
+func redactProxyList(proxies string) string {
+	parts := strings.Split(proxies, ",")
+	for i, p := range parts {
+		if u, err := url.Parse(strings.TrimSpace(p)); err == nil && u.User != nil {
+			parts[i] = u.Redacted()
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// handleLogLevel GET 查看日志级别，PUT {"level":"debug"} 修改日志级别
+func (a *AdminServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, map[string]string{"level": logger.LevelName()})
+	case http.MethodPut:
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		if err := logger.SetLevel(body.Level); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		logWarn("管理接口 | 日志级别修改为: %s", logger.LevelName())
+		writeAdminJSON(w, http.StatusOK, map[string]string{"level": logger.LevelName()})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// 审计日志
+// ============================================================================
+
+// auditMagic 加密审计文件首行的格式标识，其后为 base64 盐值；首行整体作为每条记录的附加认证数据
+const auditMagic = "CGA2"
+
+// auditMaxBody 单个请求体最多记录的字节数，超出部分截断
+const auditMaxBody = 8 << 20
+
+// auditSweepInterval 检查文件轮转与过期的间隔
+const auditSweepInterval = time.Minute
+
+// AuditConfig 审计日志参数
+type AuditConfig struct {
+	Dir            string        `json:"dir"`             // 审计文件目录，为空时不记录
+	MaxBytes       int64         `json:"max_bytes"`       // 单个文件达到该大小后轮转
+	RotateInterval time.Duration `json:"rotate_interval"` // 单个文件最长写入时间
+	Retention      time.Duration `json:"retention"`       // 文件保留时间，0 表示不删除
+	Key            string        `json:"-"`               // 加密口令，为空时写入明文
+}
+
+// AuditRecord 一条审计记录：调用方发来的原始请求、发往上游的 ChatRequest 和最终返回的回复
+type AuditRecord struct {
+	Time             time.Time       `json:"time"`
+	RequestID        string          `json:"request_id"`
+	Key              string          `json:"key"`
+	Endpoint         string          `json:"endpoint"`
+	Model            string          `json:"model,omitempty"`
+	Status           int             `json:"status"`
+	ErrorClass       string          `json:"error_class,omitempty"`
+	ContentFlags     []string        `json:"content_flags,omitempty"`
+	Cached           bool            `json:"cached,omitempty"`
+	Coalesced        bool            `json:"coalesced,omitempty"`
+	Request          json.RawMessage `json:"request,omitempty"`
+	RequestTruncated bool            `json:"request_truncated,omitempty"`
+	Upstream         *ChatRequest    `json:"upstream,omitempty"`
+	Response         string          `json:"response,omitempty"`
+}
+
+// AuditRedactor 写入前对记录中的文本做脱敏
+type AuditRedactor func(text string) string
+
+// auditEntry 处理过程中收集的审计内容，nil 表示该请求不审计
+type auditEntry struct {
+	request   bytes.Buffer
+	truncated bool
+	upstream  *ChatRequest
+	response  strings.Builder
+}
+
+// Write 记录请求体，超出 auditMaxBody 的部分丢弃
+func (e *auditEntry) Write(p []byte) (int, error) {
+	if room := auditMaxBody - e.request.Len(); len(p) > room {
+		e.request.Write(p[:room])
+		e.truncated = true
+	} else {
+		e.request.Write(p)
+	}
+	return len(p), nil
+}
+
+// output 追加发给调用方的回复文本
+func (e *auditEntry) output(text string) {
+	if e != nil {
+		e.response.WriteString(text)
+	}
+}
+
+// setUpstream 记录发往上游的请求，重试时以最后一次为准
+func (e *auditEntry) setUpstream(chatReq ChatRequest) {
+	if e != nil {
+		e.upstream = &chatReq
+	}
+}
+
+// AuditLog 按 Key 开启的审计日志，JSONL 格式，按大小和时间轮转
+type AuditLog struct {
+	cfg       AuditConfig
+	aead      cipher.AEAD // nil 表示不加密
+	header    []byte      // 加密文件首行：magic + base64 盐值
+	redactors []AuditRedactor
+
+	mu      sync.RWMutex
+	closed  bool
+	queue   chan AuditRecord
+	done    chan struct{}
+	dropped uint64
+
+	// 以下字段只在 writeLoop 中访问
+	file   *os.File
+	path   string
+	size   int64
+	opened time.Time
+}
+
+// NewAuditLog 创建审计目录并启动写入协程；redactions 为 CONFIG_FILE 中的 audit_redactions，规则一律按脱敏处理
+func NewAuditLog(cfg AuditConfig, redactions []FilterRule) (*AuditLog, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("创建审计目录失败: %w", err)
+	}
+	al := &AuditLog{
+		cfg:   cfg,
+		queue: make(chan AuditRecord, 1024),
+		done:  make(chan struct{}),
+	}
+	if cfg.Key != "" {
+		salt, err := newSalt()
+		if err != nil {
+			return nil, err
+		}
+		if al.aead, err = newPassphraseAEAD(cfg.Key, salt); err != nil {
+			return nil, err
+		}
+		al.header = auditHeader(salt)
+	}
+
+	rules := make([]FilterRule, len(redactions))
+	for i, rule := range redactions {
+		rule.Action, rule.Direction = filterRedact, filterBoth
+		rules[i] = rule
+	}
+	cf, err := NewContentFilter(rules)
+	if err != nil {
+		return nil, fmt.Errorf("审计脱敏规则: %w", err)
+	}
+	if cf != nil {
+		al.AddRedactor(func(text string) string {
+			out, _ := applyFilterRules(cf.input, text, func(*FilterRule, int) {})
+			return out
+		})
+	}
+
+	go al.writeLoop()
+	return al, nil
+}
+
+// auditHeader 加密文件首行，不含换行
+func auditHeader(salt []byte) []byte {
+	return []byte(auditMagic + " " + base64.StdEncoding.EncodeToString(salt))
+}
+
+// AddRedactor 追加脱敏钩子，按添加顺序执行；须在处理请求前调用
+func (al *AuditLog) AddRedactor(fn AuditRedactor) {
+	al.redactors = append(al.redactors, fn)
+}
+
+func (al *AuditLog) redact(text string) string {
+	for _, fn := range al.redactors {
+		text = fn(text)
+	}
+	return text
+}
+
+// redactRecord 对请求体、上游消息和回复脱敏；请求体脱敏后不再是合法 JSON 时按字符串记录
+func (al *AuditLog) redactRecord(rec *AuditRecord) {
+	if len(al.redactors) == 0 {
+		return
+	}
+	if len(rec.Request) > 0 {
+		redacted := al.redact(string(rec.Request))
+		if !json.Valid([]byte(redacted)) {
+			quoted, _ := json.Marshal(redacted)
+			redacted = string(quoted)
+		}
+		rec.Request = json.RawMessage(redacted)
+	}
+	if rec.Upstream != nil {
+		upstream := *rec.Upstream
+		upstream.Message.Parts = make([]MessagePart, len(rec.Upstream.Message.Parts))
+		for i, part := range rec.Upstream.Message.Parts {
+			part.Text = al.redact(part.Text)
+			upstream.Message.Parts[i] = part
+		}
+		rec.Upstream = &upstream
+	}
+	rec.Response = al.redact(rec.Response)
+}
+
+// Record 异步写入一条记录，队列满或已关闭时丢弃
+func (al *AuditLog) Record(rec AuditRecord) {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+	if al.closed {
+		return
+	}
+	select {
+	case al.queue <- rec:
+	default:
+		if atomic.AddUint64(&al.dropped, 1)%100 == 1 {
+			logWarn("审计日志队列已满，丢弃记录 | 累计: %d", atomic.LoadUint64(&al.dropped))
+		}
+	}
+}
+
+// writeLoop 顺序写入记录，定期检查轮转与过期文件
+func (al *AuditLog) writeLoop() {
+	defer close(al.done)
+
+	ticker := time.NewTicker(auditSweepInterval)
+	defer ticker.Stop()
+	al.removeExpired()
+
+	for {
+		select {
+		case rec, ok := <-al.queue:
+			if !ok {
+				al.closeFile()
+				return
+			}
+			if err := al.write(rec); err != nil {
+				logError("审计日志写入失败 | 请求: %s, 错误: %v", rec.RequestID, err)
+			}
+		case <-ticker.C:
+			if al.file != nil && al.cfg.RotateInterval > 0 && time.Since(al.opened) >= al.cfg.RotateInterval {
+				al.closeFile()
+			}
+			al.removeExpired()
+		}
+	}
+}
+
+func (al *AuditLog) write(rec AuditRecord) error {
+	al.redactRecord(&rec)
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if al.aead != nil {
+		if line, err = al.seal(line); err != nil {
+			return err
+		}
+	}
+	line = append(line, '\n')
+
+	if al.file != nil && (al.size > al.headerSize() && al.size+int64(len(line)) > al.cfg.MaxBytes ||
+		al.cfg.RotateInterval > 0 && time.Since(al.opened) >= al.cfg.RotateInterval) {
+		al.closeFile()
+	}
+	if al.file == nil {
+		if err := al.openFile(); err != nil {
+			return err
+		}
+	}
+	n, err := al.file.Write(line)
+	al.size += int64(n)
+	return err
+}
+
+// seal 加密一行：base64(nonce + 密文)，附加认证数据为文件首行
+func (al *AuditLog) seal(plain []byte) ([]byte, error) {
+	nonce := make([]byte, al.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := al.aead.Seal(nonce, nonce, plain, al.header)
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(out, sealed)
+	return out, nil
+}
+
+// headerSize 文件首行（含换行）占用的字节数，明文文件为 0
+func (al *AuditLog) headerSize() int64 {
+	if al.header == nil {
+		return 0
+	}
+	return int64(len(al.header) + 1)
+}
+
+// auditFileExt 明文与加密文件的扩展名
+func (al *AuditLog) auditFileExt() string {
+	if al.aead != nil {
+		return ".jsonl.enc"
+	}
+	return ".jsonl"
+}
+
+func (al *AuditLog) openFile() error {
+	now := time.Now()
+	base := "audit-" + now.Format("20060102-150405.000")
+	var f *os.File
+	var path string
+	for i := 0; ; i++ {
+		// 同一毫秒内多次轮转时加序号，避免写入已有文件
+		name := base
+		if i > 0 {
+			name += fmt.Sprintf("-%d", i)
+		}
+		path = filepath.Join(al.cfg.Dir, name+al.auditFileExt())
+		var err error
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) || i >= 100 {
+			return err
+		}
+	}
+	var size int64
+	if al.header != nil {
+		n, err := f.Write(append(append([]byte{}, al.header...), '\n'))
+		if err != nil {
+			f.Close()
+			return err
+		}
+		size = int64(n)
+	}
+	al.file, al.path, al.size, al.opened = f, path, size, now
+	logInfo("审计日志文件: %s", path)
+	return nil
+}
+
+func (al *AuditLog) closeFile() {
+	if al.file == nil {
+		return
+	}
+	if err := al.file.Close(); err != nil {
+		logError("审计日志关闭失败 | 文件: %s, 错误: %v", al.path, err)
+	}
+	al.file = nil
+}
+
+// removeExpired 删除修改时间早于保留期的审计文件
+func (al *AuditLog) removeExpired() {
+	if al.cfg.Retention <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(al.cfg.Dir)
+	if err != nil {
+		logError("审计目录读取失败: %v", err)
+		return
+	}
+	cutoff := time.Now().Add(-al.cfg.Retention)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "audit-") || !(strings.HasSuffix(name, ".jsonl") || strings.HasSuffix(name, ".jsonl.enc")) {
+			continue
+		}
+		path := filepath.Join(al.cfg.Dir, name)
+		if al.file != nil && path == al.path {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			logError("审计日志删除失败 | 文件: %s, 错误: %v", name, err)
+			continue
+		}
+		logInfo("审计日志已过期删除: %s", name)
+	}
+}
+
+// Close 写完队列中的记录并关闭文件
+func (al *AuditLog) Close() {
+	if al == nil {
+		return
+	}
+	al.mu.Lock()
+	if al.closed {
+		al.mu.Unlock()
+		return
+	}
+	al.closed = true
+	close(al.queue)
+	al.mu.Unlock()
+	<-al.done
+}
+
+// ---------------------------------------------------------------------------
+// 网关集成
+// ---------------------------------------------------------------------------
+
+// auditRequest Key 开启审计时开始收集：请求体在解析时同步记录
+func (g *Gateway) auditRequest(r *http.Request, rc *RequestContext) {
+	if g.audit == nil || rc.Key == nil || !rc.Key.Audit {
+		return
+	}
+	rc.audit = &auditEntry{}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(r.Body, rc.audit), r.Body}
+}
+
+// recordAudit 请求结束时写入审计记录
+func (g *Gateway) recordAudit(rc *RequestContext, rec UsageRecord) {
+	e := rc.audit
+	if g.audit == nil || e == nil {
+		return
+	}
+	entry := AuditRecord{
+		Time:             rec.Time,
+		RequestID:        rec.RequestID,
+		Key:              rec.Key,
+		Endpoint:         rec.Endpoint,
+		Model:            rec.Model,
+		Status:           rec.Status,
+		ErrorClass:       rec.ErrorClass,
+		ContentFlags:     rc.ContentFlags,
+		Cached:           rec.Cached,
+		Coalesced:        rec.Coalesced,
+		RequestTruncated: e.truncated,
+		Upstream:         e.upstream,
+		Response:         e.response.String(),
+	}
+	if body := bytes.TrimSpace(e.request.Bytes()); len(body) > 0 {
+		if json.Valid(body) {
+			entry.Request = json.RawMessage(body)
+		} else {
+			quoted, _ := json.Marshal(string(body))
+			entry.Request = json.RawMessage(quoted)
+		}
+	}
+	g.audit.Record(entry)
+}
+
+// ---------------------------------------------------------------------------
+// 命令行：解密审计文件
+// ---------------------------------------------------------------------------
+
+// runAuditDecrypt 用 AUDIT_KEY 解密审计文件，按行输出明文 JSONL
+func runAuditDecrypt(args []string) error {
+	if len(args) == 0 {
+		return errors.New("用法: audit-decrypt <审计文件> ...")
+	}
+	secret := getEnv("AUDIT_KEY", "")
+	if secret == "" {
+		return errors.New("未设置 AUDIT_KEY")
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, path := range args {
+		if err := decryptAuditFile(out, path, secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptAuditFile 解密单个审计文件写入 w：按首行文件头中的盐值经 scrypt 派生密钥，首行整体作为附加认证数据
+func decryptAuditFile(w io.Writer, path, secret string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s 缺少 %s 文件头", path, auditMagic)
+	}
+	header := scanner.Text()
+	rest, ok := strings.CutPrefix(header, auditMagic+" ")
+	salt, err := base64.StdEncoding.DecodeString(rest)
+	if !ok || err != nil || len(salt) != kdfSaltSize {
+		return fmt.Errorf("%s 缺少 %s 文件头或文件头格式无法识别", path, auditMagic)
+	}
+	aead, err := newPassphraseAEAD(secret, salt)
+	if err != nil {
+		return err
+	}
+
+	for n := 2; scanner.Scan(); n++ {
+		sealed, err := base64.StdEncoding.DecodeString(scanner.Text())
+		if err != nil || len(sealed) < aead.NonceSize() {
+			return fmt.Errorf("%s 第 %d 行格式无法识别", path, n)
+		}
+		plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(header))
+		if err != nil {
+			return fmt.Errorf("%s 第 %d 行解密失败（密钥错误或文件损坏）", path, n)
+		}
+		if _, err := w.Write(append(plain, '\n')); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
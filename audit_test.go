@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAuditRecord(id, text string) AuditRecord {
+	return AuditRecord{
+		Time:      time.Now().UTC(),
+		RequestID: id,
+		Key:       "key-test",
+		Endpoint:  "/v1/chat/completions",
+		Model:     "gpt-4o",
+		Status:    200,
+		Request:   json.RawMessage(`{"messages":[{"role":"user","content":"` + text + `"}]}`),
+		Upstream:  &ChatRequest{Message: Message{Parts: []MessagePart{{Text: text}}}},
+		Response:  "回复: " + text,
+	}
+}
+
+// auditFiles 按文件名排序列出审计文件
+func auditFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, entry := range entries {
+		files = append(files, filepath.Join(dir, entry.Name()))
+	}
+	sort.Strings(files)
+	return files
+}
+
+// readAuditRecords 读取审计文件中的记录，加密文件先用 secret 解密
+func readAuditRecords(t *testing.T, path, secret string) []AuditRecord {
+	t.Helper()
+	var data []byte
+	if secret != "" {
+		var buf bytes.Buffer
+		if err := decryptAuditFile(&buf, path, secret); err != nil {
+			t.Fatalf("解密 %s 失败: %v", path, err)
+		}
+		data = buf.Bytes()
+	} else {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var records []AuditRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("记录不是合法 JSON: %v\n%s", err, scanner.Text())
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestAuditEncryptedRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	al, err := NewAuditLog(AuditConfig{Dir: dir, MaxBytes: 1 << 20, Key: "passphrase"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	al.Record(testAuditRecord("req-1", "机密内容"))
+	al.Record(testAuditRecord("req-2", "机密内容"))
+	al.Close()
+
+	files := auditFiles(t, dir)
+	if len(files) != 1 || !strings.HasSuffix(files[0], ".jsonl.enc") {
+		t.Fatalf("应生成一个加密文件: %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(auditMagic+" ")) {
+		t.Fatalf("首行应为文件头: %q", data[:min(len(data), 40)])
+	}
+	if bytes.Contains(data, []byte("机密内容")) || bytes.Contains(data, []byte("req-1")) {
+		t.Fatal("加密文件中不应出现明文")
+	}
+
+	records := readAuditRecords(t, files[0], "passphrase")
+	if len(records) != 2 || records[0].RequestID != "req-1" || records[1].RequestID != "req-2" {
+		t.Fatalf("解密记录不符: %+v", records)
+	}
+	if records[0].Upstream == nil || records[0].Upstream.Message.Parts[0].Text != "机密内容" {
+		t.Fatalf("上游请求未完整记录: %+v", records[0].Upstream)
+	}
+
+	// 同一口令的另一个实例盐值不同
+	other, err := NewAuditLog(AuditConfig{Dir: t.TempDir(), Key: "passphrase"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+	if bytes.Equal(other.header, al.header) {
+		t.Fatal("每个实例应生成不同的盐值")
+	}
+
+	if err := decryptAuditFile(&bytes.Buffer{}, files[0], "wrong"); err == nil {
+		t.Fatal("口令错误时应解密失败")
+	}
+}
+
+func TestAuditRejectsTampering(t *testing.T) {
+	dir := t.TempDir()
+	al, err := NewAuditLog(AuditConfig{Dir: dir, MaxBytes: 1 << 20, Key: "passphrase"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	al.Record(testAuditRecord("req-1", "内容"))
+	al.Close()
+	path := auditFiles(t, dir)[0]
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, body, _ := bytes.Cut(data, []byte("\n"))
+
+	// 换一个文件头盐值：派生出的密钥不同，附加认证数据也不同
+	salt := make([]byte, kdfSaltSize)
+	rand.Read(salt)
+	forged := append(append(auditHeader(salt), '\n'), body...)
+	if err := os.WriteFile(path, forged, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := decryptAuditFile(&bytes.Buffer{}, path, "passphrase"); err == nil {
+		t.Fatal("文件头被替换后应解密失败")
+	}
+
+	// 篡改密文
+	sealed, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	sealed[len(sealed)-1] ^= 1
+	tampered := append(append(header, '\n'), base64.StdEncoding.EncodeToString(sealed)+"\n"...)
+	if err := os.WriteFile(path, tampered, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := decryptAuditFile(&bytes.Buffer{}, path, "passphrase"); err == nil {
+		t.Fatal("密文被篡改后应解密失败")
+	}
+}
+
+// 没有 CGA2 文件头的文件拒绝解密
+func TestAuditDecryptRequiresHeader(t *testing.T) {
+	dir := t.TempDir()
+	line, _ := json.Marshal(testAuditRecord("req-1", "内容"))
+	for name, data := range map[string]string{
+		"empty.jsonl.enc":      "",
+		"headless.jsonl.enc":   base64.StdEncoding.EncodeToString(line) + "\n",
+		"bad-salt.jsonl.enc":   auditMagic + " !!\n",
+		"short-salt.jsonl.enc": auditMagic + " " + base64.StdEncoding.EncodeToString([]byte("short")) + "\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := decryptAuditFile(&bytes.Buffer{}, path, "passphrase"); err == nil || !strings.Contains(err.Error(), "文件头") {
+			t.Fatalf("%s: 应报告缺少文件头, 错误: %v", name, err)
+		}
+	}
+}
+
+func TestAuditRedaction(t *testing.T) {
+	dir := t.TempDir()
+	rules := []FilterRule{
+		// action 与 direction 会被统一改为 redact / both
+		{Name: "email", Detector: "email", Action: filterBlock, Direction: filterOutput},
+		{Name: "quote", Words: []string{"内部代号"}, Replacement: `"`},
+	}
+	al, err := NewAuditLog(AuditConfig{Dir: dir, MaxBytes: 1 << 20}, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	al.AddRedactor(func(text string) string { return strings.ReplaceAll(text, "张三", "[NAME]") })
+	al.Record(testAuditRecord("req-1", "张三 的邮箱 alice@example.com"))
+	al.Record(testAuditRecord("req-2", "内部代号"))
+	al.Close()
+
+	files := auditFiles(t, dir)
+	if len(files) != 1 || !strings.HasSuffix(files[0], ".jsonl") {
+		t.Fatalf("应生成一个明文文件: %v", files)
+	}
+	data, _ := os.ReadFile(files[0])
+	for _, secret := range []string{"alice@example.com", "张三", "内部代号"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Fatalf("审计文件中不应出现 %q", secret)
+		}
+	}
+
+	records := readAuditRecords(t, files[0], "")
+	if len(records) != 2 {
+		t.Fatalf("记录数 = %d", len(records))
+	}
+	first := records[0]
+	want := "[NAME] 的邮箱 [REDACTED:email]"
+	if !strings.Contains(string(first.Request), want) || first.Upstream.Message.Parts[0].Text != want || first.Response != "回复: "+want {
+		t.Fatalf("脱敏结果不符: request=%s upstream=%q response=%q", first.Request, first.Upstream.Message.Parts[0].Text, first.Response)
+	}
+
+	// 脱敏后不再是合法 JSON 的请求体按字符串记录
+	var quoted string
+	if err := json.Unmarshal(records[1].Request, &quoted); err != nil || !strings.Contains(quoted, `"content":"""`) {
+		t.Fatalf("请求体应按字符串记录: %s", records[1].Request)
+	}
+}
+
+func TestAuditRotation(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		ext  string
+	}{
+		{"明文", "", ".jsonl"},
+		{"加密", "passphrase", ".jsonl.enc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// 上限小于单条记录：每个文件只写一条，不会因超限写不进去
+			al, err := NewAuditLog(AuditConfig{Dir: dir, MaxBytes: 1, Key: tt.key}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"req-1", "req-2", "req-3"} {
+				al.Record(testAuditRecord(id, "内容"))
+			}
+			al.Close()
+
+			files := auditFiles(t, dir)
+			if len(files) != 3 {
+				t.Fatalf("应轮转出 3 个文件: %v", files)
+			}
+			var ids []string
+			for _, path := range files {
+				if !strings.HasSuffix(path, tt.ext) {
+					t.Fatalf("扩展名不符: %s", path)
+				}
+				records := readAuditRecords(t, path, tt.key)
+				if len(records) != 1 {
+					t.Fatalf("%s 应只有一条记录: %+v", path, records)
+				}
+				ids = append(ids, records[0].RequestID)
+			}
+			sort.Strings(ids)
+			if strings.Join(ids, ",") != "req-1,req-2,req-3" {
+				t.Fatalf("记录不完整: %v", ids)
+			}
+		})
+	}
+}
+
+func TestAuditRemoveExpired(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"audit-old.jsonl", "audit-old.jsonl.enc", "other.jsonl"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("x\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, old, old)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "audit-new.jsonl"), []byte("x\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	al, err := NewAuditLog(AuditConfig{Dir: dir, Retention: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	al.Close()
+
+	var names []string
+	for _, path := range auditFiles(t, dir) {
+		names = append(names, filepath.Base(path))
+	}
+	if strings.Join(names, ",") != "audit-new.jsonl,other.jsonl" {
+		t.Fatalf("过期文件处理不符: %v", names)
+	}
+}
+
+func TestAuditRecordAfterClose(t *testing.T) {
+	dir := t.TempDir()
+	al, err := NewAuditLog(AuditConfig{Dir: dir, MaxBytes: 1 << 20}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			al.Record(testAuditRecord("req", "内容"))
+		}
+	}()
+	al.Close()
+	<-done
+
+	// 关闭后的记录直接丢弃，重复关闭无副作用
+	al.Record(testAuditRecord("late", "内容"))
+	al.Close()
+	for _, path := range auditFiles(t, dir) {
+		for _, rec := range readAuditRecords(t, path, "") {
+			if rec.RequestID == "late" {
+				t.Fatal("关闭后的记录不应写入")
+			}
+		}
+	}
+}
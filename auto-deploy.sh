@@ -109,13 +109,13 @@ cd /opt/chat-gateway
 if [ ! -f "main.go" ]; then
     echo "❌ 错误：找不到 main.go 文件"
     echo "请先上传以下文件到 /opt/chat-gateway/："
-    echo "  - main.go"
+    echo "  - *.go（main.go 等全部源码文件）"
     echo "  - go.mod"
     echo "  - go.sum"
     echo "  - Dockerfile"
     echo ""
     echo "上传命令示例："
-    echo "  scp main.go go.mod go.sum Dockerfile root@your-server:/opt/chat-gateway/"
+    echo "  scp *.go go.mod go.sum Dockerfile root@your-server:/opt/chat-gateway/"
     exit 1
 fi
 
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// 上游熔断
+// ============================================================================
+
+// 熔断状态
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// BreakerConfig 熔断参数
+type BreakerConfig struct {
+	Window        int           `json:"window"`         // 统计最近多少次请求
+	MinRequests   int           `json:"min_requests"`   // 窗口内请求数达到该值才判断错误率
+	ErrorRate     float64       `json:"error_rate"`     // 错误率阈值（慢请求计为错误）
+	SlowThreshold time.Duration `json:"slow_threshold"` // 上游响应头超过该时间视为慢请求
+	OpenDuration  time.Duration `json:"open_duration"`  // 熔断后多久开始探测
+	ProbeInterval time.Duration `json:"probe_interval"` // 健康探测间隔
+}
+
+// Breaker 单个上游（代理出口）的熔断器
+type Breaker struct {
+	ProxyIndex int
+	cfg        BreakerConfig
+
+	state       string
+	outcomes    []bool // 环形窗口，true 表示失败
+	next        int
+	filled      int
+	openedAt    time.Time
+	trialAt     time.Time // 半开状态下试探请求的发出时间，零值表示没有试探中的请求
+	lastError   string
+	transitions uint64
+	successes   uint64
+	failures    uint64
+	rejected    uint64
+	mu          sync.Mutex
+}
+
+func newBreaker(proxyIndex int, cfg BreakerConfig) *Breaker {
+	return &Breaker{
+		ProxyIndex: proxyIndex,
+		cfg:        cfg,
+		state:      breakerClosed,
+		outcomes:   make([]bool, cfg.Window),
+	}
+}
+
+// allow 判断是否放行请求；半开状态同一时间只放行一个试探请求，
+// 放行试探请求时返回其发出时间，请求结束时需调用 releaseTrial
+func (b *Breaker) allow() (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		b.rejected++
+		return time.Time{}, false
+	case breakerHalfOpen:
+		// 试探请求长时间没有结果时允许新的试探，作为 releaseTrial 之外的兜底
+		if !b.trialAt.IsZero() && time.Since(b.trialAt) < b.cfg.OpenDuration {
+			b.rejected++
+			return time.Time{}, false
+		}
+		b.trialAt = time.Now()
+		return b.trialAt, true
+	}
+	return time.Time{}, true
+}
+
+// releaseTrial 试探请求没有产生结果就结束（4xx、客户端断开、内容过滤等）时归还试探名额；
+// 已经由 record 决定了状态的不受影响
+func (b *Breaker) releaseTrial(trialAt time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen && b.trialAt.Equal(trialAt) {
+		b.trialAt = time.Time{}
+	}
+}
+
+// record 记录一次上游请求结果，熔断因此打开时返回 true
+func (b *Breaker) record(failed bool, reason string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if failed {
+		b.failures++
+		b.lastError = reason
+	} else {
+		b.successes++
+	}
+
+	switch b.state {
+	case breakerHalfOpen:
+		if failed {
+			b.transitionLocked(breakerOpen, "试探请求失败: "+reason)
+			return true
+		}
+		b.transitionLocked(breakerClosed, "试探请求成功")
+		return false
+	case breakerOpen:
+		return false
+	}
+
+	b.outcomes[b.next] = failed
+	b.next = (b.next + 1) % len(b.outcomes)
+	if b.filled < len(b.outcomes) {
+		b.filled++
+	}
+
+	if b.filled >= b.cfg.MinRequests {
+		if rate := b.errorRateLocked(); rate >= b.cfg.ErrorRate {
+			b.transitionLocked(breakerOpen, fmt.Sprintf("错误率 %.0f%%（最近 %d 次），最近错误: %s", rate*100, b.filled, reason))
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Breaker) errorRateLocked() float64 {
+	if b.filled == 0 {
+		return 0
+	}
+	failed := 0
+	for i := 0; i < b.filled; i++ {
+		if b.outcomes[i] {
+			failed++
+		}
+	}
+	return float64(failed) / float64(b.filled)
+}
+
+func (b *Breaker) transitionLocked(state, reason string) {
+	if b.state == state {
+		return
+	}
+	logWarn("熔断状态变更 | 代理: [%d], %s -> %s, 原因: %s", b.ProxyIndex, b.state, state, reason)
+	b.state = state
+	b.transitions++
+	b.trialAt = time.Time{}
+	switch state {
+	case breakerOpen:
+		b.openedAt = time.Now()
+	case breakerClosed:
+		b.outcomes = make([]bool, len(b.outcomes))
+		b.next, b.filled = 0, 0
+	}
+}
+
+// retryAfter 熔断打开时建议客户端的重试等待时间
+func (b *Breaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerOpen {
+		return 0
+	}
+	if d := b.cfg.OpenDuration - time.Since(b.openedAt); d > 0 {
+		return d
+	}
+	return b.cfg.ProbeInterval
+}
+
+// BreakerStatus 熔断器概要
+type BreakerStatus struct {
+	ProxyIndex  int       `json:"proxy_index"`
+	Container   string    `json:"container,omitempty"`
+	State       string    `json:"state"`
+	ErrorRate   float64   `json:"error_rate"`
+	Window      int       `json:"window"` // 窗口内已记录的请求数
+	OpenedAt    time.Time `json:"opened_at,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	Transitions uint64    `json:"transitions"`
+	Successes   uint64    `json:"successes"`
+	Failures    uint64    `json:"failures"`
+	Rejected    uint64    `json:"rejected"`
+}
+
+func (b *Breaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStatus{
+		ProxyIndex:  b.ProxyIndex,
+		State:       b.state,
+		ErrorRate:   b.errorRateLocked(),
+		Window:      b.filled,
+		OpenedAt:    b.openedAt,
+		LastError:   b.lastError,
+		Transitions: b.transitions,
+		Successes:   b.successes,
+		Failures:    b.failures,
+		Rejected:    b.rejected,
+	}
+}
+
+// ---------------------------------------------------------------------------
+// 网关集成
+// ---------------------------------------------------------------------------
+
+// BreakerSet 按代理索引管理熔断器，-1 表示直连
+type BreakerSet struct {
+	cfg      BreakerConfig
+	breakers map[int]*Breaker
+	mu       sync.Mutex
+}
+
+func NewBreakerSet(cfg BreakerConfig) *BreakerSet {
+	if cfg.Window < 1 {
+		cfg.Window = 1
+	}
+	if cfg.MinRequests > cfg.Window {
+		cfg.MinRequests = cfg.Window
+	}
+	return &BreakerSet{cfg: cfg, breakers: make(map[int]*Breaker)}
+}
+
+func (bs *BreakerSet) get(proxyIndex int) *Breaker {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, exists := bs.breakers[proxyIndex]
+	if !exists {
+		b = newBreaker(proxyIndex, bs.cfg)
+		bs.breakers[proxyIndex] = b
+	}
+	return b
+}
+
+func (bs *BreakerSet) all() []*Breaker {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	list := make([]*Breaker, 0, len(bs.breakers))
+	for _, b := range bs.breakers {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ProxyIndex < list[j].ProxyIndex })
+	return list
+}
+
+// checkBreaker 在取得会话后按会话所在的代理检查熔断，熔断时直接返回 503。
+// 放行时返回的函数须在请求结束时调用，归还半开状态下未产生结果的试探名额
+func (g *Gateway) checkBreaker(w http.ResponseWriter, rc *RequestContext, proxyIndex int, protocol apiProtocol) (func(), bool) {
+	if g.breakers == nil {
+		return func() {}, true
+	}
+	b := g.breakers.get(proxyIndex)
+	if trialAt, ok := b.allow(); ok {
+		if trialAt.IsZero() {
+			return func() {}, true
+		}
+		logInfo("%s | 熔断半开，作为试探请求放行 | 代理: [%d]", rc.ID, proxyIndex)
+		return func() { b.releaseTrial(trialAt) }, true
+	}
+
+	logWarn("%s | 上游已熔断，快速失败 | 代理: [%d]", rc.ID, proxyIndex)
+	rc.ErrorClass = errClassCircuitOpen
+	if d := b.retryAfter(); d > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(d.Seconds())+1))
+	}
+	writeAPIError(w, protocol, http.StatusServiceUnavailable, "upstream_unavailable",
+		"Upstream is temporarily unavailable (circuit open), please retry later")
+	return nil, false
+}
+
+// recordUpstream 根据 /api/chat 的结果更新熔断器：网络错误、5xx 和慢请求计为失败。
+// 配置了多个代理时，当前代理熔断后切换到下一个代理
+func (g *Gateway) recordUpstream(proxyIndex int, status int, latency time.Duration, err error) {
+	if g.breakers == nil {
+		return
+	}
+	b := g.breakers.get(proxyIndex)
+	var opened bool
+	switch {
+	case err != nil:
+		opened = b.record(true, err.Error())
+	case status >= 500:
+		opened = b.record(true, fmt.Sprintf("状态 %d", status))
+	case status == http.StatusOK && latency > g.breakers.cfg.SlowThreshold:
+		opened = b.record(true, fmt.Sprintf("响应过慢 %v", latency.Round(time.Millisecond)))
+	case status == http.StatusOK:
+		b.record(false, "")
+	}
+
+	if opened && len(g.proxyMgr.proxies) > 1 {
+		if _, current := g.proxyMgr.GetCurrentProxy(); current == proxyIndex {
+			g.proxyMgr.OnRateLimit()
+		}
+	}
+}
+
+// probe 探测上游是否恢复，只请求首页，状态码小于 500 即视为可用
+func (g *Gateway) probe(proxyIndex int) error {
+	proxyURL, ok := g.proxyMgr.proxyURL(proxyIndex)
+	if !ok {
+		return fmt.Errorf("代理已不存在")
+	}
+	client, err := g.createHTTPClient(proxyURL)
+	if err != nil {
+		return err
+	}
+	client.Timeout = 10 * time.Second
+
+	req, _ := http.NewRequest("GET", g.baseURL+"/", nil)
+	setFirefoxHeaders(req, FirefoxAcceptHTML)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("状态 %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// breakerProbeLoop 熔断打开超过 OpenDuration 后定期探测，探测成功转为半开
+func (g *Gateway) breakerProbeLoop() {
+	ticker := time.NewTicker(g.breakers.cfg.ProbeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, b := range g.breakers.all() {
+			b.mu.Lock()
+			due := b.state == breakerOpen && time.Since(b.openedAt) >= b.cfg.OpenDuration
+			b.mu.Unlock()
+			if !due {
+				continue
+			}
+
+			err := g.probe(b.ProxyIndex)
+			b.mu.Lock()
+			if err != nil {
+				b.lastError = "探测失败: " + err.Error()
+				logDebug("熔断探测失败 | 代理: [%d], 错误: %v", b.ProxyIndex, err)
+			} else if b.state == breakerOpen {
+				b.transitionLocked(breakerHalfOpen, "健康探测成功")
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+// handleBreakers GET /admin/breakers 查看熔断状态
+func (a *AdminServer) handleBreakers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	bs := a.gateway.breakers
+	if bs == nil {
+		writeAdminError(w, http.StatusNotFound, "circuit breaker disabled")
+		return
+	}
+	list := make([]BreakerStatus, 0)
+	for _, b := range bs.all() {
+		status := b.status()
+		status.Container = a.gateway.proxyMgr.containerName(b.ProxyIndex)
+		list = append(list, status)
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"config": bs.cfg, "breakers": list})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testBreakerConfig() BreakerConfig {
+	return BreakerConfig{Window: 4, MinRequests: 2, ErrorRate: 0.5, SlowThreshold: time.Second, OpenDuration: time.Minute, ProbeInterval: time.Second}
+}
+
+func TestBreakerOpensOnErrorRate(t *testing.T) {
+	b := newBreaker(0, testBreakerConfig())
+	if b.record(false, "") || b.state != breakerClosed {
+		t.Fatal("成功请求不应熔断")
+	}
+	if !b.record(true, "状态 502") || b.state != breakerOpen {
+		t.Fatalf("错误率达到阈值后应熔断, 状态 %s", b.state)
+	}
+	if _, ok := b.allow(); ok {
+		t.Fatal("熔断期间应拒绝请求")
+	}
+	if st := b.status(); st.Rejected != 1 || st.LastError != "状态 502" {
+		t.Fatalf("状态计数不符: %+v", st)
+	}
+}
+
+func TestBreakerHalfOpenTrial(t *testing.T) {
+	tests := []struct {
+		name   string
+		finish func(b *Breaker, trialAt time.Time)
+		state  string
+		next   bool // 结束后下一个请求是否放行
+	}{
+		{"试探成功恢复", func(b *Breaker, _ time.Time) { b.record(false, "") }, breakerClosed, true},
+		{"试探失败重新熔断", func(b *Breaker, _ time.Time) { b.record(true, "状态 500") }, breakerOpen, false},
+		{"未得到结果归还名额", func(b *Breaker, at time.Time) { b.releaseTrial(at) }, breakerHalfOpen, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBreaker(0, testBreakerConfig())
+			b.transitionLocked(breakerHalfOpen, "探测成功")
+
+			trialAt, ok := b.allow()
+			if !ok || trialAt.IsZero() {
+				t.Fatal("半开状态应放行一个试探请求")
+			}
+			if _, ok := b.allow(); ok {
+				t.Fatal("试探进行中应拒绝其他请求")
+			}
+			tt.finish(b, trialAt)
+			if b.state != tt.state {
+				t.Fatalf("状态 %s, 期望 %s", b.state, tt.state)
+			}
+			if _, ok := b.allow(); ok != tt.next {
+				t.Fatalf("下一个请求放行=%v, 期望 %v", ok, tt.next)
+			}
+		})
+	}
+}
+
+// 试探已经产生结果后迟到的归还不影响新的试探
+func TestBreakerStaleRelease(t *testing.T) {
+	b := newBreaker(0, testBreakerConfig())
+	b.transitionLocked(breakerHalfOpen, "探测成功")
+	first, _ := b.allow()
+	b.releaseTrial(first)
+	second, ok := b.allow()
+	if !ok {
+		t.Fatal("归还后应放行新的试探")
+	}
+	b.releaseTrial(first)
+	if _, ok := b.allow(); ok || !b.trialAt.Equal(second) {
+		t.Fatal("过期的归还不应释放新的试探")
+	}
+}
+
+func TestCheckBreaker(t *testing.T) {
+	g := newTestGateway()
+	g.breakers = NewBreakerSet(testBreakerConfig())
+
+	release, ok := g.checkBreaker(httptest.NewRecorder(), &RequestContext{ID: "req"}, 1, protocolOpenAI)
+	if !ok {
+		t.Fatal("未熔断时应放行")
+	}
+	release()
+
+	b := g.breakers.get(1)
+	b.record(true, "状态 502")
+	b.record(true, "状态 502")
+	w := httptest.NewRecorder()
+	rc := &RequestContext{ID: "req"}
+	if _, ok := g.checkBreaker(w, rc, 1, protocolAnthropic); ok {
+		t.Fatal("熔断时应拒绝")
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" || rc.ErrorClass != errClassCircuitOpen {
+		t.Fatalf("状态 %d, Retry-After %q, 错误类别 %q", w.Code, w.Header().Get("Retry-After"), rc.ErrorClass)
+	}
+
+	// 熔断只影响对应出口
+	if _, ok := g.checkBreaker(httptest.NewRecorder(), &RequestContext{ID: "req"}, -1, protocolOpenAI); !ok {
+		t.Fatal("其他出口不应受影响")
+	}
+}
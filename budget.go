@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// 价格表与预算
+// ============================================================================
+
+// ModelPrice 模型单价，单位：美元 / 百万 token
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// 预算告警级别
+const (
+	budgetLevelNone = iota
+	budgetLevelSoft
+	budgetLevelHard
+)
+
+// BudgetTracker 按自然月统计每个 Key 的花费
+type BudgetTracker struct {
+	prices  map[string]ModelPrice // 已按 convertModel 解析的模型名
+	webhook string                // 全局告警 Webhook，Key 上配置的优先
+
+	month    string             // 当前统计月份，如 2026-10
+	spend    map[string]float64 // Key 标识 -> 本月花费
+	notified map[string]int     // Key 标识 -> 本月已通知的最高级别
+	mu       sync.Mutex
+}
+
+func NewBudgetTracker(prices map[string]ModelPrice, convert func(string) string, webhook string) *BudgetTracker {
+	normalized := make(map[string]ModelPrice, len(prices))
+	for model, price := range prices {
+		normalized[convert(model)] = price
+	}
+	return &BudgetTracker{
+		prices:   normalized,
+		webhook:  webhook,
+		month:    time.Now().Format("2006-01"),
+		spend:    make(map[string]float64),
+		notified: make(map[string]int),
+	}
+}
+
+// monthStart 返回当月第一天零点
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// LoadFromLedger 从用量账本恢复本月花费，没有 key_id 的旧记录无法区分同名 Key，不计入。
+// 同时按恢复的花费重建已通知的级别，重启后不会重复发送本月已发过的告警
+func (bt *BudgetTracker) LoadFromLedger(us *UsageStore, keys *KeyStore) error {
+	now := time.Now()
+	spend := make(map[string]float64)
+	err := us.Scan(monthStart(now), now.Add(time.Second), func(rec UsageRecord) error {
+		if rec.KeyID != "" {
+			spend[rec.KeyID] += rec.CostUSD
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	notified := make(map[string]int)
+	if keys != nil {
+		for _, k := range keys.List() {
+			if level := k.budgetLevel(spend[k.id()]); level > budgetLevelNone {
+				notified[k.id()] = level
+			}
+		}
+	}
+
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.month = now.Format("2006-01")
+	bt.spend = spend
+	bt.notified = notified
+	return nil
+}
+
+// Cost 按价格表计算费用，未配置价格的模型按 0 计
+func (bt *BudgetTracker) Cost(model string, inputTokens, outputTokens int) float64 {
+	price, exists := bt.prices[model]
+	if !exists {
+		return 0
+	}
+	return (float64(inputTokens)*price.Input + float64(outputTokens)*price.Output) / 1e6
+}
+
+// rolloverLocked 跨月时清零
+func (bt *BudgetTracker) rolloverLocked() {
+	month := time.Now().Format("2006-01")
+	if month != bt.month {
+		bt.month = month
+		bt.spend = make(map[string]float64)
+		bt.notified = make(map[string]int)
+	}
+}
+
+func (bt *BudgetTracker) Spent(k *APIKey) float64 {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.rolloverLocked()
+	return bt.spend[k.id()]
+}
+
+// Add 累加花费，首次越过软/硬上限时发送 Webhook
+func (bt *BudgetTracker) Add(k *APIKey, cost float64) {
+	if k == nil || cost <= 0 {
+		return
+	}
+	id := k.id()
+
+	bt.mu.Lock()
+	bt.rolloverLocked()
+	bt.spend[id] += cost
+	spent := bt.spend[id]
+	level := k.budgetLevel(spent)
+	notify := level > bt.notified[id]
+	if notify {
+		bt.notified[id] = level
+	}
+	month := bt.month
+	bt.mu.Unlock()
+
+	if notify {
+		event := "budget.soft_limit"
+		if level == budgetLevelHard {
+			event = "budget.hard_limit"
+		}
+		logWarn("预算告警 | Key: %s, 事件: %s, 本月花费: $%.4f / $%.2f", k.label(), event, spent, k.MonthlyBudget)
+		go bt.sendWebhook(k, event, spent, month)
+	}
+}
+
+func (bt *BudgetTracker) sendWebhook(k *APIKey, event string, spent float64, month string) {
+	target := k.BudgetWebhook
+	if target == "" {
+		target = bt.webhook
+	}
+	if target == "" {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"event":      event,
+		"key":        k.label(),
+		"month":      month,
+		"spent":      spent,
+		"budget":     k.MonthlyBudget,
+		"soft_limit": k.softLimit(),
+	})
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logError("预算 Webhook 发送失败 | Key: %s, 错误: %v", k.label(), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logError("预算 Webhook 返回异常 | Key: %s, 状态: %d", k.label(), resp.StatusCode)
+	}
+}
+
+// softLimit 软上限，未配置时为预算的 80%
+func (k *APIKey) softLimit() float64 {
+	if k.SoftLimit > 0 {
+		return k.SoftLimit
+	}
+	return k.MonthlyBudget * 0.8
+}
+
+func (k *APIKey) budgetLevel(spent float64) int {
+	if k.MonthlyBudget <= 0 {
+		return budgetLevelNone
+	}
+	if spent >= k.MonthlyBudget {
+		return budgetLevelHard
+	}
+	if spent >= k.softLimit() {
+		return budgetLevelSoft
+	}
+	return budgetLevelNone
+}
+
+// checkBudget 达到硬上限时拒绝请求，达到软上限时添加告警响应头
+func (g *Gateway) checkBudget(w http.ResponseWriter, rc *RequestContext, protocol apiProtocol) bool {
+	if g.budgets == nil || rc.Key == nil || rc.Key.MonthlyBudget <= 0 {
+		return true
+	}
+
+	spent := g.budgets.Spent(rc.Key)
+	switch rc.Key.budgetLevel(spent) {
+	case budgetLevelHard:
+		logWarn("%s | 预算已用尽 | Key: %s, 本月花费: $%.4f / $%.2f", rc.ID, rc.Key.label(), spent, rc.Key.MonthlyBudget)
+		rc.ErrorClass = errClassBudget
+		writeAPIError(w, protocol, http.StatusTooManyRequests, "insufficient_quota",
+			fmt.Sprintf("Monthly budget exhausted: spent $%.4f of $%.2f", spent, rc.Key.MonthlyBudget))
+		return false
+	case budgetLevelSoft:
+		w.Header().Set("X-Budget-Warning",
+			fmt.Sprintf("soft limit reached: spent $%.4f of $%.2f", spent, rc.Key.MonthlyBudget))
+	}
+	return true
+}
+
+// BudgetStatus 预算概要
+type BudgetStatus struct {
+	Key       string  `json:"key"`
+	KeyID     string  `json:"key_id"`
+	Month     string  `json:"month"`
+	Spent     float64 `json:"spent"`
+	Budget    float64 `json:"budget,omitempty"`
+	SoftLimit float64 `json:"soft_limit,omitempty"`
+	Remaining float64 `json:"remaining,omitempty"`
+	Status    string  `json:"status"` // ok / soft_limit / hard_limit / unlimited
+}
+
+// handleBudgets GET /admin/budgets 查看所有 Key 的本月花费
+func (a *AdminServer) handleBudgets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	bt := a.gateway.budgets
+	if bt == nil {
+		writeAdminError(w, http.StatusNotFound, "budgets disabled (no price table configured)")
+		return
+	}
+
+	bt.mu.Lock()
+	bt.rolloverLocked()
+	month := bt.month
+	spend := make(map[string]float64, len(bt.spend))
+	for id, v := range bt.spend {
+		spend[id] = v
+	}
+	bt.mu.Unlock()
+
+	list := make([]BudgetStatus, 0)
+	for _, k := range a.gateway.keys.List() {
+		k := k
+		status := BudgetStatus{Key: k.label(), KeyID: k.id(), Month: month, Spent: spend[k.id()], Status: "unlimited"}
+		if k.MonthlyBudget > 0 {
+			status.Budget = k.MonthlyBudget
+			status.SoftLimit = k.softLimit()
+			status.Remaining = k.MonthlyBudget - status.Spent
+			if status.Remaining < 0 {
+				status.Remaining = 0
+			}
+			status.Status = [...]string{"ok", "soft_limit", "hard_limit"}[k.budgetLevel(status.Spent)]
+		}
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Key != list[j].Key {
+			return list[i].Key < list[j].Key
+		}
+		return list[i].KeyID < list[j].KeyID
+	})
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"month": month, "budgets": list})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestBudgets(g *Gateway, webhook string) *BudgetTracker {
+	return NewBudgetTracker(map[string]ModelPrice{
+		"gpt-5.2": {Input: 1, Output: 10},
+	}, g.convertModel, webhook)
+}
+
+func TestBudgetCost(t *testing.T) {
+	g := newTestGateway()
+	bt := newTestBudgets(g, "")
+	// 别名与上游模型名共用一个价格
+	if got := bt.Cost("openai/gpt-5.2", 1_000_000, 100_000); math.Abs(got-2) > 1e-9 {
+		t.Fatalf("Cost = %v, 期望 2", got)
+	}
+	if got := bt.Cost("unknown", 1000, 1000); got != 0 {
+		t.Fatalf("未配置价格的模型 Cost = %v, 期望 0", got)
+	}
+}
+
+func TestBudgetSeparatesKeysWithSameName(t *testing.T) {
+	g := newTestGateway()
+	bt := newTestBudgets(g, "")
+	a := &APIKey{Key: "sk-aaaa-1111", Name: "team", MonthlyBudget: 10}
+	b := &APIKey{Key: "sk-bbbb-2222", Name: "team", MonthlyBudget: 10}
+
+	bt.Add(a, 10)
+	if got := bt.Spent(a); got != 10 {
+		t.Fatalf("a 花费 %v, 期望 10", got)
+	}
+	if got := bt.Spent(b); got != 0 {
+		t.Fatalf("同名的 b 花费 %v, 期望 0", got)
+	}
+
+	g.budgets = bt
+	check := func(k *APIKey) int {
+		w := httptest.NewRecorder()
+		rc := &RequestContext{ID: "REQ-test", Key: k}
+		if g.checkBudget(w, rc, protocolOpenAI) {
+			return http.StatusOK
+		}
+		return w.Code
+	}
+	if code := check(a); code != http.StatusTooManyRequests {
+		t.Fatalf("a 预算用尽: 状态码 %d, 期望 429", code)
+	}
+	if code := check(b); code != http.StatusOK {
+		t.Fatalf("b 未花费: 状态码 %d, 期望 200", code)
+	}
+}
+
+func TestBudgetWebhookOncePerLevel(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		events = append(events, body["event"].(string))
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	g := newTestGateway()
+	bt := newTestBudgets(g, srv.URL)
+	k := &APIKey{Key: "sk-hook-0001", Name: "hook", MonthlyBudget: 10}
+	for _, cost := range []float64{5, 3.5, 0.5, 1, 2} { // 8.5 越过软上限，10 越过硬上限
+		bt.Add(k, cost)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(events)
+		mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(events) // Webhook 异步发送，顺序不固定
+	if len(events) != 2 || events[0] != "budget.hard_limit" || events[1] != "budget.soft_limit" {
+		t.Fatalf("Webhook 事件 %v, 期望软上限和硬上限各一次", events)
+	}
+}
+
+func TestFinishRequestChargesOnlyUpstreamSuccess(t *testing.T) {
+	tests := []struct {
+		name       string
+		upstreamOK bool
+		errorClass string
+		cached     bool
+		want       float64
+	}{
+		{"上游 200", true, "", false, 11},
+		{"上游限流", false, errClassRateLimited, false, 0},
+		{"网络错误", false, errClassUpstreamNetwork, false, 0},
+		{"会话池拒绝", false, errClassPoolExhausted, false, 0},
+		{"命中缓存", true, "", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGateway()
+			g.budgets = newTestBudgets(g, "")
+			k := &APIKey{Key: "sk-charge-01", Name: "charge"}
+			rc := &RequestContext{
+				ID:           "REQ-test",
+				StartTime:    time.Now(),
+				Model:        "gpt-5.2",
+				Key:          k,
+				InputTokens:  1_000_000,
+				OutputTokens: 1_000_000,
+				ErrorClass:   tt.errorClass,
+				UpstreamOK:   tt.upstreamOK,
+				CacheHit:     tt.cached,
+			}
+			g.finishRequest(rc, &statusWriter{status: http.StatusOK})
+			if got := g.budgets.Spent(k); math.Abs(got-tt.want) > 1e-9 {
+				t.Fatalf("花费 %v, 期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 重启后按账本恢复的花费重建已通知的级别，本月已发过的告警不再重复发送
+func TestBudgetNotifiedRestoredFromLedger(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		events = append(events, body["event"].(string))
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	ks, err := NewKeyStore("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := ks.Put(APIKey{Key: "sk-hook-0001", Name: "hook", MonthlyBudget: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "usage.db")
+	us, err := OpenUsageStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	us.Record(UsageRecord{Time: time.Now(), RequestID: "req-1", Key: k.label(), KeyID: k.id(), CostUSD: 9})
+	if err := us.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if us, err = OpenUsageStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer us.Close()
+
+	g := newTestGateway()
+	bt := newTestBudgets(g, srv.URL)
+	if err := bt.LoadFromLedger(us, ks); err != nil {
+		t.Fatal(err)
+	}
+	if got := bt.Spent(&k); got != 9 {
+		t.Fatalf("恢复的花费 %v, 期望 9", got)
+	}
+	bt.Add(&k, 0.5) // 仍在软上限之上，重启前已通知过
+	bt.Add(&k, 1)   // 越过硬上限
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(events)
+		mu.Unlock()
+		if n >= 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 || events[0] != "budget.hard_limit" {
+		t.Fatalf("Webhook 事件 %v, 期望只有硬上限一次", events)
+	}
+}
+
+func TestAdminConfigHidesBudgetWebhook(t *testing.T) {
+	a := &AdminServer{gateway: newTestGateway(), cfg: &Config{BudgetWebhook: "https://hooks.example.com/budget?token=secret"}}
+	w := httptest.NewRecorder()
+	a.handleConfig(w, httptest.NewRequest(http.MethodGet, "/admin/config", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "hooks.example.com") {
+		t.Fatalf("配置输出泄露 Webhook 地址: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ============================================================================
+// 响应缓存
+// ============================================================================
+
+var cacheBucket = []byte("responses")
+
+// cacheNonce 计算缓存键时使用的固定 Nonce，实际发往上游的提示词仍使用随机 Nonce
+const cacheNonce = "00000000"
+
+// CacheConfig 响应缓存参数
+type CacheConfig struct {
+	Enabled       bool          `json:"enabled"`
+	MaxEntries    int           `json:"max_entries"`     // 内存 LRU 条数
+	MaxEntryBytes int           `json:"max_entry_bytes"` // 单条响应上限，超出不缓存
+	TTL           time.Duration `json:"ttl"`
+	Path          string        `json:"path,omitempty"` // 磁盘缓存文件（bbolt），为空时只用内存
+}
+
+// cacheEntry 一条缓存：上游的文本增量按原始分块保存，回放时重新生成 SSE
+type cacheEntry struct {
+	Model   string    `json:"model"`
+	Deltas  []string  `json:"deltas"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+
+	key string
+}
+
+// body 生成与上游格式相同的 SSE 响应体
+func (e *cacheEntry) body() io.Reader {
+	var b bytes.Buffer
+	for _, delta := range e.Deltas {
+		data, _ := json.Marshal(SSEEvent{Type: "text-delta", Delta: delta})
+		fmt.Fprintf(&b, "data: %s\n\n", data)
+	}
+	b.WriteString("data: [DONE]\n\n")
+	return &b
+}
+
+// ResponseCache 两级响应缓存：内存 LRU 在前，磁盘在后，磁盘命中时提升到内存
+type ResponseCache struct {
+	cfg CacheConfig
+	db  *bolt.DB
+
+	mu      sync.Mutex
+	lru     *list.List // 元素为 *cacheEntry，最近使用的在前
+	entries map[string]*list.Element
+	closed  bool           // 关闭后不再写入磁盘，受 mu 保护
+	writes  sync.WaitGroup // 进行中的磁盘写入，Close 时等待
+
+	hits   uint64
+	misses uint64
+	stores uint64
+}
+
+// CacheStats 缓存统计，供 /admin/cache 使用
+type CacheStats struct {
+	Config      CacheConfig `json:"config"`
+	Entries     int         `json:"entries"`
+	DiskEntries int         `json:"disk_entries,omitempty"`
+	Hits        uint64      `json:"hits"`
+	Misses      uint64      `json:"misses"`
+	Stores      uint64      `json:"stores"`
+}
+
+// NewResponseCache 创建缓存，配置了 Path 时打开磁盘缓存文件
+func NewResponseCache(cfg CacheConfig) (*ResponseCache, error) {
+	c := &ResponseCache{
+		cfg:     cfg,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	if cfg.Path != "" {
+		db, err := bolt.Open(cfg.Path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+		if err != nil {
+			return nil, fmt.Errorf("打开响应缓存文件失败: %w", err)
+		}
+		if err := db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(cacheBucket)
+			return err
+		}); err != nil {
+			db.Close()
+			return nil, err
+		}
+		c.db = db
+	}
+	return c, nil
+}
+
+// Get 查找未过期的缓存
+func (c *ResponseCache) Get(key string) (*cacheEntry, bool) {
+	now := time.Now()
+	c.mu.Lock()
+	if el, exists := c.entries[key]; exists {
+		entry := el.Value.(*cacheEntry)
+		if now.Before(entry.Expires) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			atomic.AddUint64(&c.hits, 1)
+			return entry, true
+		}
+		c.removeLocked(el)
+	}
+	c.mu.Unlock()
+
+	if entry := c.getDisk(key, now); entry != nil {
+		c.mu.Lock()
+		c.addLocked(entry)
+		c.mu.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		return entry, true
+	}
+	atomic.AddUint64(&c.misses, 1)
+	return nil, false
+}
+
+func (c *ResponseCache) getDisk(key string, now time.Time) *cacheEntry {
+	if c.db == nil {
+		return nil
+	}
+	var entry *cacheEntry
+	c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(cacheBucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		var e cacheEntry
+		if json.Unmarshal(data, &e) == nil && now.Before(e.Expires) {
+			e.key = key
+			entry = &e
+		}
+		return nil
+	})
+	return entry
+}
+
+// Put 写入缓存，磁盘写入异步进行
+func (c *ResponseCache) Put(key, model string, deltas []string) {
+	now := time.Now()
+	entry := &cacheEntry{Model: model, Deltas: deltas, Created: now, Expires: now.Add(c.cfg.TTL), key: key}
+	c.mu.Lock()
+	if el, exists := c.entries[key]; exists {
+		c.removeLocked(el)
+	}
+	c.addLocked(entry)
+	writeDisk := c.db != nil && !c.closed
+	if writeDisk {
+		c.writes.Add(1)
+	}
+	c.mu.Unlock()
+	atomic.AddUint64(&c.stores, 1)
+
+	if writeDisk {
+		go func() {
+			defer c.writes.Done()
+			data, _ := json.Marshal(entry)
+			if err := c.db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket(cacheBucket).Put([]byte(key), data)
+			}); err != nil {
+				logError("响应缓存写入磁盘失败: %v", err)
+			}
+		}()
+	}
+}
+
+func (c *ResponseCache) addLocked(entry *cacheEntry) {
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.cfg.MaxEntries {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+func (c *ResponseCache) removeLocked(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// Purge 清空内存和磁盘缓存，返回清除的内存条数
+func (c *ResponseCache) Purge() (int, error) {
+	c.mu.Lock()
+	n := c.lru.Len()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.mu.Unlock()
+
+	if c.db == nil {
+		return n, nil
+	}
+	return n, c.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(cacheBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(cacheBucket)
+		return err
+	})
+}
+
+// sweep 删除磁盘中已过期的缓存
+func (c *ResponseCache) sweep() (int, error) {
+	if c.db == nil {
+		return 0, nil
+	}
+	now := time.Now()
+	removed := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(cacheBucket).Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			var e cacheEntry
+			if json.Unmarshal(v, &e) != nil || !now.Before(e.Expires) {
+				if err := cur.Delete(); err != nil {
+					return err
+				}
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// sweepLoop 每小时清理一次磁盘中的过期缓存
+func (c *ResponseCache) sweepLoop() {
+	if c.db == nil {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		if removed, err := c.sweep(); err != nil {
+			logError("响应缓存清理失败: %v", err)
+		} else if removed > 0 {
+			logInfo("响应缓存清理完成 | 删除过期条目: %d", removed)
+		}
+	}
+}
+
+// Stats 当前统计
+func (c *ResponseCache) Stats() CacheStats {
+	c.mu.Lock()
+	stats := CacheStats{Config: c.cfg, Entries: c.lru.Len()}
+	c.mu.Unlock()
+	stats.Hits = atomic.LoadUint64(&c.hits)
+	stats.Misses = atomic.LoadUint64(&c.misses)
+	stats.Stores = atomic.LoadUint64(&c.stores)
+	if c.db != nil {
+		c.db.View(func(tx *bolt.Tx) error {
+			stats.DiskEntries = tx.Bucket(cacheBucket).Stats().KeyN
+			return nil
+		})
+	}
+	return stats
+}
+
+// Close 等待进行中的磁盘写入结束后关闭磁盘缓存文件
+func (c *ResponseCache) Close() error {
+	if c == nil || c.db == nil {
+		return nil
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+	c.writes.Wait()
+	return c.db.Close()
+}
+
+// ---------------------------------------------------------------------------
+// 记录上游响应
+// ---------------------------------------------------------------------------
+
+// cacheRecorder 在转发上游响应的同时保存原始字节，完整读到 [DONE] 后才写入缓存
+type cacheRecorder struct {
+	io.Reader
+	cache *ResponseCache
+	key   string
+	model string
+	buf   *bytes.Buffer // nil 表示不记录
+}
+
+// recorder 包装上游响应体；未启用缓存或本次请求不缓存时只做透传
+func (c *ResponseCache) recorder(rc *RequestContext, model string, body io.Reader) *cacheRecorder {
+	rec := &cacheRecorder{Reader: body}
+	if c == nil || rc.CacheKey == "" {
+		return rec
+	}
+	rec.cache, rec.key, rec.model = c, rc.CacheKey, model
+	rec.buf = &bytes.Buffer{}
+	rec.Reader = io.TeeReader(body, writerFunc(func(p []byte) (int, error) {
+		// 超出单条上限后放弃记录，不影响转发
+		if rec.buf != nil && rec.buf.Len()+len(p) > c.cfg.MaxEntryBytes {
+			rec.buf = nil
+		}
+		if rec.buf != nil {
+			rec.buf.Write(p)
+		}
+		return len(p), nil
+	}))
+	return rec
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// commit 响应完整（读到 [DONE] 且有文本）时写入缓存；提前结束的响应（如达到输出上限）不缓存
+func (rec *cacheRecorder) commit() {
+	if rec.cache == nil || rec.buf == nil {
+		return
+	}
+	var deltas []string
+	done := false
+	scanner := bufio.NewScanner(rec.buf)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			break
+		}
+		var event SSEEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			continue
+		}
+		if event.Type == "text-delta" && event.Delta != "" {
+			deltas = append(deltas, event.Delta)
+		}
+	}
+	if !done || len(deltas) == 0 {
+		return
+	}
+	rec.cache.Put(rec.key, rec.model, deltas)
+}
+
+// ---------------------------------------------------------------------------
+// 网关集成
+// ---------------------------------------------------------------------------
+
+// responseCacheKey 缓存键：租户、上游模型和拼接后的提示词（使用固定 Nonce）的摘要
+func (g *Gateway) responseCacheKey(rc *RequestContext, model string, messages []OpenAIMessage) string {
+	var system string
+	for _, msg := range messages {
+		if msg.Role == "system" {
+			system = g.extractContent(msg.Content)
+			break
+		}
+	}
+	upstreamModel := g.convertModel(model)
+	prompt, err := g.prompts.lookup(model, upstreamModel).renderWithNonce(model, system, messages, g.extractContent, cacheNonce)
+	if err != nil {
+		return ""
+	}
+	h := sha256.New()
+	for _, part := range []string{rc.Key.tenant(), upstreamModel, prompt} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheBypassed Key 配置了 no_cache 或请求带 Cache-Control: no-store 时既不读也不写缓存
+func cacheBypassed(r *http.Request, key *APIKey) bool {
+	return (key != nil && key.NoCache) || strings.Contains(r.Header.Get("Cache-Control"), "no-store")
+}
+
+// serveCached 在获取会话前查找缓存，命中时直接回放并返回 true；
+// 未命中时在 rc.CacheKey 中记下缓存键，由上游响应写入。Cache-Control: no-cache 跳过查找但仍写入
+func (g *Gateway) serveCached(w http.ResponseWriter, r *http.Request, rc *RequestContext, req OpenAIRequest, protocol apiProtocol) bool {
+	if g.cache == nil {
+		return false
+	}
+	if cacheBypassed(r, rc.Key) {
+		w.Header().Set("X-Cache", "bypass")
+		return false
+	}
+	key := g.responseCacheKey(rc, req.Model, req.Messages)
+	if key == "" {
+		return false
+	}
+	if !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		if entry, hit := g.cache.Get(key); hit {
+			logInfo("%s | 响应缓存命中 | 模型: %s, 缓存时间: %s", rc.ID, entry.Model, entry.Created.Format(time.RFC3339))
+			rc.CacheHit = true
+			w.Header().Set("X-Cache", "hit")
+			w.Header().Set("Age", fmt.Sprintf("%d", int(time.Since(entry.Created).Seconds())))
+			g.relayBody(w, rc, req.Stream, entry.body(), entry.Model, protocol)
+			return true
+		}
+	}
+	w.Header().Set("X-Cache", "miss")
+	rc.CacheKey = key
+	return false
+}
+
+// relayBody 按请求的协议和模式返回上游格式的 SSE（缓存回放、合并请求），
+// 经过与上游响应相同的输出上限和内容过滤
+func (g *Gateway) relayBody(w http.ResponseWriter, rc *RequestContext, stream bool, body io.Reader, model string, protocol apiProtocol) {
+	if !stream {
+		if protocol == protocolAnthropic {
+			g.relayAnthropic(w, body, model, rc)
+		} else {
+			g.relayOpenAI(w, body, model, rc)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if protocol == protocolAnthropic {
+		g.relayAnthropicStream(w, flusher, body, model, rc)
+	} else {
+		g.relayOpenAIStream(w, flusher, body, model, rc)
+	}
+}
+
+// handleCache GET /admin/cache 查看统计，DELETE /admin/cache 清空缓存
+func (a *AdminServer) handleCache(w http.ResponseWriter, r *http.Request) {
+	cache := a.gateway.cache
+	if cache == nil {
+		writeAdminError(w, http.StatusNotFound, "response cache disabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, cache.Stats())
+	case http.MethodDelete:
+		n, err := cache.Purge()
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		logInfo("响应缓存已清空 | 内存条目: %d", n)
+		writeAdminJSON(w, http.StatusOK, map[string]int{"purged": n})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testCacheConfig() CacheConfig {
+	return CacheConfig{Enabled: true, MaxEntries: 100, MaxEntryBytes: 1 << 20, TTL: time.Hour}
+}
+
+// upstreamSSE 上游 /api/chat 格式的响应体
+func upstreamSSE(deltas ...string) string {
+	var b strings.Builder
+	for _, delta := range deltas {
+		data, _ := json.Marshal(SSEEvent{Type: "text-delta", Delta: delta})
+		fmt.Fprintf(&b, "data: %s\n\n", data)
+	}
+	b.WriteString("data: [DONE]\n\n")
+	return b.String()
+}
+
+func TestResponseCacheLRU(t *testing.T) {
+	cfg := testCacheConfig()
+	cfg.MaxEntries = 2
+	c, err := NewResponseCache(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put("a", "m", []string{"1"})
+	c.Put("b", "m", []string{"2"})
+	c.Get("a")
+	c.Put("c", "m", []string{"3"})
+
+	if _, hit := c.Get("b"); hit {
+		t.Fatal("最久未使用的条目应被淘汰")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, hit := c.Get(key); !hit {
+			t.Fatalf("%s 应保留", key)
+		}
+	}
+	if stats := c.Stats(); stats.Entries != 2 || stats.Hits != 3 || stats.Misses != 1 || stats.Stores != 3 {
+		t.Fatalf("统计不符: %+v", stats)
+	}
+}
+
+func TestResponseCacheTTL(t *testing.T) {
+	cfg := testCacheConfig()
+	cfg.TTL = 30 * time.Millisecond
+	cfg.Path = filepath.Join(t.TempDir(), "cache.db")
+	c, err := NewResponseCache(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Put("a", "m", []string{"1"})
+	if _, hit := c.Get("a"); !hit {
+		t.Fatal("有效期内应命中")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, hit := c.Get("a"); hit {
+		t.Fatal("过期后内存和磁盘都不应命中")
+	}
+	if stats := c.Stats(); stats.Entries != 0 {
+		t.Fatalf("过期条目应从内存删除: %+v", stats)
+	}
+	if removed, err := c.sweep(); err != nil || removed != 1 {
+		t.Fatalf("清理磁盘过期条目 %d 条, 错误 %v", removed, err)
+	}
+}
+
+// 磁盘缓存在重启后仍然有效，命中时提升到内存；Close 等待异步写入完成
+func TestResponseCacheDiskPromotion(t *testing.T) {
+	cfg := testCacheConfig()
+	cfg.MaxEntries = 1
+	cfg.Path = filepath.Join(t.TempDir(), "cache.db")
+	c, err := NewResponseCache(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		c.Put(fmt.Sprintf("k%d", i), "m", []string{fmt.Sprint(i)})
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 关闭后的写入只进内存，不应访问已关闭的文件
+	c.Put("late", "m", []string{"x"})
+
+	c, err = NewResponseCache(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if stats := c.Stats(); stats.Entries != 0 || stats.DiskEntries != 20 {
+		t.Fatalf("重启后应只有磁盘条目: %+v", stats)
+	}
+	entry, hit := c.Get("k3")
+	if !hit || entry.Model != "m" || strings.Join(entry.Deltas, "") != "3" {
+		t.Fatalf("磁盘条目未命中或内容不符: %+v", entry)
+	}
+	if stats := c.Stats(); stats.Entries != 1 {
+		t.Fatalf("磁盘命中后应提升到内存: %+v", stats)
+	}
+}
+
+func TestCacheRecorder(t *testing.T) {
+	body := upstreamSSE("Hello", ", ", "world")
+	tests := []struct {
+		name     string
+		maxBytes int
+		body     string
+		cached   bool
+	}{
+		{"完整响应", 1 << 20, body, true},
+		{"超过单条上限", len(body) - 1, body, false},
+		{"未读到结束标记", 1 << 20, strings.TrimSuffix(body, "data: [DONE]\n\n"), false},
+		{"没有文本", 1 << 20, upstreamSSE(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testCacheConfig()
+			cfg.MaxEntryBytes = tt.maxBytes
+			c, err := NewResponseCache(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := c.recorder(&RequestContext{CacheKey: "k"}, "m", strings.NewReader(tt.body))
+			got, _ := io.ReadAll(rec)
+			if string(got) != tt.body {
+				t.Fatal("记录时应原样透传响应")
+			}
+			rec.commit()
+			entry, hit := c.Get("k")
+			if hit != tt.cached {
+				t.Fatalf("缓存结果 %v, 期望 %v", hit, tt.cached)
+			}
+			if hit && strings.Join(entry.Deltas, "") != "Hello, world" {
+				t.Fatalf("缓存内容不符: %v", entry.Deltas)
+			}
+		})
+	}
+}
+
+// fakeChatUpstream 返回固定文本的上游，统计 /api/chat 调用次数
+type fakeChatUpstream struct {
+	*httptest.Server
+	chats atomic.Int32
+}
+
+func newFakeChatUpstream(t *testing.T, deltas ...string) *fakeChatUpstream {
+	u := &fakeChatUpstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/chat" {
+			u.chats.Add(1)
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, upstreamSSE(deltas...))
+		}
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func TestServeCachedHeaders(t *testing.T) {
+	up := newFakeChatUpstream(t, "Hello", ", ", "world")
+	g := NewGateway(up.URL, NewProxyManager("", ""), false)
+	cache, err := NewResponseCache(testCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.cache = cache
+
+	body := `{"model":"gpt-5.2","messages":[{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		name         string
+		cacheControl string
+		want         string
+		chats        int32
+	}{
+		{"首次请求", "", "miss", 1},
+		{"相同请求", "", "hit", 1},
+		{"no-cache 跳过查找", "no-cache", "miss", 2},
+		{"刷新后命中", "", "hit", 2},
+		{"no-store 不读不写", "no-store", "bypass", 3},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		if tt.cacheControl != "" {
+			r.Header.Set("Cache-Control", tt.cacheControl)
+		}
+		g.HandleChatCompletion(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("X-Cache") != tt.want || up.chats.Load() != tt.chats {
+			t.Fatalf("%s: 状态 %d, X-Cache %q, 上游请求 %d 次; 期望 %q, %d 次",
+				tt.name, w.Code, w.Header().Get("X-Cache"), up.chats.Load(), tt.want, tt.chats)
+		}
+		if !strings.Contains(w.Body.String(), `"content":"Hello, world"`) {
+			t.Fatalf("%s: 响应内容不符: %s", tt.name, w.Body.String())
+		}
+		if tt.want == "hit" && w.Header().Get("Age") == "" {
+			t.Fatalf("%s: 命中时应带 Age", tt.name)
+		}
+	}
+	if stats := cache.Stats(); stats.Stores != 2 {
+		t.Fatalf("no-store 的响应不应写入缓存: %+v", stats)
+	}
+
+	// Key 配置 no_cache 时始终绕过
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	rc := &RequestContext{ID: "req", Key: &APIKey{Key: "sk-a", NoCache: true}}
+	req := OpenAIRequest{Model: "gpt-5.2", Messages: []OpenAIMessage{{Role: "user", Content: "hi"}}}
+	if g.serveCached(w, r, rc, req, protocolOpenAI) || w.Header().Get("X-Cache") != "bypass" || rc.CacheKey != "" {
+		t.Fatalf("no_cache 的 Key 应绕过缓存: X-Cache %q, 缓存键 %q", w.Header().Get("X-Cache"), rc.CacheKey)
+	}
+}
+
+// 同一条缓存按请求的协议和流式模式回放
+func TestServeCachedReplay(t *testing.T) {
+	g := newTestGateway()
+	cache, err := NewResponseCache(testCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.cache = cache
+	messages := []OpenAIMessage{{Role: "user", Content: "hi"}}
+	cache.Put(g.responseCacheKey(&RequestContext{}, "gpt-5.2", messages), "gpt-5.2", []string{"Hello", ", ", "world"})
+
+	tests := []struct {
+		name     string
+		protocol apiProtocol
+		stream   bool
+		want     []string
+	}{
+		{"OpenAI 非流式", protocolOpenAI, false, []string{`"content":"Hello, world"`, `"finish_reason":"stop"`}},
+		{"OpenAI 流式", protocolOpenAI, true, []string{`"content":"Hello"`, `"content":", "`, `"content":"world"`, "data: [DONE]"}},
+		{"Anthropic 非流式", protocolAnthropic, false, []string{`"text":"Hello, world"`, `"stop_reason":"end_turn"`}},
+		{"Anthropic 流式", protocolAnthropic, true, []string{`"text":"Hello"`, `"text":"world"`, "event: message_stop"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			rc := &RequestContext{ID: "req"}
+			req := OpenAIRequest{Model: "gpt-5.2", Messages: messages, Stream: tt.stream}
+			if !g.serveCached(w, r, rc, req, tt.protocol) || !rc.CacheHit || w.Header().Get("X-Cache") != "hit" {
+				t.Fatal("应命中缓存")
+			}
+			out := w.Body.String()
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Fatalf("回放内容缺少 %s:\n%s", want, out)
+				}
+			}
+			if tt.stream != (w.Header().Get("Content-Type") == "text/event-stream") {
+				t.Fatalf("Content-Type 不符: %s", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+
+	// 回放经过输出上限
+	w := httptest.NewRecorder()
+	rc := &RequestContext{ID: "req", Key: &APIKey{Key: "sk-a", MaxOutputTokens: 1}}
+	req := OpenAIRequest{Model: "gpt-5.2", Messages: messages}
+	key := g.responseCacheKey(rc, "gpt-5.2", messages)
+	cache.Put(key, "gpt-5.2", []string{"Hello", ", ", "world"})
+	if !g.serveCached(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil), rc, req, protocolOpenAI) {
+		t.Fatal("应命中缓存")
+	}
+	if out := w.Body.String(); strings.Contains(out, "world") || !strings.Contains(out, `"finish_reason":"length"`) {
+		t.Fatalf("回放应受 max_output_tokens 限制:\n%s", out)
+	}
+}
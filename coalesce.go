@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// ============================================================================
+// 合并相同的并发请求
+// ============================================================================
+
+// flight 一次进行中的上游请求。首个请求（leader）负责请求上游，
+// 上游响应的原始字节写入 buf，同时到达的相同请求（follower）从头读取 buf 并等待后续数据
+type flight struct {
+	key     string
+	started chan struct{} // 上游返回 200 或 leader 失败时关闭
+	ok      bool          // 上游是否返回了 200，started 关闭后有效
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	buf       []byte
+	done      bool
+	followers int
+	landed    bool
+}
+
+// FlightGroup 按请求键登记进行中的上游请求
+type FlightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// NewFlightGroup 创建空的登记表
+func NewFlightGroup() *FlightGroup {
+	return &FlightGroup{flights: make(map[string]*flight)}
+}
+
+// join 返回键对应的 flight；没有进行中的请求时新建一个，调用方成为 leader
+func (fg *FlightGroup) join(key string) (*flight, bool) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	if f, exists := fg.flights[key]; exists {
+		f.mu.Lock()
+		f.followers++
+		f.mu.Unlock()
+		return f, false
+	}
+	f := &flight{key: key, started: make(chan struct{})}
+	f.cond = sync.NewCond(&f.mu)
+	fg.flights[key] = f
+	return f, true
+}
+
+// tee 包装 leader 的上游响应体，读到的数据同时广播给 follower
+func (f *flight) tee(body io.Reader) io.Reader {
+	if f == nil {
+		return body
+	}
+	f.ok = true
+	close(f.started)
+	return io.TeeReader(body, writerFunc(func(p []byte) (int, error) {
+		f.mu.Lock()
+		f.buf = append(f.buf, p...)
+		f.mu.Unlock()
+		f.cond.Broadcast()
+		return len(p), nil
+	}))
+}
+
+// land leader 结束时调用：不再接受新的 follower；有 follower 时读完 rest 中剩余的上游响应，
+// 避免 leader 因输出上限或内容过滤提前结束而截断 follower 的响应（此时 leader 的请求要等上游结束才返回）。可重复调用
+func (fg *FlightGroup) land(rc *RequestContext, rest io.Reader) {
+	f := rc.flight
+	if fg == nil || f == nil {
+		return
+	}
+	fg.mu.Lock()
+	if fg.flights[f.key] == f {
+		delete(fg.flights, f.key)
+	}
+	fg.mu.Unlock()
+
+	f.mu.Lock()
+	if f.landed {
+		f.mu.Unlock()
+		return
+	}
+	f.landed = true
+	followers := f.followers
+	f.mu.Unlock()
+
+	if f.ok && followers > 0 && rest != nil {
+		io.Copy(io.Discard, rest)
+	}
+	if !f.ok {
+		close(f.started)
+	}
+	f.mu.Lock()
+	f.done = true
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+// flightReader follower 读取 leader 的上游响应：先读已收到的部分，之后等待新数据。
+// follower 的客户端断开（ctx 结束）时停止等待
+type flightReader struct {
+	f   *flight
+	ctx context.Context
+	off int
+}
+
+func (r *flightReader) Read(p []byte) (int, error) {
+	f := r.f
+	// 持有 f.mu 广播，保证不会在检查 ctx 之后、Wait 之前错过唤醒
+	stop := context.AfterFunc(r.ctx, func() {
+		f.mu.Lock()
+		f.cond.Broadcast()
+		f.mu.Unlock()
+	})
+	defer stop()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for r.off >= len(f.buf) && !f.done {
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+		f.cond.Wait()
+	}
+	if r.off >= len(f.buf) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.buf[r.off:])
+	r.off += n
+	return n, nil
+}
+
+// joinFlight 相同租户、模型和提示词的请求正在进行时，等待并共享其上游响应，返回 true 表示已处理。
+// 首个请求记入 rc.flight，由上游响应广播；leader 失败时 follower 各自请求上游
+func (g *Gateway) joinFlight(w http.ResponseWriter, r *http.Request, rc *RequestContext, req OpenAIRequest, protocol apiProtocol) bool {
+	if g.flights == nil || cacheBypassed(r, rc.Key) {
+		return false
+	}
+	key := g.responseCacheKey(rc, req.Model, req.Messages)
+	if key == "" {
+		return false
+	}
+	f, leader := g.flights.join(key)
+	if leader {
+		rc.flight = f
+		return false
+	}
+
+	logInfo("%s | 相同请求正在处理，等待共享上游响应", rc.ID)
+	select {
+	case <-f.started:
+	case <-r.Context().Done():
+		return true
+	}
+	if !f.ok {
+		logWarn("%s | 共享的上游请求失败，单独请求上游", rc.ID)
+		return false
+	}
+
+	rc.Coalesced = true
+	w.Header().Set("X-Coalesced", "true")
+	g.relayBody(w, rc, req.Stream, &flightReader{f: f, ctx: r.Context()}, g.convertModel(req.Model), protocol)
+	return true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestFlightFollowerReadsLeaderBody(t *testing.T) {
+	fg := NewFlightGroup()
+	f, leader := fg.join("k")
+	if !leader {
+		t.Fatal("首个请求应成为 leader")
+	}
+	if _, leader := fg.join("k"); leader {
+		t.Fatal("相同键的后续请求应成为 follower")
+	}
+
+	pr, pw := io.Pipe()
+	body := f.tee(pr)
+	go func() {
+		pw.Write([]byte("data: a\n\n"))
+		pw.Write([]byte("data: b\n\n"))
+		pw.Close()
+	}()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(io.Discard, body)
+		fg.land(&RequestContext{flight: f}, body)
+	}()
+
+	got, err := io.ReadAll(&flightReader{f: f, ctx: context.Background()})
+	if err != nil || string(got) != "data: a\n\ndata: b\n\n" {
+		t.Fatalf("follower 读到 %q, %v", got, err)
+	}
+	<-done
+	if _, leader := fg.join("k"); !leader {
+		t.Fatal("leader 结束后相同键应重新成为 leader")
+	}
+}
+
+// follower 的客户端断开时不再等待 leader 的上游响应
+func TestFlightReaderCancelled(t *testing.T) {
+	fg := NewFlightGroup()
+	f, _ := fg.join("k")
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	f.tee(pr) // 上游迟迟不返回数据
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := (&flightReader{f: f, ctx: ctx}).Read(make([]byte, 16))
+		result <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Fatalf("err=%v, 期望 context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("客户端断开后 follower 仍在等待")
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ============================================================================
+// 运行配置
+// ============================================================================
+
+// Config 网关运行配置：简单配置项来自环境变量，结构化配置来自 CONFIG_FILE（JSON）
+type Config struct {
+	BaseURL        string `json:"base_url"`
+	Port           string `json:"port"`
+	WarpProxies    string `json:"warp_proxies"`
+	WarpContainers string `json:"warp_containers"`
+	LogLevel       string `json:"log_level"`
+	LogFormat      string `json:"log_format"`
+	UseAuth        bool   `json:"use_auth"`
+	APIKeysFile    string `json:"api_keys_file"`
+	RequireAPIKey  bool   `json:"require_api_key"`
+	AdminPort      string `json:"admin_port"`
+	AdminToken     string `json:"-"`
+	UsageDB        string `json:"usage_db"`
+	ConfigFile     string `json:"config_file"`
+	BudgetWebhook  string `json:"-"`
+	SessionPool    int    `json:"session_pool_size"`
+
+	UpstreamEmail           string        `json:"upstream_email,omitempty"`
+	UpstreamPassword        string        `json:"-"`
+	UpstreamSessionToken    string        `json:"-"`
+	UpstreamSessionCookie   string        `json:"upstream_session_cookie,omitempty"`
+	CredentialCheckInterval time.Duration `json:"credential_check_interval"`
+
+	SessionStore    string `json:"session_store"`
+	SessionStoreKey string `json:"-"`
+
+	SessionMaxConcurrency int           `json:"session_max_concurrency"`
+	SessionQueueTimeout   time.Duration `json:"session_queue_timeout"`
+	SessionIdleTimeout    time.Duration `json:"session_idle_timeout"`
+
+	CircuitBreaker bool          `json:"circuit_breaker"`
+	Breaker        BreakerConfig `json:"breaker"`
+
+	ModelHealth       bool              `json:"model_health"`
+	ModelHealthConfig ModelHealthConfig `json:"model_health_config"`
+
+	Egress      EgressConfig    `json:"egress"`
+	UpstreamTLS UpstreamTLS     `json:"upstream_tls"`
+	Transport   TransportConfig `json:"transport"`
+	Context     ContextConfig   `json:"context"`
+	Cache       CacheConfig     `json:"cache"`
+
+	CoalesceRequests bool         `json:"coalesce_requests"`
+	Streams          StreamConfig `json:"streams"`
+
+	Metrics      bool   `json:"metrics"`
+	MetricsToken string `json:"-"`
+
+	Tracing TracingConfig `json:"tracing"`
+	Audit   AuditConfig   `json:"audit"`
+
+	FileConfig
+}
+
+// FileConfig 来自 CONFIG_FILE 的结构化配置
+type FileConfig struct {
+	Prices  map[string]ModelPrice   `json:"prices,omitempty"`  // 模型 -> 单价（美元 / 百万 token）
+	Tenants map[string]TenantConfig `json:"tenants,omitempty"` // 租户 -> 会话池配置
+	TLS     map[string]UpstreamTLS  `json:"tls,omitempty"`     // 上游主机 -> TLS 配置
+
+	ContextLimits   map[string]int                  `json:"context_limits,omitempty"`   // 模型 -> 上下文窗口（token）
+	PromptTemplates map[string]PromptTemplateConfig `json:"prompt_templates,omitempty"` // default 或模型 -> 对话拼接格式
+	Policies        []PolicyRule                    `json:"policies,omitempty"`         // 请求策略，按顺序匹配
+	ContentFilters  []FilterRule                    `json:"content_filters,omitempty"`  // 输入输出内容过滤
+	AuditRedactions []FilterRule                    `json:"audit_redactions,omitempty"` // 写入审计日志前的脱敏规则
+}
+
+func loadConfig() (*Config, error) {
+	logLevel := getEnv("LOG_LEVEL", "info")
+	if debugMode := getEnv("DEBUG", "false"); debugMode == "true" || debugMode == "1" {
+		logLevel = "debug"
+	}
+
+	cfg := &Config{
+		BaseURL:        getEnv("BASE_URL", "https://demo.chat-sdk.dev"),
+		Port:           getEnv("PORT", "8080"),
+		WarpProxies:    getEnv("WARP_PROXIES", ""),
+		WarpContainers: getEnv("WARP_CONTAINERS", ""),
+		LogLevel:       logLevel,
+		LogFormat:      getEnv("LOG_FORMAT", logFormatText),
+		UseAuth:        getEnvBool("USE_AUTH", false),
+		APIKeysFile:    getEnv("API_KEYS_FILE", ""),
+		RequireAPIKey:  getEnvBool("REQUIRE_API_KEY", getEnv("API_KEYS_FILE", "") != ""),
+		AdminPort:      getEnv("ADMIN_PORT", ""),
+		AdminToken:     getEnv("ADMIN_TOKEN", ""),
+		UsageDB:        getEnv("USAGE_DB", ""),
+		ConfigFile:     getEnv("CONFIG_FILE", ""),
+		BudgetWebhook:  getEnv("BUDGET_WEBHOOK", ""),
+		SessionPool:    getEnvInt("SESSION_POOL_SIZE", 1),
+
+		UpstreamEmail:           getEnv("UPSTREAM_EMAIL", ""),
+		UpstreamPassword:        getEnv("UPSTREAM_PASSWORD", ""),
+		UpstreamSessionToken:    getEnv("UPSTREAM_SESSION_TOKEN", ""),
+		UpstreamSessionCookie:   getEnv("UPSTREAM_SESSION_COOKIE", ""),
+		CredentialCheckInterval: getEnvDuration("CREDENTIAL_CHECK_INTERVAL", 5*time.Minute),
+
+		SessionStore:    getEnv("SESSION_STORE", ""),
+		SessionStoreKey: getEnv("SESSION_STORE_KEY", ""),
+
+		SessionMaxConcurrency: getEnvInt("SESSION_MAX_CONCURRENCY", 0),
+		SessionQueueTimeout:   getEnvDuration("SESSION_QUEUE_TIMEOUT", 30*time.Second),
+		SessionIdleTimeout:    getEnvDuration("SESSION_IDLE_TIMEOUT", 30*time.Minute),
+
+		CircuitBreaker: getEnvBool("CIRCUIT_BREAKER", true),
+		Breaker: BreakerConfig{
+			Window:        getEnvInt("BREAKER_WINDOW", 20),
+			MinRequests:   getEnvInt("BREAKER_MIN_REQUESTS", 5),
+			ErrorRate:     getEnvFloat("BREAKER_ERROR_RATE", 0.5),
+			SlowThreshold: getEnvDuration("BREAKER_SLOW_THRESHOLD", 30*time.Second),
+			OpenDuration:  getEnvDuration("BREAKER_OPEN_DURATION", 30*time.Second),
+			ProbeInterval: getEnvDuration("BREAKER_PROBE_INTERVAL", 10*time.Second),
+		},
+
+		ModelHealth: getEnvBool("MODEL_HEALTH", true),
+		ModelHealthConfig: ModelHealthConfig{
+			FailureThreshold: getEnvInt("MODEL_FAILURE_THRESHOLD", 3),
+			Cooldown:         getEnvDuration("MODEL_COOLDOWN", 5*time.Minute),
+			Recheck:          getEnvBool("MODEL_RECHECK", true),
+		},
+
+		Egress: loadEgressConfig(),
+		UpstreamTLS: UpstreamTLS{
+			CAFile:     getEnv("UPSTREAM_TLS_CA", ""),
+			CertFile:   getEnv("UPSTREAM_TLS_CERT", ""),
+			KeyFile:    getEnv("UPSTREAM_TLS_KEY", ""),
+			MinVersion: getEnv("UPSTREAM_TLS_MIN_VERSION", ""),
+			ServerName: getEnv("UPSTREAM_TLS_SERVER_NAME", ""),
+			SPKIPins:   splitList(getEnv("UPSTREAM_TLS_PINS", "")),
+		},
+		Transport: TransportConfig{
+			MaxIdleConnsPerHost: getEnvInt("UPSTREAM_MAX_IDLE_CONNS", 32),
+			MaxConnsPerHost:     getEnvInt("UPSTREAM_MAX_CONNS", 0),
+			IdleConnTimeout:     getEnvDuration("UPSTREAM_IDLE_CONN_TIMEOUT", 90*time.Second),
+			DisableHTTP2:        getEnvBool("UPSTREAM_DISABLE_HTTP2", false),
+		},
+		Context: ContextConfig{
+			Strategy:      getEnv("CONTEXT_STRATEGY", contextStrategyDropOldest),
+			KeepLast:      getEnvInt("CONTEXT_KEEP_LAST", 20),
+			SummaryModel:  getEnv("CONTEXT_SUMMARY_MODEL", ""),
+			ReserveTokens: getEnvInt("CONTEXT_RESERVE_TOKENS", 8192),
+			DefaultLimit:  getEnvInt("CONTEXT_DEFAULT_LIMIT", 128000),
+		},
+		CoalesceRequests: getEnvBool("COALESCE_REQUESTS", false),
+		Streams: StreamConfig{
+			Enabled:   getEnvBool("STREAM_RESUME", false),
+			Retention: getEnvDuration("STREAM_RESUME_RETENTION", 5*time.Minute),
+			MaxBytes:  getEnvInt("STREAM_RESUME_MAX_BYTES", 4<<20),
+		},
+		Metrics:      getEnvBool("METRICS", false),
+		MetricsToken: getEnv("METRICS_TOKEN", ""),
+		Tracing:      loadTracingConfig(),
+		Audit: AuditConfig{
+			Dir:            getEnv("AUDIT_DIR", ""),
+			MaxBytes:       int64(getEnvInt("AUDIT_MAX_BYTES", 100<<20)),
+			RotateInterval: getEnvDuration("AUDIT_ROTATE_INTERVAL", 24*time.Hour),
+			Retention:      getEnvDuration("AUDIT_RETENTION", 30*24*time.Hour),
+			Key:            getEnv("AUDIT_KEY", ""),
+		},
+		Cache: CacheConfig{
+			Enabled:       getEnvBool("RESPONSE_CACHE", false),
+			MaxEntries:    getEnvInt("RESPONSE_CACHE_SIZE", 1000),
+			MaxEntryBytes: getEnvInt("RESPONSE_CACHE_MAX_ENTRY_BYTES", 1<<20),
+			TTL:           getEnvDuration("RESPONSE_CACHE_TTL", 24*time.Hour),
+			Path:          getEnv("RESPONSE_CACHE_DB", ""),
+		},
+	}
+
+	if cfg.ConfigFile != "" {
+		data, err := os.ReadFile(cfg.ConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取配置文件失败: %w", err)
+		}
+		if err := json.Unmarshal(data, &cfg.FileConfig); err != nil {
+			return nil, fmt.Errorf("解析配置文件失败: %w", err)
+		}
+	}
+
+	switch cfg.Context.Strategy {
+	case contextStrategyNone, contextStrategyDropOldest, contextStrategyKeepLast, contextStrategySummarize:
+	default:
+		return nil, fmt.Errorf("未知的上下文策略: %s", cfg.Context.Strategy)
+	}
+	if cfg.Context.KeepLast < 1 {
+		cfg.Context.KeepLast = 1
+	}
+	if cfg.Cache.MaxEntries < 1 {
+		cfg.Cache.MaxEntries = 1
+	}
+
+	// SESSION_IDLE_TIMEOUT=0 表示不回收空闲会话
+	if getEnv("SESSION_IDLE_TIMEOUT", "") == "0" {
+		cfg.SessionIdleTimeout = 0
+	}
+	// AUDIT_RETENTION=0 表示不删除审计文件
+	if getEnv("AUDIT_RETENTION", "") == "0" {
+		cfg.Audit.Retention = 0
+	}
+	if cfg.Audit.MaxBytes < 1 {
+		cfg.Audit.MaxBytes = 100 << 20
+	}
+
+	// 运维凭据只能走账户模式
+	if cfg.upstreamCredential().configured() {
+		cfg.UseAuth = true
+	}
+	for _, tc := range cfg.Tenants {
+		if tc.Credential.configured() {
+			cfg.UseAuth = true
+		}
+	}
+	return cfg, nil
+}
+
+// upstreamCredential 由环境变量组成的全局运维凭据，未配置时为 nil
+func (c *Config) upstreamCredential() *UpstreamCredential {
+	if c.UpstreamEmail == "" && c.UpstreamSessionToken == "" {
+		return nil
+	}
+	return &UpstreamCredential{
+		Email:        c.UpstreamEmail,
+		Password:     c.UpstreamPassword,
+		SessionToken: c.UpstreamSessionToken,
+	}
+}
+
+func getEnvInt(key string, defaultVal int) int {
+	if v, err := strconv.Atoi(getEnv(key, "")); err == nil {
+		return v
+	}
+	return defaultVal
+}
+
+func getEnvFloat(key string, defaultVal float64) float64 {
+	if f, err := strconv.ParseFloat(getEnv(key, ""), 64); err == nil && f > 0 {
+		return f
+	}
+	return defaultVal
+}
+
+func getEnvDuration(key string, defaultVal time.Duration) time.Duration {
+	if d, err := time.ParseDuration(getEnv(key, "")); err == nil && d > 0 {
+		return d
+	}
+	return defaultVal
+}
+
+func getEnvBool(key string, defaultVal bool) bool {
+	switch getEnv(key, "") {
+	case "true", "1":
+		return true
+	case "false", "0":
+		return false
+	}
+	return defaultVal
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// 运维提供的上游凭据（自建 chat-sdk）
+// ============================================================================
+
+// UpstreamCredential 上游服务账户，邮箱密码与预签发的 session token 二选一
+type UpstreamCredential struct {
+	Email        string `json:"email,omitempty"`
+	Password     string `json:"password,omitempty"`
+	SessionToken string `json:"session_token,omitempty"`
+}
+
+func (c *UpstreamCredential) configured() bool {
+	return c != nil && (c.SessionToken != "" || (c.Email != "" && c.Password != ""))
+}
+
+// MarshalJSON 输出时隐藏密码和 token，避免通过管理接口泄露
+func (c UpstreamCredential) MarshalJSON() ([]byte, error) {
+	out := map[string]string{}
+	if c.Email != "" {
+		out["email"] = c.Email
+	}
+	if c.Password != "" {
+		out["password"] = "***"
+	}
+	if c.SessionToken != "" {
+		out["session_token"] = "***"
+	}
+	return json.Marshal(out)
+}
+
+// credentialFor 返回租户使用的凭据：租户单独配置的优先，否则使用全局凭据
+func (g *Gateway) credentialFor(tenant string) *UpstreamCredential {
+	if cfg, exists := g.tenants.configs[tenant]; exists && cfg.Credential.configured() {
+		return cfg.Credential
+	}
+	if g.credential.configured() {
+		return g.credential
+	}
+	return nil
+}
+
+// usesCredentials 是否配置了任何运维凭据
+func (g *Gateway) usesCredentials() bool {
+	if g.credential.configured() {
+		return true
+	}
+	for _, cfg := range g.tenants.configs {
+		if cfg.Credential.configured() {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionCookieName 上游 next-auth 会话 cookie 名称，https 下带 __Secure- 前缀
+func (g *Gateway) sessionCookieName() string {
+	if g.sessionCookie != "" {
+		return g.sessionCookie
+	}
+	if strings.HasPrefix(g.baseURL, "https://") {
+		return "__Secure-authjs.session-token"
+	}
+	return "authjs.session-token"
+}
+
+// hasSessionCookie 检查 jar 中是否还有未过期的会话 cookie（过期 cookie 会被 jar 自动丢弃）
+func (g *Gateway) hasSessionCookie(client *http.Client) bool {
+	u, _ := url.Parse(g.baseURL)
+	for _, cookie := range client.Jar.Cookies(u) {
+		if strings.Contains(cookie.Name, "session-token") {
+			return true
+		}
+	}
+	return false
+}
+
+// login 使用运维凭据登录，返回上游确认的账户邮箱
+func (g *Gateway) login(client *http.Client, cred *UpstreamCredential) (string, error) {
+	if cred.SessionToken != "" {
+		u, _ := url.Parse(g.baseURL)
+		client.Jar.SetCookies(u, []*http.Cookie{{
+			Name:     g.sessionCookieName(),
+			Value:    cred.SessionToken,
+			Path:     "/",
+			Secure:   u.Scheme == "https",
+			HttpOnly: true,
+		}})
+		return g.checkSession(client)
+	}
+
+	// 与注册相同的 server action 表单
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	writer.WriteField("1_email", cred.Email)
+	writer.WriteField("1_password", cred.Password)
+	writer.WriteField("0", `[{"status":"idle"},"$K1"]`)
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", g.baseURL+"/login", &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	setFirefoxHeaders(req, FirefoxAcceptHTML)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("登录请求失败: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return "", fmt.Errorf("登录触发限流")
+	}
+	if !g.hasSessionCookie(client) {
+		return "", fmt.Errorf("登录失败，未获取到 session token（状态: %d）", resp.StatusCode)
+	}
+	return g.checkSession(client)
+}
+
+// checkSession 通过 /api/auth/session 确认会话有效，返回账户邮箱
+func (g *Gateway) checkSession(client *http.Client) (string, error) {
+	email, userType, err := g.fetchSession(client)
+	if err != nil {
+		return "", err
+	}
+	if userType == "guest" {
+		return "", fmt.Errorf("上游返回的是游客会话，凭据未生效")
+	}
+	return email, nil
+}
+
+// fetchSession 读取 /api/auth/session，返回会话用户的邮箱和类型
+func (g *Gateway) fetchSession(client *http.Client) (string, string, error) {
+	req, _ := http.NewRequest("GET", g.baseURL+"/api/auth/session", nil)
+	setFirefoxHeaders(req, FirefoxAcceptJSON)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("会话校验请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("会话校验失败，状态: %d", resp.StatusCode)
+	}
+
+	var session struct {
+		User *struct {
+			Email string `json:"email"`
+			Type  string `json:"type"`
+		} `json:"user"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil || session.User == nil {
+		return "", "", fmt.Errorf("session token 无效或已过期")
+	}
+	return session.User.Email, session.User.Type, nil
+}
+
+// reauthenticate 对使用运维凭据的账户重新登录，成功返回 true。
+// since 为发现会话失效的请求发出的时间：此后已经有其他请求重新登录过时直接沿用其结果，
+// 并发请求同时失效时只登录一次
+func (g *Gateway) reauthenticate(sk sessionKey, since time.Time) bool {
+	g.sessionMu.RLock()
+	account, exists := g.accounts[sk]
+	g.sessionMu.RUnlock()
+	if !exists || account.Credential == nil {
+		return false
+	}
+
+	account.loginMu.Lock()
+	if account.loginAt.After(since) {
+		err := account.loginErr
+		account.loginMu.Unlock()
+		logDebug("会话已由其他请求重新登录 | %s", sk)
+		return err == nil
+	}
+	email, err := g.login(account.Client, account.Credential)
+	account.loginAt, account.loginErr = time.Now(), err
+	account.loginMu.Unlock()
+	if err != nil {
+		logError("重新登录失败 | %s, 错误: %v", sk, err)
+		g.credHealth.fail(err)
+		g.clearAccount(sk)
+		return false
+	}
+
+	account.mu.Lock()
+	account.Email = email
+	account.mu.Unlock()
+	g.credHealth.ok()
+	logInfo("重新登录成功 | %s, 账户: %s", sk, email)
+	return true
+}
+
+// ---------------------------------------------------------------------------
+// 健康状态
+// ---------------------------------------------------------------------------
+
+// CredentialHealth 运维凭据健康状态
+type CredentialHealth struct {
+	Healthy   bool      `json:"healthy"`
+	LastError string    `json:"last_error,omitempty"`
+	LastCheck time.Time `json:"last_check"`
+	LastOK    time.Time `json:"last_ok"`
+	mu        sync.Mutex
+}
+
+func (h *CredentialHealth) ok() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.Healthy {
+		logInfo("上游凭据恢复正常")
+	}
+	h.Healthy = true
+	h.LastError = ""
+	h.LastCheck = time.Now()
+	h.LastOK = h.LastCheck
+}
+
+func (h *CredentialHealth) fail(err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.Healthy {
+		logError("上游凭据失效: %v", err)
+	}
+	h.Healthy = false
+	h.LastError = err.Error()
+	h.LastCheck = time.Now()
+}
+
+func (h *CredentialHealth) snapshot() CredentialHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return CredentialHealth{Healthy: h.Healthy, LastError: h.LastError, LastCheck: h.LastCheck, LastOK: h.LastOK}
+}
+
+// checkCredentials 逐个校验使用运维凭据的账户，失效的重新登录。
+// 还没有账户的凭据按正常请求的路径（当前 WARP / 出口代理、租户会话池）登录一个，尽早发现配置错误
+func (g *Gateway) checkCredentials() {
+	g.sessionMu.RLock()
+	var keys []sessionKey
+	loggedIn := make(map[*UpstreamCredential]bool)
+	for key, account := range g.accounts {
+		if account.Credential != nil {
+			keys = append(keys, key)
+			loggedIn[account.Credential] = true
+		}
+	}
+	g.sessionMu.RUnlock()
+
+	for _, tenant := range g.credentialTenants() {
+		if loggedIn[g.credentialFor(tenant)] {
+			continue
+		}
+		// 登录结果由 createAccount 写入健康状态
+		account, err := g.getOrCreateAccount(context.Background(), tenant)
+		if err != nil {
+			logWarn("运维凭据校验失败 | 租户: %s, 错误: %v", tenant, err)
+			continue
+		}
+		g.releaseAccount(account)
+	}
+
+	for _, key := range keys {
+		g.sessionMu.RLock()
+		account, exists := g.accounts[key]
+		g.sessionMu.RUnlock()
+		if !exists {
+			continue
+		}
+
+		start := time.Now()
+		_, err := g.checkSession(account.Client)
+		if err == nil {
+			g.credHealth.ok()
+			continue
+		}
+		logWarn("上游会话校验失败 | %s, 错误: %v，尝试重新登录", key, err)
+		g.reauthenticate(key, start)
+	}
+}
+
+// credentialTenants 每个运维凭据各取一个使用它的租户：全局凭据对应默认租户，其余为单独配置凭据的租户
+func (g *Gateway) credentialTenants() []string {
+	var tenants []string
+	if g.credential.configured() {
+		tenants = append(tenants, "")
+	}
+	for tenant, cfg := range g.tenants.configs {
+		if cfg.Credential.configured() {
+			tenants = append(tenants, tenant)
+		}
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// credentialCheckLoop 定期校验运维凭据
+func (g *Gateway) credentialCheckLoop(interval time.Duration) {
+	g.checkCredentials()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		g.checkCredentials()
+	}
+}
+
+// handleCredentials GET /admin/credentials 查看运维凭据健康状态
+func (a *AdminServer) handleCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if a.gateway.credHealth == nil {
+		writeAdminError(w, http.StatusNotFound, "upstream credentials not configured")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, a.gateway.credHealth.snapshot())
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeAuthUpstream 模拟自建 chat-sdk 的登录和会话接口：每次登录签发新的 token，expire 前签发的 token 都有效
+type fakeAuthUpstream struct {
+	*httptest.Server
+	logins atomic.Int32
+	token  atomic.Value // 最新签发的 session token
+	valid  sync.Map     // 有效的 session token
+}
+
+func newFakeAuthUpstream(t *testing.T) *fakeAuthUpstream {
+	u := &fakeAuthUpstream{}
+	u.token.Store("")
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		valid := false
+		if c, err := r.Cookie("authjs.session-token"); err == nil {
+			_, valid = u.valid.Load(c.Value)
+		}
+		switch r.URL.Path {
+		case "/login":
+			r.ParseMultipartForm(1 << 20)
+			if r.FormValue("1_email") != "ops@example.com" || r.FormValue("1_password") != "secret" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			n := u.logins.Add(1)
+			time.Sleep(20 * time.Millisecond) // 放大并发重新登录的窗口
+			token := fmt.Sprintf("token-%d", n)
+			u.issue(token)
+			http.SetCookie(w, &http.Cookie{Name: "authjs.session-token", Value: token, Path: "/"})
+			w.WriteHeader(http.StatusSeeOther)
+		case "/api/auth/session":
+			if c, err := r.Cookie("authjs.session-token"); err == nil && c.Value == "guest-token" {
+				fmt.Fprint(w, `{"user":{"email":"guest-1@example.com","type":"guest"}}`)
+				return
+			}
+			if !valid {
+				fmt.Fprint(w, `{}`)
+				return
+			}
+			fmt.Fprint(w, `{"user":{"email":"ops@example.com","type":"regular"}}`)
+		case "/api/chat":
+			if !valid {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+		}
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+// issue 签发 token
+func (u *fakeAuthUpstream) issue(token string) {
+	u.token.Store(token)
+	u.valid.Store(token, true)
+}
+
+// expire 让已签发的 token 全部失效
+func (u *fakeAuthUpstream) expire() {
+	u.valid.Range(func(key, _ any) bool {
+		u.valid.Delete(key)
+		return true
+	})
+}
+
+func TestReauthenticateOnce(t *testing.T) {
+	up := newFakeAuthUpstream(t)
+	g := NewGateway(up.URL, NewProxyManager("", ""), false)
+	g.credential = &UpstreamCredential{Email: "ops@example.com", Password: "secret"}
+	g.credHealth = &CredentialHealth{Healthy: true}
+
+	sk := sessionKey{ProxyIndex: -1}
+	account, err := g.createAccount(sk, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.accounts[sk] = account
+	up.expire()
+	before := up.logins.Load()
+
+	const n = 10
+	var wg sync.WaitGroup
+	statuses := make([]int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rc := &RequestContext{ID: fmt.Sprintf("req-%d", i)}
+			chatReq := ChatRequest{Message: Message{Parts: []MessagePart{{Type: "text", Text: "hi"}}}}
+			resp, err := g.postChat(account.Client, sk, chatReq, rc)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	if logins := up.logins.Load() - before; logins != 1 {
+		t.Fatalf("并发失效时重新登录 %d 次, 期望 1 次", logins)
+	}
+	for i, status := range statuses {
+		if status != http.StatusOK {
+			t.Fatalf("请求 %d 重试后状态 %d", i, status)
+		}
+	}
+	u, _ := url.Parse(up.URL)
+	if cookies := account.Client.Jar.Cookies(u); len(cookies) != 1 || cookies[0].Value != up.token.Load().(string) {
+		t.Fatalf("会话 cookie 应更新为最新的 token: %v", cookies)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	up := newFakeAuthUpstream(t)
+	up.issue("preissued")
+	g := NewGateway(up.URL, NewProxyManager("", ""), false)
+
+	tests := []struct {
+		name string
+		cred UpstreamCredential
+		ok   bool
+	}{
+		{"邮箱密码", UpstreamCredential{Email: "ops@example.com", Password: "secret"}, true},
+		{"密码错误", UpstreamCredential{Email: "ops@example.com", Password: "wrong"}, false},
+		{"预签发 token", UpstreamCredential{SessionToken: "preissued"}, true},
+		{"无效 token", UpstreamCredential{SessionToken: "unknown"}, false},
+		{"游客会话", UpstreamCredential{SessionToken: "guest-token"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := g.createHTTPClient("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			email, err := g.login(client, &tt.cred)
+			if (err == nil) != tt.ok {
+				t.Fatalf("期望成功=%v, 错误: %v", tt.ok, err)
+			}
+			if tt.ok && email != "ops@example.com" {
+				t.Fatalf("账户邮箱 %q", email)
+			}
+		})
+	}
+}
+
+// 定期校验：没有账户的凭据经会话池登录，失效的会话重新登录，凭据失效时 /health 返回 503
+func TestCheckCredentials(t *testing.T) {
+	up := newFakeAuthUpstream(t)
+	g := NewGateway(up.URL, NewProxyManager("", ""), true)
+	g.credential = &UpstreamCredential{Email: "ops@example.com", Password: "secret"}
+	g.tenants = NewTenantPools(1, map[string]TenantConfig{
+		"team":  {Credential: &UpstreamCredential{Email: "ops@example.com", Password: "secret"}},
+		"other": {SessionPoolSize: 2},
+	})
+	g.credHealth = &CredentialHealth{Healthy: true}
+	health := func() (int, string) {
+		w := httptest.NewRecorder()
+		g.HandleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		return w.Code, w.Body.String()
+	}
+
+	// 全局凭据和租户凭据各登录一个账户，放入各自的会话池
+	g.checkCredentials()
+	if logins := up.logins.Load(); logins != 2 {
+		t.Fatalf("登录 %d 次, 期望 2 次", logins)
+	}
+	for _, key := range []sessionKey{{ProxyIndex: -1}, {Tenant: "team", ProxyIndex: -1}} {
+		account, exists := g.accounts[key]
+		if !exists || account.Credential == nil || account.inflight != 0 {
+			t.Fatalf("%s 应有已归还的凭据账户: %+v", key, account)
+		}
+	}
+	if code, _ := health(); code != http.StatusOK {
+		t.Fatalf("凭据有效时 /health 状态 %d", code)
+	}
+
+	// 已有账户时只校验会话，不重复登录
+	g.checkCredentials()
+	if logins := up.logins.Load(); logins != 2 {
+		t.Fatalf("会话有效时不应重新登录, 共登录 %d 次", logins)
+	}
+
+	// 会话失效：逐个账户重新登录
+	up.expire()
+	g.checkCredentials()
+	if logins := up.logins.Load(); logins != 4 {
+		t.Fatalf("会话失效后应重新登录每个账户, 共登录 %d 次", logins)
+	}
+
+	// 凭据被改掉：重新登录失败，/health 返回 503
+	g.credential.Password = "rotated"
+	g.tenants.configs["team"].Credential.Password = "rotated"
+	up.expire()
+	g.checkCredentials()
+	if h := g.credHealth.snapshot(); h.Healthy || h.LastError == "" {
+		t.Fatalf("凭据失效后应标记为不健康: healthy=%v, 错误 %q", h.Healthy, h.LastError)
+	}
+	if code, body := health(); code != http.StatusServiceUnavailable || !strings.Contains(body, "upstream credentials invalid") {
+		t.Fatalf("凭据失效时 /health: %d %s", code, body)
+	}
+	if len(g.accounts) != 0 {
+		t.Fatalf("重新登录失败的账户应移除: %v", g.accounts)
+	}
+
+	// 凭据恢复后下一次校验重新登录并恢复健康
+	g.credential.Password = "secret"
+	g.tenants.configs["team"].Credential.Password = "secret"
+	g.checkCredentials()
+	if code, _ := health(); code != http.StatusOK || len(g.accounts) != 2 {
+		t.Fatalf("凭据恢复后 /health 状态 %d, 账户 %d 个", code, len(g.accounts))
+	}
+}
@@ -35,7 +35,7 @@ echo "📥 准备部署文件..."
 
 # 如果文件已存在则跳过
 if [ ! -f "main.go" ]; then
-    echo "请将 main.go, Dockerfile, docker-compose.yml 复制到 $DEPLOY_DIR"
+    echo "请将 *.go, go.mod, go.sum, Dockerfile, docker-compose.yml 复制到 $DEPLOY_DIR"
     exit 1
 fi
 
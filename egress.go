@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// ============================================================================
+// 出口代理
+// ============================================================================
+
+// EgressConfig 企业出口代理配置。WARP 代理优先，未配置 WARP 代理时使用出口代理
+type EgressConfig struct {
+	ProxyURL      string        `json:"proxy_url,omitempty"` // EGRESS_PROXY，为空时读取 HTTPS_PROXY / HTTP_PROXY
+	NoProxy       string        `json:"no_proxy,omitempty"`  // 不走代理的地址，同 NO_PROXY 语法
+	Username      string        `json:"username,omitempty"`  // 代理认证用户名，URL 中已带认证信息时可不填
+	Password      string        `json:"-"`
+	CheckInterval time.Duration `json:"check_interval"` // 连通性检查间隔
+}
+
+// MarshalJSON 输出时隐藏代理地址中的密码
+func (e EgressConfig) MarshalJSON() ([]byte, error) {
+	type plain EgressConfig
+	out := plain(e)
+	out.ProxyURL = redactProxyList(e.ProxyURL)
+	return json.Marshal(out)
+}
+
+// loadEgressConfig 读取出口代理配置，EGRESS_* 优先于标准代理环境变量
+func loadEgressConfig() EgressConfig {
+	env := httpproxy.FromEnvironment()
+	cfg := EgressConfig{
+		ProxyURL:      getEnv("EGRESS_PROXY", ""),
+		NoProxy:       getEnv("EGRESS_NO_PROXY", env.NoProxy),
+		Username:      getEnv("EGRESS_PROXY_USERNAME", ""),
+		Password:      getEnv("EGRESS_PROXY_PASSWORD", ""),
+		CheckInterval: getEnvDuration("EGRESS_CHECK_INTERVAL", time.Minute),
+	}
+	if cfg.ProxyURL == "" {
+		cfg.ProxyURL = env.HTTPSProxy
+	}
+	if cfg.ProxyURL == "" {
+		cfg.ProxyURL = env.HTTPProxy
+	}
+	return cfg
+}
+
+// proxyURLWithAuth 解析代理地址并补上认证信息；没有协议前缀时按 http 处理
+func (e EgressConfig) proxyURLWithAuth(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("代理地址无效: %s", redactProxyList(raw))
+	}
+	if u.User == nil && e.Username != "" {
+		u.User = url.UserPassword(e.Username, e.Password)
+	}
+	return u, nil
+}
+
+// configureProxy 为 transport 配置代理：
+// warpProxy 非空时使用 WARP 代理，否则使用出口代理；目标命中 NO_PROXY 时直连
+func (g *Gateway) configureProxy(transport *http.Transport, warpProxy string) error {
+	raw := warpProxy
+	if raw == "" {
+		raw = g.egress.ProxyURL
+	}
+	if raw == "" {
+		return nil
+	}
+
+	proxyParsed, err := g.egress.proxyURLWithAuth(raw)
+	if err != nil {
+		return err
+	}
+
+	switch proxyParsed.Scheme {
+	case "http", "https":
+		// 标准库会在 CONNECT 请求中根据 URL 中的认证信息发送 Proxy-Authorization
+		proxyFunc := (&httpproxy.Config{
+			HTTPProxy:  proxyParsed.String(),
+			HTTPSProxy: proxyParsed.String(),
+			NoProxy:    g.egress.NoProxy,
+		}).ProxyFunc()
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+		// 标准库与 https 代理握手时同样使用 TLSClientConfig，上游的主机名覆盖和 SPKI 固定会套用到代理上
+		if proxyParsed.Scheme == "https" && g.upstreamTLS != nil {
+			transport.DialTLSContext = g.dialTLSViaProxy(transport, proxyAddr(proxyParsed))
+		}
+	case "socks5", "socks5h":
+		// SOCKS5 在拨号层生效，NO_PROXY 按上游地址判断一次
+		if g.bypassProxy() {
+			return nil
+		}
+		auth := &proxy.Auth{}
+		if proxyParsed.User != nil {
+			auth.User = proxyParsed.User.Username()
+			auth.Password, _ = proxyParsed.User.Password()
+		}
+		dialer, err := proxy.SOCKS5("tcp", proxyParsed.Host, auth, &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+		if err != nil {
+			return fmt.Errorf("创建 SOCKS5 失败: %w", err)
+		}
+		contextDialer, ok := dialer.(proxy.ContextDialer)
+		if !ok {
+			return fmt.Errorf("SOCKS5 拨号器不支持 DialContext")
+		}
+		transport.DialContext = contextDialer.DialContext
+	default:
+		return fmt.Errorf("不支持的代理协议: %s", proxyParsed.Scheme)
+	}
+	return nil
+}
+
+// proxyAddr 代理的 host:port，未写端口时使用协议默认端口
+func proxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// dialTLSViaProxy https 代理下的 TLS 拨号：连接代理时使用 proxyTLS，
+// 命中 NO_PROXY 直连上游时使用 transport 的上游配置。经过代理的上游 TLS 仍由标准库在隧道内完成
+func (g *Gateway) dialTLSViaProxy(transport *http.Transport, proxy string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		cfg := transport.TLSClientConfig
+		if addr == proxy {
+			cfg = g.proxyTLS
+		}
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		cfg = cfg.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+
+		conn, err := transport.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// bypassProxy 上游地址是否命中 NO_PROXY
+func (g *Gateway) bypassProxy() bool {
+	if g.egress.NoProxy == "" {
+		return false
+	}
+	target, err := url.Parse(g.baseURL)
+	if err != nil {
+		return false
+	}
+	// 用一个占位代理判断 NO_PROXY 是否命中
+	proxyFunc := (&httpproxy.Config{HTTPProxy: "http://placeholder", HTTPSProxy: "http://placeholder", NoProxy: g.egress.NoProxy}).ProxyFunc()
+	u, _ := proxyFunc(target)
+	return u == nil
+}
+
+// ---------------------------------------------------------------------------
+// 连通性检查
+// ---------------------------------------------------------------------------
+
+// EgressStatus 单个出口的连通性
+type EgressStatus struct {
+	ProxyIndex int       `json:"proxy_index"` // -1 表示出口代理或直连
+	Proxy      string    `json:"proxy,omitempty"`
+	Healthy    bool      `json:"healthy"`
+	LastError  string    `json:"last_error,omitempty"`
+	LastCheck  time.Time `json:"last_check"`
+	Latency    string    `json:"latency,omitempty"`
+}
+
+// EgressHealth 所有出口的连通性
+type EgressHealth struct {
+	routes map[int]*EgressStatus
+	mu     sync.Mutex
+}
+
+func (eh *EgressHealth) set(status EgressStatus) {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+	prev, exists := eh.routes[status.ProxyIndex]
+	switch {
+	case !status.Healthy && (!exists || prev.Healthy):
+		logError("出口不可用 | 代理: [%d] %s, 错误: %s", status.ProxyIndex, status.Proxy, status.LastError)
+	case status.Healthy && exists && !prev.Healthy:
+		logInfo("出口恢复 | 代理: [%d] %s", status.ProxyIndex, status.Proxy)
+	}
+	eh.routes[status.ProxyIndex] = &status
+}
+
+func (eh *EgressHealth) list() []EgressStatus {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+	list := make([]EgressStatus, 0, len(eh.routes))
+	for _, status := range eh.routes {
+		list = append(list, *status)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ProxyIndex < list[j].ProxyIndex })
+	return list
+}
+
+// healthy 至少一个出口可用；还没有检查结果时视为可用
+func (eh *EgressHealth) healthy() bool {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+	if len(eh.routes) == 0 {
+		return true
+	}
+	for _, status := range eh.routes {
+		if status.Healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// egressIndexes 需要检查的出口：配置了 WARP 代理时检查每个代理，否则检查出口代理 / 直连
+func (g *Gateway) egressIndexes() []int {
+	if n := len(g.proxyMgr.proxies); n > 0 {
+		indexes := make([]int, n)
+		for i := range indexes {
+			indexes[i] = i
+		}
+		return indexes
+	}
+	return []int{-1}
+}
+
+// checkEgress 通过指定出口请求上游首页，区分代理不可达、代理认证失败和上游不可达
+func (g *Gateway) checkEgress(proxyIndex int) EgressStatus {
+	proxyURL, _ := g.proxyMgr.proxyURL(proxyIndex)
+	shown := proxyURL
+	if shown == "" {
+		shown = g.egress.ProxyURL
+	}
+	status := EgressStatus{ProxyIndex: proxyIndex, Proxy: redactProxyList(shown), LastCheck: time.Now()}
+
+	client, err := g.createHTTPClient(proxyURL)
+	if err != nil {
+		status.LastError = err.Error()
+		return status
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "HEAD", g.baseURL+"/", nil)
+	setFirefoxHeaders(req, FirefoxAcceptHTML)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		status.LastError = describeEgressError(err)
+		return status
+	}
+	resp.Body.Close()
+	status.Latency = time.Since(start).Round(time.Millisecond).String()
+
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		status.LastError = "代理认证失败 (407)，请检查 EGRESS_PROXY_USERNAME / EGRESS_PROXY_PASSWORD"
+		return status
+	case resp.StatusCode >= 500:
+		// 代理返回的 502/503 或上游自身故障，出口都无法正常使用
+		status.LastError = fmt.Sprintf("上游不可用 (%d)", resp.StatusCode)
+		return status
+	}
+	status.Healthy = true
+	return status
+}
+
+// describeEgressError 把连接错误转换为便于排查的说明
+func describeEgressError(err error) string {
+	msg := err.Error()
+	var opErr *net.OpError
+	switch {
+	case strings.Contains(msg, "Proxy Authentication Required"):
+		return "代理认证失败 (407)，请检查 EGRESS_PROXY_USERNAME / EGRESS_PROXY_PASSWORD: " + msg
+	case strings.Contains(msg, "proxyconnect"), strings.Contains(msg, "socks connect"):
+		return "代理不可达: " + msg
+	case errors.Is(err, context.DeadlineExceeded):
+		return "连接超时: " + msg
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "上游不可达: " + msg
+	}
+	return msg
+}
+
+// checkAllEgress 检查所有出口并记录结果
+func (g *Gateway) checkAllEgress() {
+	for _, index := range g.egressIndexes() {
+		g.egressHealth.set(g.checkEgress(index))
+	}
+}
+
+// egressCheckLoop 启动时及之后定期检查出口连通性
+func (g *Gateway) egressCheckLoop() {
+	g.checkAllEgress()
+	ticker := time.NewTicker(g.egress.CheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		g.checkAllEgress()
+	}
+}
+
+// handleEgress GET /admin/egress 查看出口连通性，POST 立即检查
+func (a *AdminServer) handleEgress(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		a.gateway.checkAllEgress()
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"config": a.gateway.egress,
+		"routes": a.gateway.egressHealth.list(),
+	})
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ============================================================================
+// 内容过滤
+// ============================================================================
+
+// 过滤动作
+const (
+	filterBlock  = "block"  // 输入拒绝请求，输出停止生成
+	filterRedact = "redact" // 替换为占位符
+	filterFlag   = "flag"   // 只记录
+)
+
+// 过滤方向
+const (
+	filterInput  = "input"
+	filterOutput = "output"
+	filterBoth   = "both"
+)
+
+// filterHoldback 流式输出时保留在缓冲区的字节数，跨 chunk 的匹配在缓冲区内补全后再脱敏
+const filterHoldback = 128
+
+// piiDetectors 内置 PII 检测
+var piiDetectors = map[string]struct {
+	pattern  string
+	validate func(string) bool
+}{
+	"email":   {pattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`},
+	"phone":   {pattern: `(?:\+?86[ -]?)?\b1[3-9]\d{9}\b|(?:\+\d{1,3}[ .-]?)?\(?\b\d{3}\)?[ .-]\d{3}[ .-]\d{4}\b`},
+	"card":    {pattern: `\b\d(?:[ -]?\d){12,18}\b`, validate: luhnValid},
+	"api_key": {pattern: `\b(?:sk-(?:ant-|proj-)?[A-Za-z0-9_-]{20,}|AKIA[0-9A-Z]{16}|gh[pousr]_[A-Za-z0-9]{36}|AIza[0-9A-Za-z_-]{35}|xox[abprs]-[A-Za-z0-9-]{10,})`},
+}
+
+// FilterRule 一条过滤规则，detector / pattern / words 三选一
+type FilterRule struct {
+	Name        string   `json:"name"`
+	Direction   string   `json:"direction,omitempty"`   // input / output / both，默认 both
+	Detector    string   `json:"detector,omitempty"`    // 内置检测：email / phone / card / api_key
+	Pattern     string   `json:"pattern,omitempty"`     // 正则
+	Words       []string `json:"words,omitempty"`       // 词表，不区分大小写
+	Action      string   `json:"action"`                // block / redact / flag
+	Replacement string   `json:"replacement,omitempty"` // redact 的占位符，默认 [REDACTED:<name>]
+
+	re       *regexp.Regexp
+	validate func(string) bool
+}
+
+// ContentFilter 编译后的过滤规则
+type ContentFilter struct {
+	input  []*FilterRule
+	output []*FilterRule
+}
+
+// NewContentFilter 校验并编译 CONFIG_FILE 中的 content_filters，没有规则时返回 nil
+func NewContentFilter(rules []FilterRule) (*ContentFilter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	cf := &ContentFilter{}
+	for i := range rules {
+		rule := rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		switch rule.Action {
+		case filterBlock, filterRedact, filterFlag:
+		default:
+			return nil, fmt.Errorf("过滤规则 %s: 未知动作 %q", rule.Name, rule.Action)
+		}
+		if rule.Replacement == "" {
+			rule.Replacement = "[REDACTED:" + rule.Name + "]"
+		}
+
+		var pattern string
+		switch {
+		case rule.Detector != "":
+			detector, exists := piiDetectors[rule.Detector]
+			if !exists {
+				return nil, fmt.Errorf("过滤规则 %s: 未知检测 %q", rule.Name, rule.Detector)
+			}
+			pattern, rule.validate = detector.pattern, detector.validate
+		case rule.Pattern != "":
+			pattern = rule.Pattern
+		case len(rule.Words) > 0:
+			pattern = wordsPattern(rule.Words)
+		default:
+			return nil, fmt.Errorf("过滤规则 %s: 需要 detector、pattern 或 words", rule.Name)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("过滤规则 %s: 正则无效: %w", rule.Name, err)
+		}
+		rule.re = re
+
+		switch rule.Direction {
+		case filterInput:
+			cf.input = append(cf.input, &rule)
+		case filterOutput:
+			cf.output = append(cf.output, &rule)
+		case "", filterBoth:
+			cf.input = append(cf.input, &rule)
+			cf.output = append(cf.output, &rule)
+		default:
+			return nil, fmt.Errorf("过滤规则 %s: 未知方向 %q", rule.Name, rule.Direction)
+		}
+	}
+	return cf, nil
+}
+
+// wordsPattern 词表转为正则；英文词按单词边界匹配，中文等词直接匹配
+func wordsPattern(words []string) string {
+	alts := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w == "" {
+			continue
+		}
+		quoted := regexp.QuoteMeta(w)
+		if isASCIIWord(w) {
+			quoted = `\b` + quoted + `\b`
+		}
+		alts = append(alts, quoted)
+	}
+	return `(?i)(?:` + strings.Join(alts, "|") + `)`
+}
+
+func isASCIIWord(s string) bool {
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// luhnValid 卡号校验
+func luhnValid(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// matches 返回规则在文本中的匹配区间
+func (rule *FilterRule) matches(text string) [][]int {
+	var spans [][]int
+	for _, loc := range rule.re.FindAllStringIndex(text, -1) {
+		if rule.validate == nil || rule.validate(text[loc[0]:loc[1]]) {
+			spans = append(spans, loc)
+		}
+	}
+	return spans
+}
+
+// redact 替换规则的所有匹配
+func (rule *FilterRule) redact(text string) string {
+	spans := rule.matches(text)
+	if len(spans) == 0 {
+		return text
+	}
+	var b strings.Builder
+	last := 0
+	for _, span := range spans {
+		b.WriteString(text[last:span[0]])
+		b.WriteString(rule.Replacement)
+		last = span[1]
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// applyFilterRules 依次执行规则：命中 block 时返回该规则；redact 替换文本；flag 和 redact 通过 onHit 记录
+func applyFilterRules(rules []*FilterRule, text string, onHit func(rule *FilterRule, count int)) (string, *FilterRule) {
+	for _, rule := range rules {
+		spans := rule.matches(text)
+		if len(spans) == 0 {
+			continue
+		}
+		onHit(rule, len(spans))
+		switch rule.Action {
+		case filterBlock:
+			return text, rule
+		case filterRedact:
+			text = rule.redact(text)
+		}
+	}
+	return text, nil
+}
+
+// ---------------------------------------------------------------------------
+// 网关集成
+// ---------------------------------------------------------------------------
+
+var (
+	filterActionNames    = map[string]string{filterBlock: "拦截", filterRedact: "脱敏", filterFlag: "标记"}
+	filterDirectionNames = map[string]string{filterInput: "输入", filterOutput: "输出"}
+)
+
+// recordFilterHit 记录命中，同一规则在一个请求中只标记一次
+func recordFilterHit(rc *RequestContext, direction string, rule *FilterRule, count int) {
+	logInfo("%s | 内容过滤 | 方向: %s, 规则: %s, 动作: %s, 命中: %d", rc.ID, filterDirectionNames[direction], rule.Name, filterActionNames[rule.Action], count)
+	flag := direction + ":" + rule.Name
+	for _, f := range rc.ContentFlags {
+		if f == flag {
+			return
+		}
+	}
+	rc.ContentFlags = append(rc.ContentFlags, flag)
+}
+
+// filterInput 在构建上游请求前过滤所有消息，命中 block 时返回 400；
+// 命中规则写入 X-Content-Filter 响应头
+func (g *Gateway) filterInput(w http.ResponseWriter, rc *RequestContext, req *OpenAIRequest, protocol apiProtocol) bool {
+	if g.filters == nil || len(g.filters.input) == 0 {
+		return true
+	}
+	onHit := func(rule *FilterRule, count int) { recordFilterHit(rc, filterInput, rule, count) }
+	for i, msg := range req.Messages {
+		filtered, blocked := g.filters.filterContent(msg.Content, onHit)
+		if blocked != nil {
+			rc.ErrorClass = errClassContentFilter
+			writeAPIError(w, protocol, http.StatusBadRequest, "content_filter",
+				fmt.Sprintf("Request blocked by content filter (%s)", blocked.Name))
+			return false
+		}
+		req.Messages[i].Content = filtered
+	}
+	if len(rc.ContentFlags) > 0 {
+		w.Header().Set("X-Content-Filter", strings.Join(rc.ContentFlags, ", "))
+	}
+	return true
+}
+
+// filterContent 按输入规则过滤一条消息的内容。数组格式逐个过滤 text 部分并原位替换，
+// 图片等其他部分保持不变
+func (cf *ContentFilter) filterContent(content interface{}, onHit func(rule *FilterRule, count int)) (interface{}, *FilterRule) {
+	switch v := content.(type) {
+	case string:
+		filtered, blocked := applyFilterRules(cf.input, v, onHit)
+		return filtered, blocked
+	case []interface{}:
+		for _, item := range v {
+			part, ok := item.(map[string]interface{})
+			if !ok || part["type"] != "text" {
+				continue
+			}
+			text, ok := part["text"].(string)
+			if !ok {
+				continue
+			}
+			filtered, blocked := applyFilterRules(cf.input, text, onHit)
+			if blocked != nil {
+				return content, blocked
+			}
+			part["text"] = filtered
+		}
+	}
+	return content, nil
+}
+
+// outputFilter 流式输出过滤。缓冲区末尾保留 filterHoldback 字节，
+// 跨 chunk 的匹配在缓冲区内补全后整体替换；nil 表示不过滤
+type outputFilter struct {
+	rules   []*FilterRule
+	rc      *RequestContext
+	buf     string
+	blocked *FilterRule // 命中 block 的规则，之后的输出全部丢弃
+}
+
+// newOutputFilter 没有输出规则时返回 nil
+func (g *Gateway) newOutputFilter(rc *RequestContext) *outputFilter {
+	if g.filters == nil || len(g.filters.output) == 0 {
+		return nil
+	}
+	return &outputFilter{rules: g.filters.output, rc: rc}
+}
+
+// push 追加一段输出，返回可以安全发送的部分
+func (f *outputFilter) push(delta string) string {
+	if f == nil {
+		return delta
+	}
+	if f.blocked != nil {
+		return ""
+	}
+	f.buf += delta
+
+	// block 规则在缓冲区内一出现就停止输出
+	for _, rule := range f.rules {
+		if rule.Action == filterBlock && len(rule.matches(f.buf)) > 0 {
+			f.block(rule)
+			return ""
+		}
+	}
+
+	safe := len(f.buf) - filterHoldback
+	if safe <= 0 {
+		return ""
+	}
+	for safe > 0 && !utf8.RuneStart(f.buf[safe]) {
+		safe--
+	}
+	// 不在匹配中间切分：跨越切分点的匹配整体留在缓冲区
+	var spans [][]int
+	for _, rule := range f.rules {
+		spans = append(spans, rule.matches(f.buf)...)
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] > spans[j][0] })
+	for _, span := range spans {
+		if span[0] < safe && span[1] > safe {
+			safe = span[0]
+		}
+	}
+
+	out := f.buf[:safe]
+	f.buf = f.buf[safe:]
+	return f.apply(out)
+}
+
+// flush 输出结束时处理缓冲区中剩余的内容
+func (f *outputFilter) flush() string {
+	if f == nil || f.blocked != nil {
+		return ""
+	}
+	out := f.buf
+	f.buf = ""
+	return f.apply(out)
+}
+
+func (f *outputFilter) apply(text string) string {
+	if text == "" {
+		return ""
+	}
+	out, blocked := applyFilterRules(f.rules, text, func(rule *FilterRule, count int) {
+		if rule.Action != filterBlock {
+			recordFilterHit(f.rc, filterOutput, rule, count)
+		}
+	})
+	if blocked != nil {
+		f.block(blocked)
+		return ""
+	}
+	return out
+}
+
+func (f *outputFilter) block(rule *FilterRule) {
+	recordFilterHit(f.rc, filterOutput, rule, 1)
+	f.blocked = rule
+	f.buf = ""
+}
+
+// isBlocked 输出是否已被拦截
+func (f *outputFilter) isBlocked() bool {
+	return f != nil && f.blocked != nil
+}
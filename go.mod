@@ -3,6 +3,15 @@ module demo
 go 1.21
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.17.11
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/crypto v0.21.0
 	golang.org/x/net v0.23.0
 )
+
+require (
+	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
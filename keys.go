@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// API Key 与权限
+// ============================================================================
+
+// APIKey 客户端 API Key 及其权限
+type APIKey struct {
+	Key              string   `json:"key"`
+	Name             string   `json:"name"`
+	Tenant           string   `json:"tenant,omitempty"`            // 所属租户，为空时 Key 自成一个租户
+	AllowedModels    []string `json:"allowed_models,omitempty"`    // 为空不限制，别名经 convertModel 解析
+	AllowedEndpoints []string `json:"allowed_endpoints,omitempty"` // 为空不限制，如 /v1/messages
+	MaxOutputTokens  int      `json:"max_output_tokens,omitempty"` // 强制输出上限（估算 token）
+	SystemPrompt     string   `json:"system_prompt,omitempty"`     // 强制系统提示词前缀
+	MonthlyBudget    float64  `json:"monthly_budget,omitempty"`    // 月预算（美元），达到后拒绝请求
+	SoftLimit        float64  `json:"soft_limit,omitempty"`        // 软上限（美元），默认预算的 80%
+	BudgetWebhook    string   `json:"budget_webhook,omitempty"`    // 预算告警 Webhook，为空时使用全局配置
+	NoCache          bool     `json:"no_cache,omitempty"`          // 不使用响应缓存
+	Audit            bool     `json:"audit,omitempty"`             // 记录完整请求与回复到审计日志
+	Disabled         bool     `json:"disabled,omitempty"`
+}
+
+// label 用于日志与统计的 Key 标识，未命名时使用脱敏后的 Key
+func (k *APIKey) label() string {
+	if k.Name != "" {
+		return k.Name
+	}
+	return maskKey(k.Key)
+}
+
+// id Key 的稳定标识（Key 的 SHA-256 前 16 位十六进制），不暴露 Key 本身。
+// 名称可以重复，按 Key 隔离的状态（花费、租户等）必须用它而不是 label
+func (k *APIKey) id() string {
+	sum := sha256.Sum256([]byte(k.Key))
+	return "key-" + hex.EncodeToString(sum[:8])
+}
+
+// KeyStore API Key 存储。是否鉴权由启动配置决定，与 Key 数量无关：
+// 删光所有 Key 后拒绝全部请求，而不是放行
+type KeyStore struct {
+	keys     map[string]*APIKey
+	path     string
+	required bool
+	mu       sync.RWMutex
+}
+
+// NewKeyStore 从 JSON 文件加载 API Key 列表，path 为空时返回空存储；
+// required 为 true 时即使没有任何 Key 也要求鉴权
+func NewKeyStore(path string, required bool) (*KeyStore, error) {
+	ks := &KeyStore{
+		keys:     make(map[string]*APIKey),
+		path:     path,
+		required: required,
+	}
+	if path == "" {
+		return ks, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取 API Key 文件失败: %w", err)
+	}
+
+	var keys []*APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("解析 API Key 文件失败: %w", err)
+	}
+	for _, k := range keys {
+		if k.Key == "" {
+			continue
+		}
+		ks.keys[k.Key] = k
+	}
+	return ks, nil
+}
+
+// Enabled 是否启用鉴权
+func (ks *KeyStore) Enabled() bool {
+	return ks.required
+}
+
+// Len 当前 Key 数量
+func (ks *KeyStore) Len() int {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return len(ks.keys)
+}
+
+func (ks *KeyStore) Lookup(key string) (*APIKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	k, exists := ks.keys[key]
+	if !exists || k.Disabled {
+		return nil, false
+	}
+	return k, true
+}
+
+// List 返回所有 Key 的副本，按名称排序
+func (ks *KeyStore) List() []APIKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	list := make([]APIKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		list = append(list, *k)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+func (ks *KeyStore) Get(key string) (APIKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	k, exists := ks.keys[key]
+	if !exists {
+		return APIKey{}, false
+	}
+	return *k, true
+}
+
+// Put 新增或替换 Key，Key 为空时自动生成，并写回文件
+func (ks *KeyStore) Put(k APIKey) (APIKey, error) {
+	if k.Key == "" {
+		k.Key = "sk-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	// 替换指针而非原地修改，处理中的请求仍持有旧配置
+	ks.keys[k.Key] = &k
+	return k, ks.saveLocked()
+}
+
+// Delete 删除 Key 并写回文件
+func (ks *KeyStore) Delete(key string) (bool, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if _, exists := ks.keys[key]; !exists {
+		return false, nil
+	}
+	delete(ks.keys, key)
+	return true, ks.saveLocked()
+}
+
+// saveLocked 写回 Key 文件（先写临时文件再替换），未配置文件时只保存在内存
+func (ks *KeyStore) saveLocked() error {
+	if ks.path == "" {
+		return nil
+	}
+
+	list := make([]*APIKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ks.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("写入 API Key 文件失败: %w", err)
+	}
+	return os.Rename(tmp, ks.path)
+}
+
+// maskKey 脱敏显示 Key
+func maskKey(key string) string {
+	if len(key) <= 8 {
+		return strings.Repeat("*", len(key))
+	}
+	return key[:4] + "..." + key[len(key)-4:]
+}
+
+// allowsModel 检查模型是否在白名单内，两侧都按 convertModel 解析别名
+func (k *APIKey) allowsModel(model string, convert func(string) string) bool {
+	if k == nil || len(k.AllowedModels) == 0 {
+		return true
+	}
+	target := convert(model)
+	for _, allowed := range k.AllowedModels {
+		if allowed == "*" || convert(allowed) == target {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) allowsEndpoint(endpoint string) bool {
+	if k == nil || len(k.AllowedEndpoints) == 0 {
+		return true
+	}
+	for _, allowed := range k.AllowedEndpoints {
+		if allowed == "*" || strings.TrimSuffix(allowed, "/") == strings.TrimSuffix(endpoint, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) maxOutputTokens() int {
+	if k == nil {
+		return 0
+	}
+	return k.MaxOutputTokens
+}
+
+// applySystemPrompt 将强制系统提示词插入到用户系统提示词之前
+func (k *APIKey) applySystemPrompt(messages []OpenAIMessage, extract func(interface{}) string) []OpenAIMessage {
+	if k == nil || k.SystemPrompt == "" {
+		return messages
+	}
+
+	result := make([]OpenAIMessage, 0, len(messages)+1)
+	injected := false
+	for _, msg := range messages {
+		if msg.Role == "system" && !injected {
+			msg.Content = k.SystemPrompt + "\n\n" + extract(msg.Content)
+			injected = true
+		}
+		result = append(result, msg)
+	}
+	if !injected {
+		result = append([]OpenAIMessage{{Role: "system", Content: k.SystemPrompt}}, result...)
+	}
+	return result
+}
+
+// extractAPIKey 从 Authorization: Bearer 或 x-api-key 头中读取 Key
+func extractAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if strings.HasPrefix(auth, "Bearer ") {
+			return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		}
+	}
+	return strings.TrimSpace(r.Header.Get("x-api-key"))
+}
+
+// authenticate 校验 API Key 与端点权限，失败时已写出对应协议的错误响应
+func (g *Gateway) authenticate(w http.ResponseWriter, r *http.Request, rc *RequestContext, protocol apiProtocol) bool {
+	if g.keys == nil || !g.keys.Enabled() {
+		return true
+	}
+
+	key, ok := g.keys.Lookup(extractAPIKey(r))
+	if !ok {
+		logWarn("%s | API Key 无效 | 端点: %s", rc.ID, rc.Endpoint)
+		rc.ErrorClass = errClassAuth
+		writeAPIError(w, protocol, http.StatusUnauthorized, "invalid_api_key", "Invalid API key")
+		return false
+	}
+	rc.Key = key
+
+	if !key.allowsEndpoint(rc.Endpoint) {
+		logWarn("%s | 端点无权限 | Key: %s, 端点: %s", rc.ID, key.Name, rc.Endpoint)
+		rc.ErrorClass = errClassForbidden
+		writeAPIError(w, protocol, http.StatusForbidden, "endpoint_not_allowed",
+			fmt.Sprintf("This API key is not allowed to access %s", rc.Endpoint))
+		return false
+	}
+	return true
+}
+
+// checkModelAllowed 校验模型权限，失败时已写出对应协议的错误响应
+func (g *Gateway) checkModelAllowed(w http.ResponseWriter, rc *RequestContext, model string, protocol apiProtocol) bool {
+	if rc.Key.allowsModel(model, g.convertModel) {
+		return true
+	}
+	logWarn("%s | 模型无权限 | Key: %s, 模型: %s", rc.ID, rc.Key.Name, model)
+	rc.ErrorClass = errClassForbidden
+	writeAPIError(w, protocol, http.StatusForbidden, "model_not_allowed",
+		fmt.Sprintf("This API key is not allowed to use model %s", model))
+	return false
+}
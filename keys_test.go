@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func newTestGateway() *Gateway {
+	return NewGateway("http://127.0.0.1:0", NewProxyManager("", ""), false)
+}
+
+func authRequest(t *testing.T, g *Gateway, key string) (int, *RequestContext) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	w := httptest.NewRecorder()
+	rc := newRequestContext(w, r)
+	if g.authenticate(w, r, rc, protocolOpenAI) {
+		return http.StatusOK, rc
+	}
+	return w.Code, rc
+}
+
+func TestAuthenticate(t *testing.T) {
+	ks, err := NewKeyStore("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newTestGateway()
+	g.keys = ks
+
+	// 启用鉴权但没有任何 Key 时拒绝所有请求
+	if code, _ := authRequest(t, g, ""); code != http.StatusUnauthorized {
+		t.Fatalf("空存储无 Key 请求: 状态码 %d, 期望 401", code)
+	}
+
+	if _, err := ks.Put(APIKey{Key: "sk-a", Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Put(APIKey{Key: "sk-off", Name: "off", Disabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Put(APIKey{Key: "sk-msg", Name: "msg", AllowedEndpoints: []string{"/v1/messages"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		want int
+	}{
+		{"有效 Key", "sk-a", http.StatusOK},
+		{"缺少 Key", "", http.StatusUnauthorized},
+		{"未知 Key", "sk-unknown", http.StatusUnauthorized},
+		{"已禁用", "sk-off", http.StatusUnauthorized},
+		{"端点不在白名单", "sk-msg", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, rc := authRequest(t, g, tt.key)
+			if code != tt.want {
+				t.Fatalf("状态码 %d, 期望 %d", code, tt.want)
+			}
+			if code == http.StatusOK && (rc.Key == nil || rc.Key.Key != tt.key) {
+				t.Fatalf("rc.Key 未设置为 %s", tt.key)
+			}
+		})
+	}
+
+	// 删除最后一个可用 Key 后仍然鉴权，不会变为放行
+	for _, k := range []string{"sk-a", "sk-off", "sk-msg"} {
+		if _, err := ks.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code, _ := authRequest(t, g, "sk-a"); code != http.StatusUnauthorized {
+		t.Fatalf("删除全部 Key 后: 状态码 %d, 期望 401", code)
+	}
+}
+
+func TestAuthenticateDisabled(t *testing.T) {
+	ks, err := NewKeyStore("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newTestGateway()
+	g.keys = ks
+	if code, rc := authRequest(t, g, ""); code != http.StatusOK || rc.Key != nil {
+		t.Fatalf("未启用鉴权: 状态码 %d, Key %v", code, rc.Key)
+	}
+}
+
+func TestKeyStorePersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	ks, err := NewKeyStore("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.path = path
+	created, err := ks.Put(APIKey{Name: "gen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created.Key) < 10 {
+		t.Fatalf("自动生成的 Key 过短: %q", created.Key)
+	}
+
+	reloaded, err := NewKeyStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := reloaded.Lookup(created.Key); !ok || k.Name != "gen" {
+		t.Fatalf("重新加载后找不到 Key %s", created.Key)
+	}
+}
+
+func TestAllowsModel(t *testing.T) {
+	g := newTestGateway()
+	k := &APIKey{AllowedModels: []string{"gpt-5.2"}}
+	tests := []struct {
+		model string
+		want  bool
+	}{
+		{"gpt-5.2", true},
+		{"openai/gpt-5.2", true}, // 别名与上游模型名等价
+		{"gemini-3-pro-preview", false},
+	}
+	for _, tt := range tests {
+		if got := k.allowsModel(tt.model, g.convertModel); got != tt.want {
+			t.Errorf("allowsModel(%q) = %v, 期望 %v", tt.model, got, tt.want)
+		}
+	}
+
+	var none *APIKey
+	if !none.allowsModel("anything", g.convertModel) {
+		t.Error("未启用鉴权时应允许所有模型")
+	}
+	if !(&APIKey{AllowedModels: []string{"*"}}).allowsModel("x", g.convertModel) {
+		t.Error("* 应允许所有模型")
+	}
+}
+
+func TestAllowsEndpoint(t *testing.T) {
+	k := &APIKey{AllowedEndpoints: []string{"/v1/messages/"}}
+	if !k.allowsEndpoint("/v1/messages") {
+		t.Error("末尾斜杠应忽略")
+	}
+	if k.allowsEndpoint("/v1/chat/completions") {
+		t.Error("不在白名单的端点应拒绝")
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// ============================================================================
+// 日志工具
+// ============================================================================
+
+// 日志格式
+const (
+	logFormatText = "text" // 单行文本，附加字段以 key=value 追加在末尾
+	logFormatJSON = "json" // 每行一个 JSON 对象
+)
+
+var logLevelNames = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// Logger 基于 log/slog 的日志输出，级别可在运行时通过管理接口修改
+type Logger struct {
+	requestCount uint64
+	level        slog.LevelVar
+	handler      slog.Handler
+}
+
+var logger = newLogger(os.Stderr, logFormatText)
+
+func newLogger(w io.Writer, format string) *Logger {
+	l := &Logger{}
+	l.level.Set(slog.LevelInfo)
+	l.handler = newLogHandler(w, format, &l.level)
+	return l
+}
+
+func newLogHandler(w io.Writer, format string, level slog.Leveler) slog.Handler {
+	if format == logFormatJSON {
+		return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})
+	}
+	return &textHandler{w: w, mu: &sync.Mutex{}, level: level}
+}
+
+// SetFormat 设置日志格式（text / json），须在启动时调用
+func (l *Logger) SetFormat(format string) error {
+	switch format {
+	case logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("未知日志格式: %s", format)
+	}
+	l.handler = newLogHandler(os.Stderr, format, &l.level)
+	return nil
+}
+
+func (l *Logger) nextRequestID() string {
+	id := atomic.AddUint64(&l.requestCount, 1)
+	return fmt.Sprintf("REQ-%06d", id)
+}
+
+// SetLevel 按名称设置日志级别
+func (l *Logger) SetLevel(name string) error {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("未知日志级别: %s", name)
+	}
+	l.level.Set(level)
+	return nil
+}
+
+func (l *Logger) LevelName() string {
+	level := l.level.Level()
+	for name, v := range logLevelNames {
+		if v == level {
+			return name
+		}
+	}
+	return "info"
+}
+
+// logf 输出格式化日志。以 "%s | " 开头、首个参数为请求 ID 的日志，请求 ID 作为 req_id 字段单独输出
+func (l *Logger) logf(level slog.Level, format string, args []interface{}) {
+	ctx := context.Background()
+	if !l.handler.Enabled(ctx, level) {
+		return
+	}
+	var attrs []slog.Attr
+	if rest, ok := strings.CutPrefix(format, "%s | "); ok && len(args) > 0 {
+		if id, ok := args[0].(string); ok {
+			format, args = rest, args[1:]
+			attrs = append(attrs, slog.String("req_id", id))
+		}
+	}
+	record := slog.NewRecord(time.Now(), level, fmt.Sprintf(format, args...), 0)
+	record.AddAttrs(attrs...)
+	l.handler.Handle(ctx, record)
+}
+
+// event 输出带结构化字段的日志
+func (l *Logger) event(level slog.Level, msg string, attrs ...slog.Attr) {
+	ctx := context.Background()
+	if !l.handler.Enabled(ctx, level) {
+		return
+	}
+	record := slog.NewRecord(time.Now(), level, msg, 0)
+	record.AddAttrs(attrs...)
+	l.handler.Handle(ctx, record)
+}
+
+func logDebug(format string, args ...interface{}) {
+	logger.logf(slog.LevelDebug, format, args)
+}
+
+func logInfo(format string, args ...interface{}) {
+	logger.logf(slog.LevelInfo, format, args)
+}
+
+func logWarn(format string, args ...interface{}) {
+	logger.logf(slog.LevelWarn, format, args)
+}
+
+func logError(format string, args ...interface{}) {
+	logger.logf(slog.LevelError, format, args)
+}
+
+// ---------------------------------------------------------------------------
+// 文本格式
+// ---------------------------------------------------------------------------
+
+// textHandler 保持原有的日志样式：2006/01/02 15:04:05 [INFO] REQ-000001 | 消息 key=value
+type textHandler struct {
+	w     io.Writer
+	mu    *sync.Mutex
+	level slog.Leveler
+	attrs []slog.Attr
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	b.WriteString(r.Time.Format("2006/01/02 15:04:05"))
+	b.WriteString(" [")
+	b.WriteString(r.Level.String())
+	b.WriteString("] ")
+
+	var fields []slog.Attr
+	reqID := ""
+	collect := func(a slog.Attr) bool {
+		if a.Key == "req_id" && reqID == "" {
+			reqID = a.Value.String()
+		} else {
+			fields = append(fields, a)
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		collect(a)
+	}
+	r.Attrs(collect)
+
+	if reqID != "" {
+		b.WriteString(reqID)
+		b.WriteString(" | ")
+	}
+	b.WriteString(r.Message)
+	for _, a := range fields {
+		b.WriteByte(' ')
+		b.WriteString(a.Key)
+		b.WriteByte('=')
+		b.WriteString(textValue(a.Value))
+	}
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(b.Bytes())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &clone
+}
+
+func (h *textHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// textValue 字段值含空白、引号或为空时加引号
+func textValue(v slog.Value) string {
+	s := v.Resolve().String()
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") || !utf8.ValidString(s) {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// ---------------------------------------------------------------------------
+// 请求 ID
+// ---------------------------------------------------------------------------
+
+// maxRequestIDLength 客户端传入的请求 ID 最大长度
+const maxRequestIDLength = 128
+
+// requestID 优先使用客户端 X-Request-ID，不合法时生成新的 ID
+func requestID(r *http.Request) string {
+	if id := strings.TrimSpace(r.Header.Get("X-Request-ID")); validRequestID(id) {
+		return id
+	}
+	return logger.nextRequestID()
+}
+
+// validRequestID 只接受可打印 ASCII 且不含空白，避免日志注入
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// logRequestDone 请求结束时输出一条汇总日志，字段固定，供日志系统按请求检索
+func logRequestDone(rec UsageRecord, traceID string) {
+	level := slog.LevelInfo
+	if rec.Status >= 500 {
+		level = slog.LevelWarn
+	}
+	attrs := []slog.Attr{
+		slog.String("req_id", rec.RequestID),
+		slog.String("endpoint", rec.Endpoint),
+		slog.String("model", rec.Model),
+		slog.String("key", rec.Key),
+		slog.Int("status", rec.Status),
+		slog.Int64("duration_ms", rec.LatencyMs),
+		slog.Bool("stream", rec.Stream),
+		slog.Int("input_tokens", rec.InputTokens),
+		slog.Int("output_tokens", rec.OutputTokens),
+	}
+	if rec.ErrorClass != "" {
+		attrs = append(attrs, slog.String("error_class", rec.ErrorClass))
+	}
+	if traceID != "" {
+		attrs = append(attrs, slog.String("trace_id", traceID))
+	}
+	if rec.Cached {
+		attrs = append(attrs, slog.Bool("cached", true))
+	}
+	if rec.Coalesced {
+		attrs = append(attrs, slog.Bool("coalesced", true))
+	}
+	logger.event(level, "请求结束", attrs...)
+}
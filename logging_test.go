@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs 把全局日志换成写入缓冲区的 logger，测试结束后恢复
+func captureLogs(t *testing.T, format string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	old := logger
+	logger = newLogger(&buf, format)
+	t.Cleanup(func() { logger = old })
+	return &buf
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		reused bool
+	}{
+		{"沿用客户端 ID", "client-7f3a_01.2", true},
+		{"去掉首尾空白", "  trace-42  ", true},
+		{"最大长度", strings.Repeat("a", maxRequestIDLength), true},
+		{"缺少", "", false},
+		{"超长", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"含换行", "id\nfake log line", false},
+		{"含控制字符", "id\x1b[31m", false},
+		{"含空格", "two words", false},
+		{"含引号", `id"x`, false},
+		{"含反斜杠", `id\x`, false},
+		{"非 ASCII", "请求-1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Request-ID", tt.header)
+			}
+			w := httptest.NewRecorder()
+			rc := newRequestContext(w, r)
+
+			if tt.reused && rc.ID != strings.TrimSpace(tt.header) {
+				t.Fatalf("应沿用客户端的 ID, 得到 %q", rc.ID)
+			}
+			if !tt.reused && (!strings.HasPrefix(rc.ID, "REQ-") || rc.ID == tt.header) {
+				t.Fatalf("应生成新的 ID, 得到 %q", rc.ID)
+			}
+			if got := w.Header().Get("X-Request-ID"); got != rc.ID {
+				t.Fatalf("响应头 X-Request-ID = %q, 期望 %q", got, rc.ID)
+			}
+		})
+	}
+}
+
+// 请求结束的 JSON 日志带有 req_id、status 和 duration_ms，且与响应头中的 ID 一致
+func TestRequestDoneJSONLog(t *testing.T) {
+	buf := captureLogs(t, logFormatJSON)
+	g := newTestGateway()
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader("not json"))
+	r.Header.Set("X-Request-ID", "client-req-1")
+	w := httptest.NewRecorder()
+	g.HandleChatCompletion(w, r)
+	if w.Code != http.StatusBadRequest || w.Header().Get("X-Request-ID") != "client-req-1" {
+		t.Fatalf("状态 %d, X-Request-ID %q", w.Code, w.Header().Get("X-Request-ID"))
+	}
+
+	var done map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("日志不是合法 JSON: %v\n%s", err, line)
+		}
+		if entry["req_id"] != "client-req-1" {
+			t.Fatalf("请求日志缺少 req_id: %s", line)
+		}
+		if entry["msg"] == "请求结束" {
+			done = entry
+		}
+	}
+	if done == nil {
+		t.Fatalf("缺少请求结束日志:\n%s", buf.String())
+	}
+	if done["status"] != float64(http.StatusBadRequest) || done["endpoint"] != "/v1/chat/completions" || done["error_class"] != errClassBadRequest {
+		t.Fatalf("请求结束日志字段不符: %v", done)
+	}
+	if ms, ok := done["duration_ms"].(float64); !ok || ms < 0 {
+		t.Fatalf("duration_ms 不符: %v", done["duration_ms"])
+	}
+}
+
+func TestLogFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{logFormatText, []string{"[WARN] REQ-000042 | 上游返回 502 | 模型: gpt-5.2\n"}},
+		{logFormatJSON, []string{`"level":"WARN"`, `"msg":"上游返回 502 | 模型: gpt-5.2"`, `"req_id":"REQ-000042"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			buf := captureLogs(t, tt.format)
+			logDebug("%s | 低于日志级别", "REQ-000041")
+			logWarn("%s | 上游返回 %d | 模型: %s", "REQ-000042", 502, "gpt-5.2")
+			out := buf.String()
+			if strings.Count(out, "\n") != 1 {
+				t.Fatalf("应只输出一行:\n%s", out)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Fatalf("缺少 %s:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
@@ -3,24 +3,26 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"math/big"
 	"mime/multipart"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
-	"golang.org/x/net/proxy"
 )
 
 // ============================================================================
@@ -35,6 +37,9 @@ const (
 	FirefoxAcceptEncoding = "gzip, deflate, br, zstd"
 )
 
+// shutdownTimeout 退出时等待处理中请求结束的最长时间
+const shutdownTimeout = 30 * time.Second
+
 var ModelMapping = map[string]string{
 	"gpt-5.2":              "openai/gpt-5.2",
 	"claude-opus-4.5":      "anthropic/claude-opus-4.5",
@@ -42,40 +47,6 @@ var ModelMapping = map[string]string{
 	"gemini-3-pro-preview": "google/gemini-3-pro-preview",
 }
 
-// ============================================================================
-// 日志工具
-// ============================================================================
-
-type Logger struct {
-	requestCount uint64
-	debugEnabled bool
-}
-
-var logger = &Logger{}
-
-func (l *Logger) nextRequestID() string {
-	id := atomic.AddUint64(&l.requestCount, 1)
-	return fmt.Sprintf("REQ-%06d", id)
-}
-
-func logDebug(format string, args ...interface{}) {
-	if logger.debugEnabled {
-		log.Printf("[DEBUG] "+format, args...)
-	}
-}
-
-func logInfo(format string, args ...interface{}) {
-	log.Printf("[INFO] "+format, args...)
-}
-
-func logWarn(format string, args ...interface{}) {
-	log.Printf("[WARN] "+format, args...)
-}
-
-func logError(format string, args ...interface{}) {
-	log.Printf("[ERROR] "+format, args...)
-}
-
 // ============================================================================
 // 数据结构
 // ============================================================================
@@ -86,18 +57,30 @@ type Account struct {
 	Password     string
 	SessionToken string
 	Client       *http.Client
+	Credential   *UpstreamCredential // 运维提供的凭据，nil 表示自动注册的账户
+	Tenant       string
 	ProxyIndex   int
+	Slot         int
 	CreatedAt    time.Time
 	LastUsedAt   time.Time
 	mu           sync.Mutex
+	loginMu      sync.Mutex // 串行化重新登录
+	loginAt      time.Time  // 最近一次登录的时间，受 loginMu 保护
+	loginErr     error      // 最近一次登录的结果，受 loginMu 保护
+	restored     bool       // 从会话文件恢复，首次使用前需要校验
+	inflight     int        // 处理中的请求数，受 Gateway.sessionMu 保护
 }
 
 type GuestSession struct {
 	Client     *http.Client
+	Tenant     string
 	ProxyIndex int
+	Slot       int
 	CreatedAt  time.Time
 	LastUsedAt time.Time
 	mu         sync.Mutex
+	restored   bool // 从会话文件恢复，首次使用前需要校验
+	inflight   int  // 处理中的请求数，受 Gateway.sessionMu 保护
 }
 
 type ChatRequest struct {
@@ -157,6 +140,86 @@ type SSEEvent struct {
 	Delta string `json:"delta,omitempty"`
 }
 
+// RequestContext 单次请求在处理链路中传递的上下文
+type RequestContext struct {
+	ID        string
+	StartTime time.Time
+	Endpoint  string
+	Model     string
+	Stream    bool
+	Key       *APIKey // 未启用 API Key 时为 nil
+
+	// 以下字段在处理过程中填充，请求结束时写入用量账本
+	InputTokens  int
+	OutputTokens int
+	ErrorClass   string
+	ContentFlags []string // 命中的内容过滤规则，格式为 方向:规则名
+	UpstreamOK   bool     // 收到了上游 200 响应，只有这类请求计费
+	CacheKey     string   // 响应缓存键，为空表示本次响应不写入缓存
+	CacheHit     bool
+	Coalesced    bool          // 共享了相同并发请求的上游响应
+	flight       *flight       // 作为 leader 时的进行中请求，上游响应广播给相同的并发请求
+	FirstToken   time.Duration // 首个输出 token 的耗时，零值表示没有输出
+	span         *Span         // 请求的根 span，nil 表示未追踪
+	audit        *auditEntry   // 审计内容，nil 表示该请求不审计
+}
+
+// 错误分类，用于用量统计
+const (
+	errClassAuth             = "auth"
+	errClassForbidden        = "forbidden"
+	errClassBadRequest       = "bad_request"
+	errClassNoSession        = "no_session"
+	errClassUpstreamNetwork  = "upstream_network"
+	errClassRateLimited      = "rate_limited"
+	errClassUpstreamStatus   = "upstream_status"
+	errClassBudget           = "budget_exceeded"
+	errClassPoolExhausted    = "pool_exhausted"
+	errClassCircuitOpen      = "circuit_open"
+	errClassModelUnavailable = "model_unavailable"
+	errClassPolicy           = "policy"
+	errClassContentFilter    = "content_filter"
+)
+
+// statusWriter 记录写出的状态码，同时保留流式输出能力
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// newRequestContext 创建请求上下文，请求 ID 通过 X-Request-ID 响应头返回给客户端
+func newRequestContext(w http.ResponseWriter, r *http.Request) *RequestContext {
+	rc := &RequestContext{
+		ID:        requestID(r),
+		StartTime: time.Now(),
+		Endpoint:  r.URL.Path,
+		span:      spanFromContext(r.Context()),
+	}
+	w.Header().Set("X-Request-ID", rc.ID)
+	rc.span.setAttr("gateway.request_id", rc.ID)
+	return rc
+}
+
 // ============================================================================
 // 代理管理
 // ============================================================================
@@ -165,6 +228,7 @@ type ProxyManager struct {
 	proxies      []string // 代理地址列表
 	containers   []string // 对应的容器名
 	currentIndex int
+	onRestart    func(proxyURL string) // WARP 重启完成后调用，用于丢弃失效的连接
 	mu           sync.Mutex
 }
 
@@ -201,6 +265,25 @@ func (pm *ProxyManager) GetCurrentProxy() (string, int) {
 	return pm.proxies[pm.currentIndex], pm.currentIndex
 }
 
+// proxyURL 返回代理索引对应的代理地址，-1 表示直连
+func (pm *ProxyManager) proxyURL(index int) (string, bool) {
+	if index == -1 {
+		return "", len(pm.proxies) == 0
+	}
+	if index >= 0 && index < len(pm.proxies) {
+		return pm.proxies[index], true
+	}
+	return "", false
+}
+
+// containerName 返回代理索引对应的容器名
+func (pm *ProxyManager) containerName(index int) string {
+	if index >= 0 && index < len(pm.containers) {
+		return pm.containers[index]
+	}
+	return ""
+}
+
 func (pm *ProxyManager) OnRateLimit() {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
@@ -219,10 +302,10 @@ func (pm *ProxyManager) OnRateLimit() {
 		pm.currentIndex, pm.containers[pm.currentIndex])
 
 	// 异步重启被限流的 WARP 容器刷新 IP
-	go pm.restartWarp(oldContainer)
+	go pm.restartWarp(oldContainer, pm.proxies[oldIndex])
 }
 
-func (pm *ProxyManager) restartWarp(container string) {
+func (pm *ProxyManager) restartWarp(container, proxyURL string) {
 	if container == "" {
 		return
 	}
@@ -235,6 +318,9 @@ func (pm *ProxyManager) restartWarp(container string) {
 	// 等待 WARP 就绪
 	time.Sleep(15 * time.Second)
 	logInfo("WARP 重启完成 | 容器: %s", container)
+	if pm.onRestart != nil {
+		pm.onRestart(proxyURL)
+	}
 }
 
 // ============================================================================
@@ -244,47 +330,110 @@ func (pm *ProxyManager) restartWarp(container string) {
 type Gateway struct {
 	baseURL   string
 	proxyMgr  *ProxyManager
-	accounts  map[int]*Account      // 按代理索引存储注册账户
-	sessions  map[int]*GuestSession // 按代理索引存储游客会话（备用）
+	accounts  map[sessionKey]*Account      // 按租户 + 代理索引存储注册账户
+	sessions  map[sessionKey]*GuestSession // 按租户 + 代理索引存储游客会话（备用）
 	sessionMu sync.RWMutex
-	useAuth   bool // 是否使用注册账户
+	tenants   *TenantPools // 租户会话池配置
+
+	credential    *UpstreamCredential // 全局运维凭据，nil 表示自动注册
+	sessionCookie string              // 上游会话 cookie 名称，为空时按协议推断
+	credHealth    *CredentialHealth   // 运维凭据健康状态，未配置凭据时为 nil
+
+	useAuth bool           // 是否使用注册账户
+	keys    *KeyStore      // 客户端 API Key，nil 表示不鉴权
+	usage   *UsageStore    // 用量账本，nil 表示不记录
+	budgets *BudgetTracker // 价格表与预算，nil 表示不计费
+
+	sessionStore *SessionStore // 会话文件，nil 表示不持久化
+
+	breakers *BreakerSet   // 上游熔断，nil 表示不熔断
+	models   *ModelTracker // 模型可用性，nil 表示不跟踪
+
+	egress       EgressConfig  // 出口代理
+	egressHealth *EgressHealth // 出口连通性
+	upstreamTLS  *tls.Config   // 上游 TLS，nil 表示使用默认配置
+	proxyTLS     *tls.Config   // 与 https 出口代理握手的 TLS，nil 表示使用默认配置
+
+	transportCfg TransportConfig                    // 上游连接池参数
+	transports   map[string]*decompressingTransport // 出口代理地址 -> 共享 transport，空字符串表示出口代理或直连
+	transportMu  sync.Mutex
+
+	contextCfg    ContextConfig    // 上下文窗口
+	contextLimits map[string]int   // 上游模型名 -> 上下文窗口，来自 CONFIG_FILE
+	summaries     *summaryCache    // 上下文摘要缓存
+	prompts       *PromptTemplates // 对话拼接格式
+	policies      *PolicyEngine    // 请求策略，nil 表示全部放行
+	filters       *ContentFilter   // 内容过滤，nil 表示不过滤
+	cache         *ResponseCache   // 响应缓存，nil 表示未启用
+	flights       *FlightGroup     // 进行中的上游请求，nil 表示不合并
+	streams       *StreamStore     // 可续传的流式响应，nil 表示不支持续传
+	metrics       *Metrics         // Prometheus 指标，nil 表示不采集
+	tracer        *Tracer          // 链路追踪，nil 表示不追踪
+	audit         *AuditLog        // 审计日志，nil 表示未启用
+
+	pool      PoolConfig                  // 会话池参数
+	poolStats map[string]*PoolStats       // 租户 -> 会话池计数，受 sessionMu 保护
+	poolFreed chan struct{}               // 会话归还时关闭，用于唤醒排队请求
+	pending   map[sessionKey]*pendingSlot // 正在创建会话的槽位，受 sessionMu 保护
+
+	inflight   map[*RequestContext]struct{} // 处理中的请求，客户端传入的请求 ID 可能重复，按指针登记
+	inflightMu sync.Mutex
 }
 
 func NewGateway(baseURL string, proxyMgr *ProxyManager, useAuth bool) *Gateway {
+	prompts, _ := NewPromptTemplates(nil) // 内置格式
 	return &Gateway{
-		baseURL:  baseURL,
-		proxyMgr: proxyMgr,
-		accounts: make(map[int]*Account),
-		sessions: make(map[int]*GuestSession),
-		useAuth:  useAuth,
+		baseURL:      baseURL,
+		proxyMgr:     proxyMgr,
+		accounts:     make(map[sessionKey]*Account),
+		sessions:     make(map[sessionKey]*GuestSession),
+		tenants:      NewTenantPools(1, nil),
+		poolStats:    make(map[string]*PoolStats),
+		poolFreed:    make(chan struct{}),
+		pending:      make(map[sessionKey]*pendingSlot),
+		egressHealth: &EgressHealth{routes: make(map[int]*EgressStatus)},
+		transports:   make(map[string]*decompressingTransport),
+		summaries:    newSummaryCache(summaryCacheSize),
+		prompts:      prompts,
+		useAuth:      useAuth,
+		inflight:     make(map[*RequestContext]struct{}),
 	}
 }
 
-func (g *Gateway) createHTTPClient(proxyURL string) (*http.Client, error) {
-	jar, _ := cookiejar.New(nil)
-	transport := &http.Transport{}
-
-	if proxyURL != "" {
-		proxyParsed, err := url.Parse(proxyURL)
-		if err != nil {
-			return nil, fmt.Errorf("解析代理失败: %w", err)
+// Close 退出前释放资源
+func (g *Gateway) Close() {
+	g.saveSessions()
+	g.tracer.Close()
+	g.audit.Close()
+	if err := g.cache.Close(); err != nil {
+		logError("响应缓存关闭失败: %v", err)
+	}
+	if g.usage != nil {
+		if err := g.usage.Close(); err != nil {
+			logError("用量账本关闭失败: %v", err)
 		}
+	}
+}
 
-		switch proxyParsed.Scheme {
-		case "http", "https":
-			transport.Proxy = http.ProxyURL(proxyParsed)
-		case "socks5", "socks5h":
-			auth := &proxy.Auth{}
-			if proxyParsed.User != nil {
-				auth.User = proxyParsed.User.Username()
-				auth.Password, _ = proxyParsed.User.Password()
-			}
-			dialer, err := proxy.SOCKS5("tcp", proxyParsed.Host, auth, proxy.Direct)
-			if err != nil {
-				return nil, fmt.Errorf("创建 SOCKS5 失败: %w", err)
-			}
-			transport.Dial = dialer.Dial
-		}
+// trackRequest 登记处理中的请求，返回的函数用于注销
+func (g *Gateway) trackRequest(rc *RequestContext) func() {
+	g.inflightMu.Lock()
+	g.inflight[rc] = struct{}{}
+	g.inflightMu.Unlock()
+
+	return func() {
+		g.inflightMu.Lock()
+		delete(g.inflight, rc)
+		g.inflightMu.Unlock()
+	}
+}
+
+// createHTTPClient 创建会话使用的客户端：cookie 按会话隔离，连接按出口共享
+func (g *Gateway) createHTTPClient(proxyURL string) (*http.Client, error) {
+	jar := newRecordingJar()
+	transport, err := g.transportFor(proxyURL)
+	if err != nil {
+		return nil, err
 	}
 
 	return &http.Client{
@@ -375,82 +524,189 @@ func (g *Gateway) register(client *http.Client) (string, string, error) {
 	return "", "", fmt.Errorf("注册失败，未获取到 session token")
 }
 
-// getOrCreateAccount 获取或创建注册账户
-func (g *Gateway) getOrCreateAccount() (*Account, error) {
+// getOrCreateAccount 从租户会话池取出一个未满载的账户（不存在时创建），用完后需调用 releaseAccount
+func (g *Gateway) getOrCreateAccount(ctx context.Context, tenant string) (*Account, error) {
 	proxyURL, proxyIndex := g.proxyMgr.GetCurrentProxy()
 
 	g.sessionMu.Lock()
 	defer g.sessionMu.Unlock()
 
-	// 查找当前代理的账户
-	if account, exists := g.accounts[proxyIndex]; exists {
+	var key sessionKey
+	for {
+		var err error
+		key, err = g.waitForSlotLocked(ctx, tenant, proxyIndex)
+		if err != nil {
+			return nil, err
+		}
+		// 槽位上的会话正在创建，等创建结束后重新选择
+		if pending, creating := g.pending[key]; creating {
+			if err := g.waitPendingLocked(ctx, pending); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// 查找租户在当前代理的账户
+		account, exists := g.accounts[key]
+		if !exists {
+			break
+		}
+		// 运维凭据的会话 cookie 过期后被 jar 丢弃，需要重新登录
+		if account.Credential != nil && !g.hasSessionCookie(account.Client) {
+			logWarn("会话 cookie 已过期，重新登录 | %s", key)
+			delete(g.accounts, key)
+			break
+		}
+		validate := account.restored
+		account.restored = false
+		account.inflight++
 		account.mu.Lock()
 		account.LastUsedAt = time.Now()
 		account.mu.Unlock()
-		return account, nil
+		if !validate || g.validateRestoredUnlocked(account.Client, false) == nil {
+			return account, nil
+		}
+		logWarn("恢复的账户已失效，重新创建 | %s", key)
+		account.inflight--
+		if g.accounts[key] == account {
+			delete(g.accounts, key)
+		}
+		g.notifyPoolLocked()
 	}
 
-	// 创建新账户
-	containerName := ""
-	if proxyIndex < len(g.proxyMgr.containers) {
-		containerName = g.proxyMgr.containers[proxyIndex]
+	// 占用槽位后在锁外注册或登录，慢的上游不阻塞其他请求获取和归还会话
+	pending := g.reserveSlotLocked(key)
+	g.sessionMu.Unlock()
+	account, err := g.createAccount(key, proxyURL)
+	g.sessionMu.Lock()
+	g.publishSlotLocked(key, pending)
+	if err != nil {
+		return nil, err
 	}
-	logInfo("账户注册中 | 代理: [%d]%s", proxyIndex, containerName)
+
+	account.inflight++
+	g.accounts[key] = account
+	g.poolStatsLocked(tenant).Created++
+	return account, nil
+}
+
+// createAccount 为槽位注册账户（配置了运维凭据时登录），不持有 sessionMu
+func (g *Gateway) createAccount(key sessionKey, proxyURL string) (*Account, error) {
+	containerName := g.proxyMgr.containerName(key.ProxyIndex)
+	logInfo("账户注册中 | %s, 代理: [%d]%s", key, key.ProxyIndex, containerName)
 
 	client, err := g.createHTTPClient(proxyURL)
 	if err != nil {
 		return nil, err
 	}
 
-	email, password, err := g.register(client)
+	var email, password string
+	cred := g.credentialFor(key.Tenant)
+	if cred != nil {
+		email, err = g.login(client, cred)
+		password = cred.Password
+		if err != nil {
+			g.credHealth.fail(err)
+		} else {
+			g.credHealth.ok()
+		}
+	} else {
+		email, password, err = g.register(client)
+	}
 	if err != nil {
-		logError("账户注册失败 | 代理: [%d], 错误: %v", proxyIndex, err)
+		logError("账户注册失败 | 代理: [%d], 错误: %v", key.ProxyIndex, err)
 		if strings.Contains(err.Error(), "限流") {
 			g.proxyMgr.OnRateLimit()
 		}
 		return nil, err
 	}
 
-	account := &Account{
+	logInfo("账户创建成功 | %s, 代理: [%d]%s, 邮箱: %s", key, key.ProxyIndex, containerName, email)
+	return &Account{
 		Email:      email,
 		Password:   password,
 		Client:     client,
-		ProxyIndex: proxyIndex,
+		Credential: cred,
+		Tenant:     key.Tenant,
+		ProxyIndex: key.ProxyIndex,
+		Slot:       key.Slot,
 		CreatedAt:  time.Now(),
 		LastUsedAt: time.Now(),
-	}
-
-	g.accounts[proxyIndex] = account
-	logInfo("账户创建成功 | 代理: [%d]%s, 邮箱: %s", proxyIndex, containerName, email)
-	return account, nil
+		loginAt:    time.Now(),
+	}, nil
 }
 
-func (g *Gateway) clearAccount(proxyIndex int) {
+func (g *Gateway) clearAccount(key sessionKey) {
 	g.sessionMu.Lock()
 	defer g.sessionMu.Unlock()
-	delete(g.accounts, proxyIndex)
+	delete(g.accounts, key)
+	g.notifyPoolLocked()
 }
 
-func (g *Gateway) getOrCreateSession() (*GuestSession, error) {
+// getOrCreateSession 从租户会话池取出一个未满载的游客会话（不存在时创建），用完后需调用 releaseSession
+func (g *Gateway) getOrCreateSession(ctx context.Context, tenant string) (*GuestSession, error) {
 	proxyURL, proxyIndex := g.proxyMgr.GetCurrentProxy()
 
 	g.sessionMu.Lock()
 	defer g.sessionMu.Unlock()
 
-	// 查找当前代理的会话
-	if session, exists := g.sessions[proxyIndex]; exists {
+	var key sessionKey
+	for {
+		var err error
+		key, err = g.waitForSlotLocked(ctx, tenant, proxyIndex)
+		if err != nil {
+			return nil, err
+		}
+		// 槽位上的会话正在创建，等创建结束后重新选择
+		if pending, creating := g.pending[key]; creating {
+			if err := g.waitPendingLocked(ctx, pending); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// 查找租户在当前代理的会话
+		session, exists := g.sessions[key]
+		if !exists {
+			break
+		}
+		validate := session.restored
+		session.restored = false
+		session.inflight++
 		session.mu.Lock()
 		session.LastUsedAt = time.Now()
 		session.mu.Unlock()
-		return session, nil
+		if !validate || g.validateRestoredUnlocked(session.Client, true) == nil {
+			return session, nil
+		}
+		logWarn("恢复的会话已失效，重新创建 | %s", key)
+		session.inflight--
+		if g.sessions[key] == session {
+			delete(g.sessions, key)
+		}
+		g.notifyPoolLocked()
 	}
 
-	// 创建新会话
-	containerName := ""
-	if proxyIndex >= 0 && proxyIndex < len(g.proxyMgr.containers) {
-		containerName = g.proxyMgr.containers[proxyIndex]
+	// 占用槽位后在锁外创建
+	pending := g.reserveSlotLocked(key)
+	g.sessionMu.Unlock()
+	session, err := g.createGuestSession(key, proxyURL)
+	g.sessionMu.Lock()
+	g.publishSlotLocked(key, pending)
+	if err != nil {
+		return nil, err
 	}
-	logInfo("会话创建中 | 代理: [%d]%s", proxyIndex, containerName)
+
+	session.inflight++
+	g.sessions[key] = session
+	g.poolStatsLocked(tenant).Created++
+	return session, nil
+}
+
+// createGuestSession 为槽位创建游客会话，不持有 sessionMu
+func (g *Gateway) createGuestSession(key sessionKey, proxyURL string) (*GuestSession, error) {
+	containerName := g.proxyMgr.containerName(key.ProxyIndex)
+	logInfo("会话创建中 | %s, 代理: [%d]%s", key, key.ProxyIndex, containerName)
 	client, err := g.createHTTPClient(proxyURL)
 	if err != nil {
 		return nil, err
@@ -461,7 +717,7 @@ func (g *Gateway) getOrCreateSession() (*GuestSession, error) {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		logError("会话创建失败 | 代理: [%d], 错误: %v", proxyIndex, err)
+		logError("会话创建失败 | 代理: [%d], 错误: %v", key.ProxyIndex, err)
 		return nil, fmt.Errorf("获取会话失败: %w", err)
 	}
 	resp.Body.Close()
@@ -471,45 +727,96 @@ func (g *Gateway) getOrCreateSession() (*GuestSession, error) {
 		return nil, fmt.Errorf("触发限流")
 	}
 
-	session := &GuestSession{
+	logInfo("会话创建成功 | %s, 代理: [%d]%s", key, key.ProxyIndex, containerName)
+	return &GuestSession{
 		Client:     client,
-		ProxyIndex: proxyIndex,
+		Tenant:     key.Tenant,
+		ProxyIndex: key.ProxyIndex,
+		Slot:       key.Slot,
 		CreatedAt:  time.Now(),
 		LastUsedAt: time.Now(),
-	}
+	}, nil
+}
 
-	g.sessions[proxyIndex] = session
-	logInfo("会话创建成功 | 代理: [%d]%s", proxyIndex, containerName)
-	return session, nil
+// onUpstreamStatus 处理 /api/chat 的非 200 响应（429 除外）：
+// 4xx 说明会话本身可能失效，丢弃后重建；5xx 交给熔断器统计，不再切换代理
+func (g *Gateway) onUpstreamStatus(key sessionKey, status int) {
+	if status >= 400 && status < 500 {
+		g.clearSession(key)
+		g.clearAccount(key)
+	}
 }
 
-func (g *Gateway) clearSession(proxyIndex int) {
+func (g *Gateway) clearSession(key sessionKey) {
 	g.sessionMu.Lock()
 	defer g.sessionMu.Unlock()
-	delete(g.sessions, proxyIndex)
+	delete(g.sessions, key)
+	g.notifyPoolLocked()
 }
 
 func (g *Gateway) HandleChatCompletion(w http.ResponseWriter, r *http.Request) {
-	reqID := logger.nextRequestID()
-	startTime := time.Now()
+	rc := newRequestContext(w, r)
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	defer g.finishRequest(rc, sw)
 
+	if !g.authenticate(w, r, rc, protocolOpenAI) {
+		return
+	}
+
+	// 断线重连：补发 Last-Event-ID 之后的事件
+	if g.resumeFromHeader(w, r, rc, protocolOpenAI) {
+		return
+	}
+	g.auditRequest(r, rc)
+
+	parse := rc.startSpan("request.parse")
 	var openAIReq OpenAIRequest
-	if err := json.NewDecoder(r.Body).Decode(&openAIReq); err != nil {
-		logError("%s | 请求解析失败: %v", reqID, err)
+	err := json.NewDecoder(r.Body).Decode(&openAIReq)
+	parse.end(err)
+	if err != nil {
+		logError("%s | 请求解析失败: %v", rc.ID, err)
+		rc.ErrorClass = errClassBadRequest
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
 	if len(openAIReq.Messages) == 0 {
-		logError("%s | 消息为空", reqID)
+		logError("%s | 消息为空", rc.ID)
+		rc.ErrorClass = errClassBadRequest
 		http.Error(w, "No messages found", http.StatusBadRequest)
 		return
 	}
 
-	// 检测无意义请求
-	if g.isMeaninglessRequest(openAIReq.Messages) {
-		logInfo("%s | 无意义请求，直接返回 BAKA!", reqID)
-		g.respondBAKA(w, openAIReq.Stream)
+	rc.Model = openAIReq.Model
+	rc.Stream = openAIReq.Stream
+	defer g.trackRequest(rc)()
+
+	if !g.checkModelAllowed(w, rc, openAIReq.Model, protocolOpenAI) {
+		return
+	}
+	if !g.checkBudget(w, rc, protocolOpenAI) {
+		return
+	}
+	if !g.checkModelAvailable(w, rc, openAIReq.Model, protocolOpenAI) {
+		return
+	}
+
+	// 请求策略
+	if !g.applyPolicy(w, rc, &openAIReq, protocolOpenAI) {
+		return
+	}
+
+	// 输入内容过滤
+	if !g.filterInput(w, rc, &openAIReq, protocolOpenAI) {
+		return
+	}
+
+	// 强制系统提示词
+	openAIReq.Messages = rc.Key.applySystemPrompt(openAIReq.Messages, g.extractContent)
+
+	// 按模型上下文窗口裁剪
+	if !g.applyContextWindow(w, r, rc, &openAIReq, protocolOpenAI) {
 		return
 	}
 
@@ -519,7 +826,7 @@ func (g *Gateway) HandleChatCompletion(w http.ResponseWriter, r *http.Request) {
 	if openAIReq.Stream {
 		streamMode = "流式"
 	}
-	logInfo("%s | 请求开始 | 模型: %s, 消息数: %d, 模式: %s", reqID, openAIReq.Model, msgCount, streamMode)
+	logInfo("%s | 请求开始 | 模型: %s, 消息数: %d, 模式: %s", rc.ID, openAIReq.Model, msgCount, streamMode)
 
 	// 详细记录每条消息的角色和长度
 	for i, msg := range openAIReq.Messages {
@@ -527,12 +834,13 @@ func (g *Gateway) HandleChatCompletion(w http.ResponseWriter, r *http.Request) {
 		if str, ok := msg.Content.(string); ok {
 			contentLen = len(str)
 		}
-		logDebug("%s | 消息[%d] role=%s, len=%d", reqID, i, msg.Role, contentLen)
+		logDebug("%s | 消息[%d] role=%s, len=%d", rc.ID, i, msg.Role, contentLen)
 	}
 
 	// 构建最终消息：拼接所有历史
-	finalMessage := g.buildConversationMessage(openAIReq.Messages)
-	logDebug("%s | 消息长度: %d 字符", reqID, len(finalMessage))
+	finalMessage := g.buildConversationMessage(openAIReq.Model, openAIReq.Messages)
+	rc.InputTokens = estimateTokens(finalMessage)
+	logDebug("%s | 消息长度: %d 字符", rc.ID, len(finalMessage))
 
 	chatModel := g.convertModel(openAIReq.Model)
 	chatReq := ChatRequest{
@@ -546,139 +854,266 @@ func (g *Gateway) HandleChatCompletion(w http.ResponseWriter, r *http.Request) {
 		SelectedVisibilityType: "private",
 	}
 
+	// 响应缓存
+	if g.serveCached(w, r, rc, openAIReq, protocolOpenAI) {
+		return
+	}
+
+	// 合并相同的并发请求
+	if g.joinFlight(w, r, rc, openAIReq, protocolOpenAI) {
+		return
+	}
+	defer g.flights.land(rc, nil)
+
 	// 根据模式选择账户或游客会话
 	if g.useAuth {
-		g.handleWithAccount(w, r, openAIReq, chatReq, reqID, startTime)
+		g.handleWithAccount(w, r, openAIReq, chatReq, rc)
 	} else {
-		g.handleWithSession(w, r, openAIReq, chatReq, reqID, startTime)
+		g.handleWithSession(w, r, openAIReq, chatReq, rc)
 	}
 }
 
 // handleWithAccount 使用注册账户处理请求
-func (g *Gateway) handleWithAccount(w http.ResponseWriter, r *http.Request, openAIReq OpenAIRequest, chatReq ChatRequest, reqID string, startTime time.Time) {
+func (g *Gateway) handleWithAccount(w http.ResponseWriter, r *http.Request, openAIReq OpenAIRequest, chatReq ChatRequest, rc *RequestContext) {
 	var account *Account
 	var err error
+	acquire := rc.startSpan("session.acquire")
 	for retry := 0; retry < 3; retry++ {
-		account, err = g.getOrCreateAccount()
-		if err == nil {
+		account, err = g.getOrCreateAccount(r.Context(), rc.Key.tenant())
+		if err == nil || err == errPoolExhausted || r.Context().Err() != nil {
 			break
 		}
-		logWarn("%s | 获取账户失败 (重试 %d/3): %v", reqID, retry+1, err)
+		logWarn("%s | 获取账户失败 (重试 %d/3): %v", rc.ID, retry+1, err)
 		time.Sleep(time.Second)
 	}
+	if account != nil {
+		acquire.setAttr("gateway.proxy_index", account.ProxyIndex)
+	}
+	acquire.end(err)
 
+	if err == errPoolExhausted {
+		logWarn("%s | 会话池已满，排队超时", rc.ID)
+		rc.ErrorClass = errClassPoolExhausted
+		http.Error(w, "Session pool exhausted", http.StatusServiceUnavailable)
+		return
+	}
 	if account == nil {
-		logError("%s | 服务不可用，所有重试失败", reqID)
+		logError("%s | 服务不可用，所有重试失败", rc.ID)
+		rc.ErrorClass = errClassNoSession
 		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
 		return
 	}
+	defer g.releaseAccount(account)
+
+	// 熔断按实际使用的代理判断
+	releaseTrial, ok := g.checkBreaker(w, rc, account.ProxyIndex, protocolOpenAI)
+	if !ok {
+		return
+	}
+	defer releaseTrial()
 
 	containerName := ""
 	if account.ProxyIndex >= 0 && account.ProxyIndex < len(g.proxyMgr.containers) {
 		containerName = g.proxyMgr.containers[account.ProxyIndex]
 	}
-	logInfo("%s | 转发请求 | 代理: [%d]%s, 账户: %s, 目标模型: %s",
-		reqID, account.ProxyIndex, containerName, account.Email, chatReq.SelectedChatModel)
+	logInfo("%s | 转发请求 | 租户: %s, 代理: [%d]%s, 账户: %s, 目标模型: %s",
+		rc.ID, account.Tenant, account.ProxyIndex, containerName, account.Email, chatReq.SelectedChatModel)
 
 	if openAIReq.Stream {
-		g.handleStreamWithClient(w, account.Client, account.ProxyIndex, chatReq, reqID, startTime)
+		g.handleStreamWithClient(w, account.Client, account.sessionKey(), chatReq, rc)
 	} else {
-		g.handleNonStreamWithClient(w, account.Client, account.ProxyIndex, chatReq, reqID, startTime)
+		g.handleNonStreamWithClient(w, account.Client, account.sessionKey(), chatReq, rc)
 	}
 }
 
 // handleWithSession 使用游客会话处理请求
-func (g *Gateway) handleWithSession(w http.ResponseWriter, r *http.Request, openAIReq OpenAIRequest, chatReq ChatRequest, reqID string, startTime time.Time) {
+func (g *Gateway) handleWithSession(w http.ResponseWriter, r *http.Request, openAIReq OpenAIRequest, chatReq ChatRequest, rc *RequestContext) {
 	var session *GuestSession
 	var err error
+	acquire := rc.startSpan("session.acquire")
 	for retry := 0; retry < 3; retry++ {
-		session, err = g.getOrCreateSession()
-		if err == nil {
+		session, err = g.getOrCreateSession(r.Context(), rc.Key.tenant())
+		if err == nil || err == errPoolExhausted || r.Context().Err() != nil {
 			break
 		}
-		logWarn("%s | 获取会话失败 (重试 %d/3): %v", reqID, retry+1, err)
+		logWarn("%s | 获取会话失败 (重试 %d/3): %v", rc.ID, retry+1, err)
 		time.Sleep(time.Second)
 	}
+	if session != nil {
+		acquire.setAttr("gateway.proxy_index", session.ProxyIndex)
+	}
+	acquire.end(err)
 
+	if err == errPoolExhausted {
+		logWarn("%s | 会话池已满，排队超时", rc.ID)
+		rc.ErrorClass = errClassPoolExhausted
+		http.Error(w, "Session pool exhausted", http.StatusServiceUnavailable)
+		return
+	}
 	if session == nil {
-		logError("%s | 服务不可用，所有重试失败", reqID)
+		logError("%s | 服务不可用，所有重试失败", rc.ID)
+		rc.ErrorClass = errClassNoSession
 		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
 		return
 	}
+	defer g.releaseSession(session)
+
+	// 熔断按实际使用的代理判断
+	releaseTrial, ok := g.checkBreaker(w, rc, session.ProxyIndex, protocolOpenAI)
+	if !ok {
+		return
+	}
+	defer releaseTrial()
 
 	containerName := ""
 	if session.ProxyIndex >= 0 && session.ProxyIndex < len(g.proxyMgr.containers) {
 		containerName = g.proxyMgr.containers[session.ProxyIndex]
 	}
-	logInfo("%s | 转发请求 | 代理: [%d]%s, 目标模型: %s",
-		reqID, session.ProxyIndex, containerName, chatReq.SelectedChatModel)
+	logInfo("%s | 转发请求 | 租户: %s, 代理: [%d]%s, 目标模型: %s",
+		rc.ID, session.Tenant, session.ProxyIndex, containerName, chatReq.SelectedChatModel)
 
 	if openAIReq.Stream {
-		g.handleStreamWithClient(w, session.Client, session.ProxyIndex, chatReq, reqID, startTime)
+		g.handleStreamWithClient(w, session.Client, session.sessionKey(), chatReq, rc)
 	} else {
-		g.handleNonStreamWithClient(w, session.Client, session.ProxyIndex, chatReq, reqID, startTime)
+		g.handleNonStreamWithClient(w, session.Client, session.sessionKey(), chatReq, rc)
+	}
+}
+
+// postChat 发送 /api/chat 请求；使用运维凭据的账户返回 401 时重新登录并重试一次
+func (g *Gateway) postChat(client *http.Client, sk sessionKey, chatReq ChatRequest, rc *RequestContext) (*http.Response, error) {
+	reqBody, _ := json.Marshal(chatReq)
+	rc.audit.setUpstream(chatReq)
+	// 记录请求字段（不含内容）
+	logDebug("%s | 上游请求 | id=%s, model=%s, msgId=%s, textLen=%d",
+		rc.ID, chatReq.ID, chatReq.SelectedChatModel, chatReq.Message.ID, len(chatReq.Message.Parts[0].Text))
+
+	send := func() (*http.Response, error) {
+		req, _ := http.NewRequest("POST", g.baseURL+"/api/chat", bytes.NewReader(reqBody))
+		setFirefoxHeaders(req, FirefoxAcceptJSON)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Origin", g.baseURL)
+		req.Header.Set("Referer", g.baseURL+"/")
+		return client.Do(req)
+	}
+
+	// span 在收到响应头时结束，耗时即首字节时间
+	span := rc.span.child("upstream.chat", spanKindClient)
+	span.setAttr("gen_ai.request.model", chatReq.SelectedChatModel)
+	span.setAttr("gateway.proxy_index", sk.ProxyIndex)
+	start := time.Now()
+	resp, err := send()
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && g.reauthenticate(sk, start) {
+		resp.Body.Close()
+		logWarn("%s | 上游会话已失效，重新登录后重试", rc.ID)
+		span.addEvent("reauthenticated")
+		start = time.Now()
+		resp, err = send()
+	}
+	if err != nil {
+		g.recordUpstream(sk.ProxyIndex, 0, 0, err)
+		g.metrics.observeUpstream(sk.ProxyIndex, 0, 0, err)
+		g.recordModel(chatReq.SelectedChatModel, 0, err)
+		span.end(err)
+		return nil, err
+	}
+	latency := time.Since(start)
+	g.recordUpstream(sk.ProxyIndex, resp.StatusCode, latency, nil)
+	g.metrics.observeUpstream(sk.ProxyIndex, resp.StatusCode, latency, nil)
+	span.setAttr("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		span.setError(fmt.Sprintf("状态 %d", resp.StatusCode))
+	}
+	span.end(nil)
+	g.recordModel(chatReq.SelectedChatModel, resp.StatusCode, nil)
+	if resp.StatusCode == http.StatusOK {
+		rc.UpstreamOK = true
 	}
+	return resp, nil
 }
 
-func (g *Gateway) handleStreamWithClient(w http.ResponseWriter, client *http.Client, proxyIndex int, chatReq ChatRequest, reqID string, startTime time.Time) {
+func (g *Gateway) handleStreamWithClient(w http.ResponseWriter, client *http.Client, sk sessionKey, chatReq ChatRequest, rc *RequestContext) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		logError("%s | 流式响应不支持", reqID)
+		logError("%s | 流式响应不支持", rc.ID)
 		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
 		return
 	}
 
-	reqBody, _ := json.Marshal(chatReq)
-	// 记录请求字段（不含内容）
-	logDebug("%s | 上游请求 | id=%s, model=%s, msgId=%s, textLen=%d",
-		reqID, chatReq.ID, chatReq.SelectedChatModel, chatReq.Message.ID, len(chatReq.Message.Parts[0].Text))
-
-	req, _ := http.NewRequest("POST", g.baseURL+"/api/chat", bytes.NewReader(reqBody))
-	setFirefoxHeaders(req, FirefoxAcceptJSON)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Origin", g.baseURL)
-	req.Header.Set("Referer", g.baseURL+"/")
-
-	resp, err := client.Do(req)
+	resp, err := g.postChat(client, sk, chatReq, rc)
 	if err != nil {
-		logError("%s | 上游请求失败: %v", reqID, err)
+		logError("%s | 上游请求失败: %v", rc.ID, err)
+		rc.ErrorClass = errClassUpstreamNetwork
+		writeAPIError(w, protocolOpenAI, http.StatusBadGateway, "upstream_error", "Upstream request failed")
 		return
 	}
 	defer resp.Body.Close()
 
-	logDebug("%s | 上游响应状态: %d", reqID, resp.StatusCode)
+	logDebug("%s | 上游响应状态: %d", rc.ID, resp.StatusCode)
 
 	// 非200时记录错误码
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := bufio.NewReader(resp.Body).Peek(512)
-		logError("%s | 上游错误 [%d]: %s", reqID, resp.StatusCode, string(bodyBytes))
+		logError("%s | 上游错误 [%d]: %s", rc.ID, resp.StatusCode, string(bodyBytes))
 	}
 
 	if resp.StatusCode == http.StatusTooManyRequests {
-		logWarn("%s | 上游返回 429 限流", reqID)
+		logWarn("%s | 上游返回 429 限流", rc.ID)
+		rc.ErrorClass = errClassRateLimited
 		g.proxyMgr.OnRateLimit()
-		g.clearSession(proxyIndex)
-		g.clearAccount(proxyIndex)
+		g.clearSession(sk)
+		g.clearAccount(sk)
 		http.Error(w, "Rate limited", http.StatusTooManyRequests)
 		return
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		logError("%s | 上游响应异常: %d，切换代理", reqID, resp.StatusCode)
-		g.proxyMgr.OnRateLimit()
-		g.clearSession(proxyIndex)
-		g.clearAccount(proxyIndex)
+		logError("%s | 上游响应异常: %d", rc.ID, resp.StatusCode)
+		g.onUpstreamStatus(sk, resp.StatusCode)
+		rc.ErrorClass = errClassUpstreamStatus
 		http.Error(w, "Upstream error", resp.StatusCode)
 		return
 	}
 
-	scanner := bufio.NewScanner(resp.Body)
+	body := g.cache.recorder(rc, chatReq.SelectedChatModel, rc.flight.tee(resp.Body))
+	g.relayOpenAIStream(w, flusher, body, chatReq.SelectedChatModel, rc)
+	g.flights.land(rc, body)
+	body.commit()
+}
+
+// relayOpenAIStream 将上游 SSE 转为 OpenAI 流式响应，上游响应和缓存回放共用
+func (g *Gateway) relayOpenAIStream(w http.ResponseWriter, flusher http.Flusher, body io.Reader, model string, rc *RequestContext) {
+	span := rc.startSpan("response.encode")
+	defer span.end(nil)
+	scanner := bufio.NewScanner(body)
 	chatID := uuid.New().String()
 	var tokenCount int
+	limiter := &outputLimiter{limit: rc.Key.maxOutputTokens()}
+	filter := g.newOutputFilter(rc)
+	events := g.newEventStream(w, flusher, rc, protocolOpenAI, model)
+	defer events.close()
+
+	emit := func(delta string) {
+		if delta == "" {
+			return
+		}
+		tokenCount++
+		rc.audit.output(delta)
+		chunk := map[string]interface{}{
+			"id":      chatID,
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   model,
+			"choices": []map[string]interface{}{
+				{"index": 0, "delta": map[string]string{"content": delta}},
+			},
+		}
+		chunkData, _ := json.Marshal(chunk)
+		events.send("", chunkData)
+	}
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -698,77 +1133,98 @@ func (g *Gateway) handleStreamWithClient(w http.ResponseWriter, client *http.Cli
 		}
 
 		if event.Type == "text-delta" && event.Delta != "" {
-			tokenCount++
-			chunk := map[string]interface{}{
-				"id":      chatID,
-				"object":  "chat.completion.chunk",
-				"created": time.Now().Unix(),
-				"model":   chatReq.SelectedChatModel,
-				"choices": []map[string]interface{}{
-					{"index": 0, "delta": map[string]string{"content": event.Delta}},
-				},
+			rc.markFirstToken()
+			emit(limiter.take(filter.push(event.Delta)))
+			if limiter.exhausted || filter.isBlocked() {
+				break
 			}
-			chunkData, _ := json.Marshal(chunk)
-			fmt.Fprintf(w, "data: %s\n\n", chunkData)
-			flusher.Flush()
 		}
 	}
+	// 过滤器缓冲区中剩余的内容
+	if !limiter.exhausted {
+		emit(limiter.take(filter.flush()))
+	}
 
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	flusher.Flush()
-
-	duration := time.Since(startTime)
-	logInfo("%s | 请求完成 | 耗时: %v, 输出块数: %d", reqID, duration.Round(time.Millisecond), tokenCount)
-}
+	finishReason := ""
+	switch {
+	case filter.isBlocked():
+		logInfo("%s | 输出被内容过滤拦截，停止生成", rc.ID)
+		finishReason = "content_filter"
+	case limiter.exhausted:
+		logInfo("%s | 输出达到 Key 上限 %d，截断", rc.ID, limiter.limit)
+		finishReason = "length"
+	}
+	if finishReason != "" {
+		chunk := map[string]interface{}{
+			"id":      chatID,
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   model,
+			"choices": []map[string]interface{}{
+				{"index": 0, "delta": map[string]string{}, "finish_reason": finishReason},
+			},
+		}
+		chunkData, _ := json.Marshal(chunk)
+		events.send("", chunkData)
+	}
 
-func (g *Gateway) handleNonStreamWithClient(w http.ResponseWriter, client *http.Client, proxyIndex int, chatReq ChatRequest, reqID string, startTime time.Time) {
-	reqBody, _ := json.Marshal(chatReq)
-	// 记录请求字段（不含内容）
-	logDebug("%s | 上游请求 | id=%s, model=%s, msgId=%s, textLen=%d",
-		reqID, chatReq.ID, chatReq.SelectedChatModel, chatReq.Message.ID, len(chatReq.Message.Parts[0].Text))
+	events.send("", []byte("[DONE]"))
 
-	req, _ := http.NewRequest("POST", g.baseURL+"/api/chat", bytes.NewReader(reqBody))
-	setFirefoxHeaders(req, FirefoxAcceptJSON)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Origin", g.baseURL)
-	req.Header.Set("Referer", g.baseURL+"/")
+	rc.OutputTokens = limiter.used()
+	duration := time.Since(rc.StartTime)
+	logInfo("%s | 请求完成 | 耗时: %v, 输出块数: %d", rc.ID, duration.Round(time.Millisecond), tokenCount)
+}
 
-	resp, err := client.Do(req)
+func (g *Gateway) handleNonStreamWithClient(w http.ResponseWriter, client *http.Client, sk sessionKey, chatReq ChatRequest, rc *RequestContext) {
+	resp, err := g.postChat(client, sk, chatReq, rc)
 	if err != nil {
-		logError("%s | 上游请求失败: %v", reqID, err)
+		logError("%s | 上游请求失败: %v", rc.ID, err)
+		rc.ErrorClass = errClassUpstreamNetwork
 		http.Error(w, "Request failed", http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
 
-	logDebug("%s | 上游响应状态: %d", reqID, resp.StatusCode)
+	logDebug("%s | 上游响应状态: %d", rc.ID, resp.StatusCode)
 
 	// 非200时记录错误码
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := bufio.NewReader(resp.Body).Peek(512)
-		logError("%s | 上游错误 [%d]: %s", reqID, resp.StatusCode, string(bodyBytes))
+		logError("%s | 上游错误 [%d]: %s", rc.ID, resp.StatusCode, string(bodyBytes))
 	}
 
 	if resp.StatusCode == http.StatusTooManyRequests {
-		logWarn("%s | 上游返回 429 限流", reqID)
+		logWarn("%s | 上游返回 429 限流", rc.ID)
+		rc.ErrorClass = errClassRateLimited
 		g.proxyMgr.OnRateLimit()
-		g.clearSession(proxyIndex)
-		g.clearAccount(proxyIndex)
+		g.clearSession(sk)
+		g.clearAccount(sk)
 		http.Error(w, "Rate limited", http.StatusTooManyRequests)
 		return
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		logError("%s | 上游响应异常: %d，切换代理", reqID, resp.StatusCode)
-		g.proxyMgr.OnRateLimit()
-		g.clearSession(proxyIndex)
-		g.clearAccount(proxyIndex)
+		logError("%s | 上游响应异常: %d", rc.ID, resp.StatusCode)
+		g.onUpstreamStatus(sk, resp.StatusCode)
+		rc.ErrorClass = errClassUpstreamStatus
 		http.Error(w, "Upstream error", resp.StatusCode)
 		return
 	}
 
+	body := g.cache.recorder(rc, chatReq.SelectedChatModel, rc.flight.tee(resp.Body))
+	g.relayOpenAI(w, body, chatReq.SelectedChatModel, rc)
+	g.flights.land(rc, body)
+	body.commit()
+}
+
+// relayOpenAI 读取上游 SSE 并返回 OpenAI 非流式响应，上游响应和缓存回放共用
+func (g *Gateway) relayOpenAI(w http.ResponseWriter, body io.Reader, model string, rc *RequestContext) {
+	span := rc.startSpan("response.encode")
+	defer span.end(nil)
 	var fullContent strings.Builder
-	scanner := bufio.NewScanner(resp.Body)
+	scanner := bufio.NewScanner(body)
+	limiter := &outputLimiter{limit: rc.Key.maxOutputTokens()}
+	filter := g.newOutputFilter(rc)
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -787,20 +1243,40 @@ func (g *Gateway) handleNonStreamWithClient(w http.ResponseWriter, client *http.
 		}
 
 		if event.Type == "text-delta" && event.Delta != "" {
-			fullContent.WriteString(event.Delta)
+			rc.markFirstToken()
+			fullContent.WriteString(limiter.take(filter.push(event.Delta)))
+			if limiter.exhausted || filter.isBlocked() {
+				break
+			}
 		}
 	}
+	if !limiter.exhausted {
+		fullContent.WriteString(limiter.take(filter.flush()))
+	}
+	if filter.isBlocked() {
+		// 非流式响应还没有发出任何内容，拦截时整段丢弃
+		fullContent.Reset()
+	}
+	rc.audit.output(fullContent.String())
+
+	finishReason := "stop"
+	switch {
+	case filter.isBlocked():
+		finishReason = "content_filter"
+	case limiter.exhausted:
+		finishReason = "length"
+	}
 
 	openAIResp := map[string]interface{}{
 		"id":      uuid.New().String(),
 		"object":  "chat.completion",
 		"created": time.Now().Unix(),
-		"model":   chatReq.SelectedChatModel,
+		"model":   model,
 		"choices": []map[string]interface{}{
 			{
 				"index":         0,
 				"message":       map[string]string{"role": "assistant", "content": fullContent.String()},
-				"finish_reason": "stop",
+				"finish_reason": finishReason,
 			},
 		},
 	}
@@ -808,8 +1284,9 @@ func (g *Gateway) handleNonStreamWithClient(w http.ResponseWriter, client *http.
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(openAIResp)
 
-	duration := time.Since(startTime)
-	logInfo("%s | 请求完成 | 耗时: %v, 响应长度: %d", reqID, duration.Round(time.Millisecond), fullContent.Len())
+	rc.OutputTokens = limiter.used()
+	duration := time.Since(rc.StartTime)
+	logInfo("%s | 请求完成 | 耗时: %v, 响应长度: %d", rc.ID, duration.Round(time.Millisecond), fullContent.Len())
 }
 
 func (g *Gateway) convertModel(model string) string {
@@ -819,45 +1296,8 @@ func (g *Gateway) convertModel(model string) string {
 	return model
 }
 
-// isMeaninglessRequest 检测无意义请求
-// 条件：无历史消息（只有1条user消息），长度<10，且包含测试关键词
-func (g *Gateway) isMeaninglessRequest(messages []OpenAIMessage) bool {
-	// 统计非 system 消息数量
-	var userMsgCount int
-	var firstUserMsg string
-	for _, msg := range messages {
-		if msg.Role == "user" || msg.Role == "assistant" {
-			userMsgCount++
-			if msg.Role == "user" && firstUserMsg == "" {
-				firstUserMsg = g.extractContent(msg.Content)
-			}
-		}
-	}
-
-	// 有历史消息（多轮对话），直接放行
-	if userMsgCount > 1 {
-		return false
-	}
-
-	// 消息长度 >= 10，直接放行
-	if len(firstUserMsg) >= 10 {
-		return false
-	}
-
-	// 检查是否包含测试关键词
-	lowerMsg := strings.ToLower(firstUserMsg)
-	testKeywords := []string{"hi", "hello", "test", "测试", "你好", "hey", "ping"}
-	for _, keyword := range testKeywords {
-		if strings.Contains(lowerMsg, keyword) {
-			return true
-		}
-	}
-
-	return false
-}
-
-// respondBAKA 返回 BAKA! 响应
-func (g *Gateway) respondBAKA(w http.ResponseWriter, stream bool) {
+// respondCanned 返回策略配置的固定回复
+func (g *Gateway) respondCanned(w http.ResponseWriter, stream bool, model, text string) {
 	if stream {
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
@@ -867,9 +1307,9 @@ func (g *Gateway) respondBAKA(w http.ResponseWriter, stream bool) {
 			"id":      uuid.New().String(),
 			"object":  "chat.completion.chunk",
 			"created": time.Now().Unix(),
-			"model":   "baka",
+			"model":   model,
 			"choices": []map[string]interface{}{
-				{"index": 0, "delta": map[string]string{"content": "BAKA!"}},
+				{"index": 0, "delta": map[string]string{"content": text}},
 			},
 		}
 		chunkData, _ := json.Marshal(chunk)
@@ -884,11 +1324,11 @@ func (g *Gateway) respondBAKA(w http.ResponseWriter, stream bool) {
 			"id":      uuid.New().String(),
 			"object":  "chat.completion",
 			"created": time.Now().Unix(),
-			"model":   "baka",
+			"model":   model,
 			"choices": []map[string]interface{}{
 				{
 					"index":         0,
-					"message":       map[string]string{"role": "assistant", "content": "BAKA!"},
+					"message":       map[string]string{"role": "assistant", "content": text},
 					"finish_reason": "stop",
 				},
 			},
@@ -896,13 +1336,8 @@ func (g *Gateway) respondBAKA(w http.ResponseWriter, stream bool) {
 	}
 }
 
-// buildConversationMessage 将所有消息拼接成一条完整的对话
-func (g *Gateway) buildConversationMessage(messages []OpenAIMessage) string {
-	var parts []string
-
-	// 内置系统提示词（禁用工具）
-	builtinSystemPrompt := "请不要调用任何工具"
-
+// buildConversationMessage 按模型的提示词模板将所有消息拼接成一条完整的对话
+func (g *Gateway) buildConversationMessage(model string, messages []OpenAIMessage) string {
 	// 提取用户透传的系统提示词
 	var userSystemPrompt string
 	for _, msg := range messages {
@@ -912,27 +1347,15 @@ func (g *Gateway) buildConversationMessage(messages []OpenAIMessage) string {
 		}
 	}
 
-	// 构建系统指令块
-	if userSystemPrompt != "" {
-		parts = append(parts, fmt.Sprintf("[System]\n%s\n\n%s", userSystemPrompt, builtinSystemPrompt))
-	} else {
-		parts = append(parts, fmt.Sprintf("[System]\n%s", builtinSystemPrompt))
-	}
-
-	// 拼接对话历史
-	for _, msg := range messages {
-		content := g.extractContent(msg.Content)
-		switch msg.Role {
-		case "system":
-			continue
-		case "user":
-			parts = append(parts, fmt.Sprintf("[User]\n%s", content))
-		case "assistant":
-			parts = append(parts, fmt.Sprintf("[Assistant]\n%s", content))
-		}
+	pt := g.prompts.lookup(model, g.convertModel(model))
+	prompt, err := pt.render(model, userSystemPrompt, messages, g.extractContent)
+	if err != nil {
+		// 模板在启动时已解析，执行失败时退回内置格式
+		logError("提示词模板 %s 渲染失败，使用内置格式: %v", pt.name, err)
+		builtin, _ := PromptTemplateConfig{}.compile("builtin")
+		prompt, _ = builtin.render(model, userSystemPrompt, messages, g.extractContent)
 	}
-
-	return strings.Join(parts, "\n\n")
+	return prompt
 }
 
 // extractContent 提取消息内容（支持字符串和数组格式）
@@ -956,9 +1379,33 @@ func (g *Gateway) extractContent(content interface{}) string {
 	return ""
 }
 
+// HandleHealth GET /health：所有出口都不可用或运维凭据失效时返回 503
+func (g *Gateway) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if !g.egressHealth.healthy() {
+		http.Error(w, "egress unreachable, see /admin/egress", http.StatusServiceUnavailable)
+		return
+	}
+	if g.credHealth != nil {
+		if h := g.credHealth.snapshot(); !h.Healthy {
+			http.Error(w, "upstream credentials invalid: "+h.LastError, http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
 func (g *Gateway) HandleModels(w http.ResponseWriter, r *http.Request) {
+	rc := newRequestContext(w, r)
+	if !g.authenticate(w, r, rc, protocolOpenAI) {
+		return
+	}
+
 	models := make([]map[string]interface{}, 0, len(ModelMapping))
 	for id := range ModelMapping {
+		if !rc.Key.allowsModel(id, g.convertModel) || !g.modelAvailable(id) {
+			continue
+		}
 		models = append(models, map[string]interface{}{
 			"id":       id,
 			"object":   "model",
@@ -972,10 +1419,23 @@ func (g *Gateway) HandleModels(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g *Gateway) HandleAnthropicMessages(w http.ResponseWriter, r *http.Request) {
-	reqID := logger.nextRequestID()
-	startTime := time.Now()
+	rc := newRequestContext(w, r)
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	defer g.finishRequest(rc, sw)
+
+	if !g.authenticate(w, r, rc, protocolAnthropic) {
+		return
+	}
+
+	// 断线重连：补发 Last-Event-ID 之后的事件
+	if g.resumeFromHeader(w, r, rc, protocolAnthropic) {
+		return
+	}
+	g.auditRequest(r, rc)
 
 	// 使用兼容格式解析
+	parse := rc.startSpan("request.parse")
 	var anthropicReqCompat struct {
 		Model    string                   `json:"model"`
 		Messages []AnthropicMessageCompat `json:"messages"`
@@ -983,35 +1443,65 @@ func (g *Gateway) HandleAnthropicMessages(w http.ResponseWriter, r *http.Request
 		MaxTokens int                     `json:"max_tokens,omitempty"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&anthropicReqCompat); err != nil {
-		logError("%s | Anthropic 请求解析失败: %v", reqID, err)
+	err := json.NewDecoder(r.Body).Decode(&anthropicReqCompat)
+	parse.end(err)
+	if err != nil {
+		logError("%s | Anthropic 请求解析失败: %v", rc.ID, err)
+		rc.ErrorClass = errClassBadRequest
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
 	if len(anthropicReqCompat.Messages) == 0 {
-		logError("%s | Anthropic 消息为空", reqID)
+		logError("%s | Anthropic 消息为空", rc.ID)
+		rc.ErrorClass = errClassBadRequest
 		http.Error(w, "No messages found", http.StatusBadRequest)
 		return
 	}
 
+	rc.Model = anthropicReqCompat.Model
+	rc.Stream = anthropicReqCompat.Stream
+	defer g.trackRequest(rc)()
+
 	streamMode := "非流式"
 	if anthropicReqCompat.Stream {
 		streamMode = "流式"
 	}
-	logInfo("%s | Anthropic 请求开始 | 模型: %s, 消息数: %d, 模式: %s", reqID, anthropicReqCompat.Model, len(anthropicReqCompat.Messages), streamMode)
+	logInfo("%s | Anthropic 请求开始 | 模型: %s, 消息数: %d, 模式: %s", rc.ID, anthropicReqCompat.Model, len(anthropicReqCompat.Messages), streamMode)
+
+	if !g.checkModelAllowed(w, rc, anthropicReqCompat.Model, protocolAnthropic) {
+		return
+	}
+	if !g.checkBudget(w, rc, protocolAnthropic) {
+		return
+	}
+	if !g.checkModelAvailable(w, rc, anthropicReqCompat.Model, protocolAnthropic) {
+		return
+	}
 
 	// 转换为 OpenAI 格式处理
 	openAIReq := g.anthropicCompatToOpenAI(anthropicReqCompat)
 
-	// 检测无意义请求
-	if g.isMeaninglessRequest(openAIReq.Messages) {
-		logInfo("%s | 无意义请求，直接返回 BAKA!", reqID)
-		g.respondAnthropicBAKA(w, anthropicReqCompat.Stream)
+	// 请求策略
+	if !g.applyPolicy(w, rc, &openAIReq, protocolAnthropic) {
+		return
+	}
+
+	// 输入内容过滤
+	if !g.filterInput(w, rc, &openAIReq, protocolAnthropic) {
 		return
 	}
 
-	finalMessage := g.buildConversationMessage(openAIReq.Messages)
+	// 强制系统提示词
+	openAIReq.Messages = rc.Key.applySystemPrompt(openAIReq.Messages, g.extractContent)
+
+	// 按模型上下文窗口裁剪
+	if !g.applyContextWindow(w, r, rc, &openAIReq, protocolAnthropic) {
+		return
+	}
+
+	finalMessage := g.buildConversationMessage(openAIReq.Model, openAIReq.Messages)
+	rc.InputTokens = estimateTokens(finalMessage)
 	chatModel := g.convertModel(openAIReq.Model)
 
 	chatReq := ChatRequest{
@@ -1025,123 +1515,199 @@ func (g *Gateway) HandleAnthropicMessages(w http.ResponseWriter, r *http.Request
 		SelectedVisibilityType: "private",
 	}
 
+	// 响应缓存
+	if g.serveCached(w, r, rc, openAIReq, protocolAnthropic) {
+		return
+	}
+
+	// 合并相同的并发请求
+	if g.joinFlight(w, r, rc, openAIReq, protocolAnthropic) {
+		return
+	}
+	defer g.flights.land(rc, nil)
+
 	if g.useAuth {
-		g.handleWithAccountAnthropic(w, r, openAIReq, chatReq, reqID, startTime)
+		g.handleWithAccountAnthropic(w, r, openAIReq, chatReq, rc)
 	} else {
-		g.handleWithSessionAnthropic(w, r, openAIReq, chatReq, reqID, startTime)
+		g.handleWithSessionAnthropic(w, r, openAIReq, chatReq, rc)
 	}
 }
 
-func (g *Gateway) handleWithAccountAnthropic(w http.ResponseWriter, r *http.Request, openAIReq OpenAIRequest, chatReq ChatRequest, reqID string, startTime time.Time) {
+func (g *Gateway) handleWithAccountAnthropic(w http.ResponseWriter, r *http.Request, openAIReq OpenAIRequest, chatReq ChatRequest, rc *RequestContext) {
 	var account *Account
 	var err error
+	acquire := rc.startSpan("session.acquire")
 	for retry := 0; retry < 3; retry++ {
-		account, err = g.getOrCreateAccount()
-		if err == nil {
+		account, err = g.getOrCreateAccount(r.Context(), rc.Key.tenant())
+		if err == nil || err == errPoolExhausted || r.Context().Err() != nil {
 			break
 		}
-		logWarn("%s | 获取账户失败 (重试 %d/3): %v", reqID, retry+1, err)
+		logWarn("%s | 获取账户失败 (重试 %d/3): %v", rc.ID, retry+1, err)
 		time.Sleep(time.Second)
 	}
+	if account != nil {
+		acquire.setAttr("gateway.proxy_index", account.ProxyIndex)
+	}
+	acquire.end(err)
 
+	if err == errPoolExhausted {
+		logWarn("%s | 会话池已满，排队超时", rc.ID)
+		rc.ErrorClass = errClassPoolExhausted
+		http.Error(w, "Session pool exhausted", http.StatusServiceUnavailable)
+		return
+	}
 	if account == nil {
-		logError("%s | 服务不可用，所有重试失败", reqID)
+		logError("%s | 服务不可用，所有重试失败", rc.ID)
+		rc.ErrorClass = errClassNoSession
 		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
 		return
 	}
+	defer g.releaseAccount(account)
+
+	// 熔断按实际使用的代理判断
+	releaseTrial, ok := g.checkBreaker(w, rc, account.ProxyIndex, protocolAnthropic)
+	if !ok {
+		return
+	}
+	defer releaseTrial()
 
 	containerName := ""
 	if account.ProxyIndex >= 0 && account.ProxyIndex < len(g.proxyMgr.containers) {
 		containerName = g.proxyMgr.containers[account.ProxyIndex]
 	}
-	logInfo("%s | 转发请求 | 代理: [%d]%s, 账户: %s, 目标模型: %s",
-		reqID, account.ProxyIndex, containerName, account.Email, chatReq.SelectedChatModel)
+	logInfo("%s | 转发请求 | 租户: %s, 代理: [%d]%s, 账户: %s, 目标模型: %s",
+		rc.ID, account.Tenant, account.ProxyIndex, containerName, account.Email, chatReq.SelectedChatModel)
 
 	if openAIReq.Stream {
-		g.handleStreamAnthropic(w, account.Client, account.ProxyIndex, chatReq, reqID, startTime)
+		g.handleStreamAnthropic(w, account.Client, account.sessionKey(), chatReq, rc)
 	} else {
-		g.handleNonStreamAnthropic(w, account.Client, account.ProxyIndex, chatReq, reqID, startTime)
+		g.handleNonStreamAnthropic(w, account.Client, account.sessionKey(), chatReq, rc)
 	}
 }
 
-func (g *Gateway) handleWithSessionAnthropic(w http.ResponseWriter, r *http.Request, openAIReq OpenAIRequest, chatReq ChatRequest, reqID string, startTime time.Time) {
+func (g *Gateway) handleWithSessionAnthropic(w http.ResponseWriter, r *http.Request, openAIReq OpenAIRequest, chatReq ChatRequest, rc *RequestContext) {
 	var session *GuestSession
 	var err error
+	acquire := rc.startSpan("session.acquire")
 	for retry := 0; retry < 3; retry++ {
-		session, err = g.getOrCreateSession()
-		if err == nil {
+		session, err = g.getOrCreateSession(r.Context(), rc.Key.tenant())
+		if err == nil || err == errPoolExhausted || r.Context().Err() != nil {
 			break
 		}
-		logWarn("%s | 获取会话失败 (重试 %d/3): %v", reqID, retry+1, err)
+		logWarn("%s | 获取会话失败 (重试 %d/3): %v", rc.ID, retry+1, err)
 		time.Sleep(time.Second)
 	}
+	if session != nil {
+		acquire.setAttr("gateway.proxy_index", session.ProxyIndex)
+	}
+	acquire.end(err)
 
+	if err == errPoolExhausted {
+		logWarn("%s | 会话池已满，排队超时", rc.ID)
+		rc.ErrorClass = errClassPoolExhausted
+		http.Error(w, "Session pool exhausted", http.StatusServiceUnavailable)
+		return
+	}
 	if session == nil {
-		logError("%s | 服务不可用，所有重试失败", reqID)
+		logError("%s | 服务不可用，所有重试失败", rc.ID)
+		rc.ErrorClass = errClassNoSession
 		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
 		return
 	}
+	defer g.releaseSession(session)
+
+	// 熔断按实际使用的代理判断
+	releaseTrial, ok := g.checkBreaker(w, rc, session.ProxyIndex, protocolAnthropic)
+	if !ok {
+		return
+	}
+	defer releaseTrial()
 
 	containerName := ""
 	if session.ProxyIndex >= 0 && session.ProxyIndex < len(g.proxyMgr.containers) {
 		containerName = g.proxyMgr.containers[session.ProxyIndex]
 	}
-	logInfo("%s | 转发请求 | 代理: [%d]%s, 目标模型: %s",
-		reqID, session.ProxyIndex, containerName, chatReq.SelectedChatModel)
+	logInfo("%s | 转发请求 | 租户: %s, 代理: [%d]%s, 目标模型: %s",
+		rc.ID, session.Tenant, session.ProxyIndex, containerName, chatReq.SelectedChatModel)
 
 	if openAIReq.Stream {
-		g.handleStreamAnthropic(w, session.Client, session.ProxyIndex, chatReq, reqID, startTime)
+		g.handleStreamAnthropic(w, session.Client, session.sessionKey(), chatReq, rc)
 	} else {
-		g.handleNonStreamAnthropic(w, session.Client, session.ProxyIndex, chatReq, reqID, startTime)
+		g.handleNonStreamAnthropic(w, session.Client, session.sessionKey(), chatReq, rc)
 	}
 }
 
-func (g *Gateway) handleStreamAnthropic(w http.ResponseWriter, client *http.Client, proxyIndex int, chatReq ChatRequest, reqID string, startTime time.Time) {
+func (g *Gateway) handleStreamAnthropic(w http.ResponseWriter, client *http.Client, sk sessionKey, chatReq ChatRequest, rc *RequestContext) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		logError("%s | 流式响应不支持", reqID)
+		logError("%s | 流式响应不支持", rc.ID)
 		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
 		return
 	}
 
-	reqBody, _ := json.Marshal(chatReq)
-	req, _ := http.NewRequest("POST", g.baseURL+"/api/chat", bytes.NewReader(reqBody))
-	setFirefoxHeaders(req, FirefoxAcceptJSON)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Origin", g.baseURL)
-	req.Header.Set("Referer", g.baseURL+"/")
-
-	resp, err := client.Do(req)
+	resp, err := g.postChat(client, sk, chatReq, rc)
 	if err != nil {
-		logError("%s | 上游请求失败: %v", reqID, err)
+		logError("%s | 上游请求失败: %v", rc.ID, err)
+		rc.ErrorClass = errClassUpstreamNetwork
+		writeAPIError(w, protocolAnthropic, http.StatusBadGateway, "upstream_error", "Upstream request failed")
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusTooManyRequests {
-		logWarn("%s | 上游返回 429 限流", reqID)
+		logWarn("%s | 上游返回 429 限流", rc.ID)
+		rc.ErrorClass = errClassRateLimited
 		g.proxyMgr.OnRateLimit()
-		g.clearSession(proxyIndex)
-		g.clearAccount(proxyIndex)
+		g.clearSession(sk)
+		g.clearAccount(sk)
 		http.Error(w, "Rate limited", http.StatusTooManyRequests)
 		return
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		logError("%s | 上游响应异常: %d", reqID, resp.StatusCode)
-		g.proxyMgr.OnRateLimit()
-		g.clearSession(proxyIndex)
-		g.clearAccount(proxyIndex)
+		logError("%s | 上游响应异常: %d", rc.ID, resp.StatusCode)
+		g.onUpstreamStatus(sk, resp.StatusCode)
+		rc.ErrorClass = errClassUpstreamStatus
 		http.Error(w, "Upstream error", resp.StatusCode)
 		return
 	}
 
-	scanner := bufio.NewScanner(resp.Body)
+	body := g.cache.recorder(rc, chatReq.SelectedChatModel, rc.flight.tee(resp.Body))
+	g.relayAnthropicStream(w, flusher, body, chatReq.SelectedChatModel, rc)
+	g.flights.land(rc, body)
+	body.commit()
+}
+
+// relayAnthropicStream 将上游 SSE 转为 Anthropic 流式响应，上游响应和缓存回放共用
+func (g *Gateway) relayAnthropicStream(w http.ResponseWriter, flusher http.Flusher, body io.Reader, model string, rc *RequestContext) {
+	span := rc.startSpan("response.encode")
+	defer span.end(nil)
+	scanner := bufio.NewScanner(body)
 	var tokenCount int
+	limiter := &outputLimiter{limit: rc.Key.maxOutputTokens()}
+	filter := g.newOutputFilter(rc)
+	events := g.newEventStream(w, flusher, rc, protocolAnthropic, model)
+	defer events.close()
+
+	emit := func(delta string) {
+		if delta == "" {
+			return
+		}
+		tokenCount++
+		rc.audit.output(delta)
+		// Anthropic 格式
+		chunk := map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": map[string]string{"type": "text_delta", "text": delta},
+		}
+		chunkData, _ := json.Marshal(chunk)
+		events.send("content_block_delta", chunkData)
+	}
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -1160,64 +1726,86 @@ func (g *Gateway) handleStreamAnthropic(w http.ResponseWriter, client *http.Clie
 		}
 
 		if event.Type == "text-delta" && event.Delta != "" {
-			tokenCount++
-			// Anthropic 格式
-			chunk := map[string]interface{}{
-				"type":  "content_block_delta",
-				"index": 0,
-				"delta": map[string]string{"type": "text_delta", "text": event.Delta},
+			rc.markFirstToken()
+			emit(limiter.take(filter.push(event.Delta)))
+			if limiter.exhausted || filter.isBlocked() {
+				break
 			}
-			chunkData, _ := json.Marshal(chunk)
-			fmt.Fprintf(w, "event: content_block_delta\n")
-			fmt.Fprintf(w, "data: %s\n\n", chunkData)
-			flusher.Flush()
 		}
 	}
+	// 过滤器缓冲区中剩余的内容
+	if !limiter.exhausted {
+		emit(limiter.take(filter.flush()))
+	}
+
+	stopReason := ""
+	switch {
+	case filter.isBlocked():
+		logInfo("%s | 输出被内容过滤拦截，停止生成", rc.ID)
+		stopReason = "refusal"
+	case limiter.exhausted:
+		logInfo("%s | 输出达到 Key 上限 %d，截断", rc.ID, limiter.limit)
+		stopReason = "max_tokens"
+	}
+	if stopReason != "" {
+		chunk := map[string]interface{}{
+			"type":  "message_delta",
+			"delta": map[string]interface{}{"stop_reason": stopReason, "stop_sequence": nil},
+			"usage": map[string]int{"output_tokens": limiter.used()},
+		}
+		chunkData, _ := json.Marshal(chunk)
+		events.send("message_delta", chunkData)
+	}
 
-	fmt.Fprintf(w, "event: message_stop\n")
-	fmt.Fprintf(w, "data: {\"type\":\"message_stop\"}\n\n")
-	flusher.Flush()
+	events.send("message_stop", []byte(`{"type":"message_stop"}`))
 
-	duration := time.Since(startTime)
-	logInfo("%s | Anthropic 请求完成 | 耗时: %v, 输出块数: %d", reqID, duration.Round(time.Millisecond), tokenCount)
+	rc.OutputTokens = limiter.used()
+	duration := time.Since(rc.StartTime)
+	logInfo("%s | Anthropic 请求完成 | 耗时: %v, 输出块数: %d", rc.ID, duration.Round(time.Millisecond), tokenCount)
 }
 
-func (g *Gateway) handleNonStreamAnthropic(w http.ResponseWriter, client *http.Client, proxyIndex int, chatReq ChatRequest, reqID string, startTime time.Time) {
-	reqBody, _ := json.Marshal(chatReq)
-	req, _ := http.NewRequest("POST", g.baseURL+"/api/chat", bytes.NewReader(reqBody))
-	setFirefoxHeaders(req, FirefoxAcceptJSON)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Origin", g.baseURL)
-	req.Header.Set("Referer", g.baseURL+"/")
-
-	resp, err := client.Do(req)
+func (g *Gateway) handleNonStreamAnthropic(w http.ResponseWriter, client *http.Client, sk sessionKey, chatReq ChatRequest, rc *RequestContext) {
+	resp, err := g.postChat(client, sk, chatReq, rc)
 	if err != nil {
-		logError("%s | 上游请求失败: %v", reqID, err)
+		logError("%s | 上游请求失败: %v", rc.ID, err)
+		rc.ErrorClass = errClassUpstreamNetwork
 		http.Error(w, "Request failed", http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusTooManyRequests {
-		logWarn("%s | 上游返回 429 限流", reqID)
+		logWarn("%s | 上游返回 429 限流", rc.ID)
+		rc.ErrorClass = errClassRateLimited
 		g.proxyMgr.OnRateLimit()
-		g.clearSession(proxyIndex)
-		g.clearAccount(proxyIndex)
+		g.clearSession(sk)
+		g.clearAccount(sk)
 		http.Error(w, "Rate limited", http.StatusTooManyRequests)
 		return
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		logError("%s | 上游响应异常: %d", reqID, resp.StatusCode)
-		g.proxyMgr.OnRateLimit()
-		g.clearSession(proxyIndex)
-		g.clearAccount(proxyIndex)
+		logError("%s | 上游响应异常: %d", rc.ID, resp.StatusCode)
+		g.onUpstreamStatus(sk, resp.StatusCode)
+		rc.ErrorClass = errClassUpstreamStatus
 		http.Error(w, "Upstream error", resp.StatusCode)
 		return
 	}
 
+	body := g.cache.recorder(rc, chatReq.SelectedChatModel, rc.flight.tee(resp.Body))
+	g.relayAnthropic(w, body, chatReq.SelectedChatModel, rc)
+	g.flights.land(rc, body)
+	body.commit()
+}
+
+// relayAnthropic 读取上游 SSE 并返回 Anthropic 非流式响应，上游响应和缓存回放共用
+func (g *Gateway) relayAnthropic(w http.ResponseWriter, body io.Reader, model string, rc *RequestContext) {
+	span := rc.startSpan("response.encode")
+	defer span.end(nil)
 	var fullContent strings.Builder
-	scanner := bufio.NewScanner(resp.Body)
+	scanner := bufio.NewScanner(body)
+	limiter := &outputLimiter{limit: rc.Key.maxOutputTokens()}
+	filter := g.newOutputFilter(rc)
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -1236,9 +1824,29 @@ func (g *Gateway) handleNonStreamAnthropic(w http.ResponseWriter, client *http.C
 		}
 
 		if event.Type == "text-delta" && event.Delta != "" {
-			fullContent.WriteString(event.Delta)
+			rc.markFirstToken()
+			fullContent.WriteString(limiter.take(filter.push(event.Delta)))
+			if limiter.exhausted || filter.isBlocked() {
+				break
+			}
 		}
 	}
+	if !limiter.exhausted {
+		fullContent.WriteString(limiter.take(filter.flush()))
+	}
+	if filter.isBlocked() {
+		// 非流式响应还没有发出任何内容，拦截时整段丢弃
+		fullContent.Reset()
+	}
+	rc.audit.output(fullContent.String())
+
+	stopReason := "end_turn"
+	switch {
+	case filter.isBlocked():
+		stopReason = "refusal"
+	case limiter.exhausted:
+		stopReason = "max_tokens"
+	}
 
 	anthropicResp := map[string]interface{}{
 		"id":      "msg_" + uuid.New().String(),
@@ -1247,20 +1855,21 @@ func (g *Gateway) handleNonStreamAnthropic(w http.ResponseWriter, client *http.C
 		"content": []map[string]interface{}{
 			{"type": "text", "text": fullContent.String()},
 		},
-		"model":             chatReq.SelectedChatModel,
-		"stop_reason":       "end_turn",
+		"model":             model,
+		"stop_reason":       stopReason,
 		"stop_sequence":     nil,
 		"usage": map[string]interface{}{
-			"input_tokens":  0,
-			"output_tokens": len(fullContent.String()),
+			"input_tokens":  rc.InputTokens,
+			"output_tokens": limiter.used(),
 		},
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(anthropicResp)
 
-	duration := time.Since(startTime)
-	logInfo("%s | Anthropic 请求完成 | 耗时: %v, 响应长度: %d", reqID, duration.Round(time.Millisecond), fullContent.Len())
+	rc.OutputTokens = limiter.used()
+	duration := time.Since(rc.StartTime)
+	logInfo("%s | Anthropic 请求完成 | 耗时: %v, 响应长度: %d", rc.ID, duration.Round(time.Millisecond), fullContent.Len())
 }
 
 func (g *Gateway) anthropicCompatToOpenAI(req struct {
@@ -1299,7 +1908,8 @@ func (g *Gateway) anthropicCompatToOpenAI(req struct {
 	}
 }
 
-func (g *Gateway) respondAnthropicBAKA(w http.ResponseWriter, stream bool) {
+// respondAnthropicCanned 以 Anthropic 格式返回策略配置的固定回复
+func (g *Gateway) respondAnthropicCanned(w http.ResponseWriter, stream bool, model, text string) {
 	if stream {
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
@@ -1308,7 +1918,7 @@ func (g *Gateway) respondAnthropicBAKA(w http.ResponseWriter, stream bool) {
 		chunk := map[string]interface{}{
 			"type":  "content_block_delta",
 			"index": 0,
-			"delta": map[string]string{"type": "text_delta", "text": "BAKA!"},
+			"delta": map[string]string{"type": "text_delta", "text": text},
 		}
 		chunkData, _ := json.Marshal(chunk)
 		fmt.Fprintf(w, "event: content_block_delta\n")
@@ -1324,12 +1934,12 @@ func (g *Gateway) respondAnthropicBAKA(w http.ResponseWriter, stream bool) {
 			"id":      "msg_" + uuid.New().String(),
 			"type":    "message",
 			"role":    "assistant",
-			"content": []map[string]interface{}{{"type": "text", "text": "BAKA!"}},
-			"model":   "claude-3-opus-20240229",
+			"content": []map[string]interface{}{{"type": "text", "text": text}},
+			"model":   model,
 			"stop_reason": "end_turn",
 			"usage": map[string]interface{}{
 				"input_tokens":  0,
-				"output_tokens": 5,
+				"output_tokens": estimateTokens(text),
 			},
 		})
 	}
@@ -1346,49 +1956,357 @@ func setFirefoxHeaders(req *http.Request, acceptType string) {
 	req.Header.Set("Sec-Fetch-Site", "same-origin")
 }
 
+// apiProtocol 客户端使用的接口协议，决定错误响应格式
+type apiProtocol int
+
+const (
+	protocolOpenAI apiProtocol = iota
+	protocolAnthropic
+)
+
+// writeAPIError 按协议格式写出错误响应
+func writeAPIError(w http.ResponseWriter, protocol apiProtocol, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if protocol == protocolAnthropic {
+		errType := "invalid_request_error"
+		switch status {
+		case http.StatusUnauthorized:
+			errType = "authentication_error"
+		case http.StatusForbidden:
+			errType = "permission_error"
+		case http.StatusTooManyRequests:
+			errType = "rate_limit_error"
+		case http.StatusServiceUnavailable:
+			errType = "overloaded_error"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":  "error",
+			"error": map[string]string{"type": errType, "message": message},
+		})
+		return
+	}
+
+	errType := "invalid_request_error"
+	switch status {
+	case http.StatusForbidden:
+		errType = "permission_error"
+	case http.StatusTooManyRequests:
+		errType = "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		errType = "server_error"
+	}
+	if code == "insufficient_quota" {
+		errType = code
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errType,
+			"param":   nil,
+			"code":    code,
+		},
+	})
+}
+
+// estimateTokens 粗略估算 token 数：ASCII 约 4 字符 1 token，其他字符 1 字 1 token
+func estimateTokens(text string) int {
+	return (tokenUnits(text) + 3) / 4
+}
+
+// tokenUnits 以 1/4 token 为单位计数
+func tokenUnits(text string) int {
+	units := 0
+	for _, r := range text {
+		if r < 0x80 {
+			units++
+		} else {
+			units += 4
+		}
+	}
+	return units
+}
+
+// outputLimiter 统计输出 token 数，并按上限截断输出（上游不支持 max_tokens）
+type outputLimiter struct {
+	limit     int // 0 表示不限制
+	units     int
+	exhausted bool
+}
+
+// take 返回本次允许输出的部分，达到上限后 exhausted 置为 true
+func (l *outputLimiter) take(delta string) string {
+	if l.limit <= 0 {
+		l.units += tokenUnits(delta)
+		return delta
+	}
+	if l.exhausted {
+		return ""
+	}
+
+	remaining := l.limit*4 - l.units
+	need := tokenUnits(delta)
+	if need <= remaining {
+		l.units += need
+		return delta
+	}
+
+	var b strings.Builder
+	for _, r := range delta {
+		u := 1
+		if r >= 0x80 {
+			u = 4
+		}
+		if u > remaining {
+			break
+		}
+		remaining -= u
+		l.units += u
+		b.WriteRune(r)
+	}
+	l.exhausted = true
+	return b.String()
+}
+
+func (l *outputLimiter) used() int {
+	return (l.units + 3) / 4
+}
+
 // ============================================================================
 // 主程序
 // ============================================================================
 
 func main() {
-	baseURL := getEnv("BASE_URL", "https://demo.chat-sdk.dev")
-	warpProxies := getEnv("WARP_PROXIES", "")
-	warpContainers := getEnv("WARP_CONTAINERS", "")
-	port := getEnv("PORT", "8080")
-	debugMode := getEnv("DEBUG", "false")
-	useAuth := getEnv("USE_AUTH", "false")
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
 
-	logger.debugEnabled = debugMode == "true" || debugMode == "1"
-	useAuthEnabled := useAuth == "true" || useAuth == "1"
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("加载配置失败: %v", err)
+	}
+	if err := logger.SetFormat(cfg.LogFormat); err != nil {
+		log.Fatalf("日志格式配置错误: %v", err)
+	}
+	if err := logger.SetLevel(cfg.LogLevel); err != nil {
+		log.Fatalf("日志级别配置错误: %v", err)
+	}
 
 	logInfo("========================================")
 	logInfo("Chat SDK 2API 网关启动")
 	logInfo("========================================")
-	logInfo("监听端口: %s", port)
-	logInfo("上游地址: %s", baseURL)
-	logInfo("WARP 代理: %s", warpProxies)
-	logInfo("WARP 容器: %s", warpContainers)
-	logInfo("DEBUG 模式: %v", logger.debugEnabled)
-	logInfo("账户模式: %v", useAuthEnabled)
+	logInfo("监听端口: %s", cfg.Port)
+	logInfo("上游地址: %s", cfg.BaseURL)
+	logInfo("WARP 代理: %s", cfg.WarpProxies)
+	logInfo("WARP 容器: %s", cfg.WarpContainers)
+	logInfo("日志级别: %s, 格式: %s", logger.LevelName(), cfg.LogFormat)
+	logInfo("账户模式: %v", cfg.UseAuth)
+	logInfo("API Key 文件: %s", cfg.APIKeysFile)
+	logInfo("管理端口: %s", cfg.AdminPort)
+	logInfo("用量账本: %s", cfg.UsageDB)
+	logInfo("配置文件: %s", cfg.ConfigFile)
+	logInfo("会话文件: %s", cfg.SessionStore)
 	logInfo("========================================")
 
-	proxyMgr := NewProxyManager(warpProxies, warpContainers)
-	gateway := NewGateway(baseURL, proxyMgr, useAuthEnabled)
+	keyStore, err := NewKeyStore(cfg.APIKeysFile, cfg.RequireAPIKey)
+	if err != nil {
+		log.Fatalf("加载 API Key 失败: %v", err)
+	}
+	if keyStore.Enabled() {
+		logInfo("API Key 鉴权已启用 | Key 数量: %d", keyStore.Len())
+		if keyStore.Len() == 0 {
+			logWarn("未配置任何 API Key，所有 /v1/* 请求都将被拒绝")
+		}
+	}
+
+	proxyMgr := NewProxyManager(cfg.WarpProxies, cfg.WarpContainers)
+	gateway := NewGateway(cfg.BaseURL, proxyMgr, cfg.UseAuth)
+	gateway.keys = keyStore
+	gateway.tenants = NewTenantPools(cfg.SessionPool, cfg.Tenants)
+	gateway.egress = cfg.Egress
+	gateway.transportCfg = cfg.Transport
+	gateway.contextCfg = cfg.Context
+	gateway.contextLimits = make(map[string]int, len(cfg.ContextLimits))
+	for model, limit := range cfg.ContextLimits {
+		gateway.contextLimits[gateway.convertModel(model)] = limit
+	}
+	if gateway.prompts, err = NewPromptTemplates(cfg.PromptTemplates); err != nil {
+		log.Fatalf("提示词模板配置错误: %v", err)
+	}
+	if gateway.policies, err = NewPolicyEngine(cfg.Policies, gateway.convertModel); err != nil {
+		log.Fatalf("请求策略配置错误: %v", err)
+	}
+	if len(cfg.Policies) > 0 {
+		logInfo("请求策略已加载 | 规则数: %d", len(cfg.Policies))
+	}
+	if gateway.filters, err = NewContentFilter(cfg.ContentFilters); err != nil {
+		log.Fatalf("内容过滤配置错误: %v", err)
+	}
+	if len(cfg.ContentFilters) > 0 {
+		logInfo("内容过滤已加载 | 规则数: %d", len(cfg.ContentFilters))
+	}
+	proxyMgr.onRestart = gateway.closeIdleConns
+	if gateway.upstreamTLS, err = loadUpstreamTLS(cfg.BaseURL, cfg.UpstreamTLS, cfg.TLS); err != nil {
+		log.Fatalf("上游 TLS 配置错误: %v", err)
+	}
+	if gateway.proxyTLS, err = loadProxyTLS(cfg.BaseURL, cfg.UpstreamTLS, cfg.TLS); err != nil {
+		log.Fatalf("上游 TLS 配置错误: %v", err)
+	}
+	if gateway.egress.ProxyURL != "" && len(proxyMgr.proxies) == 0 {
+		logInfo("出口代理: %s, NO_PROXY: %s", redactProxyList(gateway.egress.ProxyURL), gateway.egress.NoProxy)
+	}
+	go gateway.egressCheckLoop()
+	if cfg.CircuitBreaker {
+		gateway.breakers = NewBreakerSet(cfg.Breaker)
+		go gateway.breakerProbeLoop()
+	}
+	if cfg.ModelHealth {
+		gateway.models = NewModelTracker(cfg.ModelHealthConfig)
+		if cfg.ModelHealthConfig.Recheck {
+			go gateway.modelRecheckLoop()
+		}
+	}
+	gateway.pool = PoolConfig{
+		MaxConcurrency: cfg.SessionMaxConcurrency,
+		QueueTimeout:   cfg.SessionQueueTimeout,
+		IdleTimeout:    cfg.SessionIdleTimeout,
+	}
+	if gateway.pool.IdleTimeout > 0 {
+		go gateway.poolEvictLoop()
+	}
+
+	gateway.credential = cfg.upstreamCredential()
+	gateway.sessionCookie = cfg.UpstreamSessionCookie
+
+	if cfg.SessionStore != "" {
+		store, err := NewSessionStore(cfg.SessionStore, cfg.SessionStoreKey)
+		if err != nil {
+			log.Fatalf("会话文件初始化失败: %v", err)
+		}
+		gateway.sessionStore = store
+		gateway.restoreSessions()
+		go gateway.sessionSaveLoop()
+	}
+
+	if gateway.usesCredentials() {
+		gateway.credHealth = &CredentialHealth{Healthy: true}
+		go gateway.credentialCheckLoop(cfg.CredentialCheckInterval)
+		logInfo("上游运维凭据已启用 | 校验间隔: %v", cfg.CredentialCheckInterval)
+	}
+
+	if cfg.UsageDB != "" {
+		usage, err := OpenUsageStore(cfg.UsageDB)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		gateway.usage = usage
+	}
+
+	if cfg.Streams.Enabled {
+		gateway.streams = NewStreamStore(cfg.Streams)
+	}
+	if cfg.CoalesceRequests {
+		gateway.flights = NewFlightGroup()
+	}
+	if cfg.Metrics {
+		gateway.metrics = NewMetrics()
+	}
+	if cfg.Audit.Dir != "" {
+		audit, err := NewAuditLog(cfg.Audit, cfg.AuditRedactions)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		gateway.audit = audit
+		logInfo("审计日志已启用 | 目录: %s, 加密: %v, 保留: %v", cfg.Audit.Dir, cfg.Audit.Key != "", cfg.Audit.Retention)
+	}
+	if gateway.tracer = NewTracer(cfg.Tracing); gateway.tracer != nil {
+		logInfo("链路追踪已启用 | 导出地址: %s, 采样比例: %g", cfg.Tracing.Endpoint, cfg.Tracing.SampleRatio)
+	}
+	if cfg.Cache.Enabled {
+		cache, err := NewResponseCache(cfg.Cache)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		gateway.cache = cache
+		go cache.sweepLoop()
+		logInfo("响应缓存已启用 | 内存条数: %d, TTL: %v, 磁盘: %s", cfg.Cache.MaxEntries, cfg.Cache.TTL, cfg.Cache.Path)
+	}
+
+	if len(cfg.Prices) > 0 {
+		gateway.budgets = NewBudgetTracker(cfg.Prices, gateway.convertModel, cfg.BudgetWebhook)
+		if gateway.usage != nil {
+			if err := gateway.budgets.LoadFromLedger(gateway.usage, gateway.keys); err != nil {
+				logError("从用量账本恢复本月花费失败: %v", err)
+			}
+		}
+		logInfo("计费已启用 | 价格表模型数: %d", len(cfg.Prices))
+	}
+
+	server := &http.Server{Addr: ":" + cfg.Port}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		logInfo("收到退出信号，正在关闭...")
+		// 先停止接收新请求并等待处理中的请求结束，再关闭账本等组件
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := server.Shutdown(ctx); err != nil {
+			logWarn("等待处理中的请求超时: %v", err)
+		}
+		cancel()
+		gateway.Close()
+		os.Exit(0)
+	}()
+
+	if cfg.AdminPort != "" {
+		admin := NewAdminServer(gateway, cfg)
+		go admin.ListenAndServe()
+	}
 
 	// OpenAI 兼容接口
-	http.HandleFunc("/v1/chat/completions", gateway.HandleChatCompletion)
+	http.HandleFunc("/v1/chat/completions", gateway.traced("/v1/chat/completions", gateway.HandleChatCompletion))
 	http.HandleFunc("/v1/models", gateway.HandleModels)
 
 	// Anthropic 兼容接口
-	http.HandleFunc("/v1/messages", gateway.HandleAnthropicMessages)
+	http.HandleFunc("/v1/messages", gateway.traced("/v1/messages", gateway.HandleAnthropicMessages))
 
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	// 流式响应续传
+	http.HandleFunc("/v1/streams/", gateway.traced("/v1/streams/{id}", gateway.HandleStreamResume))
+
+	// Prometheus 指标
+	if gateway.metrics != nil {
+		http.HandleFunc("/metrics", gateway.HandleMetrics(cfg.MetricsToken))
+	}
+
+	http.HandleFunc("/health", gateway.HandleHealth)
 
 	logInfo("服务就绪，等待请求...")
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	select {} // 等待信号处理完成退出
+}
+
+// runCommand 执行命令行子命令
+func runCommand(name string, args []string) {
+	var err error
+	switch name {
+	case "export-usage":
+		err = runExportUsage(args)
+	case "spki-pin":
+		err = runSPKIPin(args)
+	case "audit-decrypt":
+		err = runAuditDecrypt(args)
+	default:
+		fmt.Fprintf(os.Stderr, "未知命令: %s\n可用命令: export-usage, spki-pin, audit-decrypt\n", name)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s 失败: %v\n", name, err)
+		os.Exit(1)
+	}
 }
 
 func getEnv(key, defaultVal string) string {
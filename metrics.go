@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Prometheus 指标
+// ============================================================================
+
+// 请求耗时与首 token 耗时的分桶（秒）
+var (
+	latencyBuckets    = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120}
+	firstTokenBuckets = []float64{0.1, 0.25, 0.5, 1, 2, 3, 5, 10, 20, 30}
+)
+
+// metricLabels 一组标签值，按 vec 声明的标签名顺序排列
+type metricLabels []string
+
+func (l metricLabels) key() string {
+	return strings.Join(l, "\xff")
+}
+
+// counterVec 带标签的计数器
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels metricLabels
+	value  float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]*counterValue)}
+}
+
+func (c *counterVec) add(delta float64, labels ...string) {
+	key := metricLabels(labels).key()
+	c.mu.Lock()
+	v, exists := c.values[key]
+	if !exists {
+		v = &counterValue{labels: labels}
+		c.values[key] = v
+	}
+	v.value += delta
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeMetricHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		v := c.values[key]
+		writeSample(w, c.name, c.labels, v.labels, v.value)
+	}
+}
+
+// histogramVec 带标签的直方图
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels metricLabels
+	counts []uint64 // 与 buckets 一一对应，不含 +Inf
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+}
+
+func (h *histogramVec) observe(value float64, labels ...string) {
+	key := metricLabels(labels).key()
+	h.mu.Lock()
+	v, exists := h.values[key]
+	if !exists {
+		v = &histogramValue{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+	h.mu.Unlock()
+}
+
+func (h *histogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	names := append(append([]string{}, h.labels...), "le")
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+		for i, bound := range h.buckets {
+			writeSample(w, h.name+"_bucket", names, append(append(metricLabels{}, v.labels...), formatFloat(bound)), float64(v.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", names, append(append(metricLabels{}, v.labels...), "+Inf"), float64(v.count))
+		writeSample(w, h.name+"_sum", h.labels, v.labels, v.sum)
+		writeSample(w, h.name+"_count", h.labels, v.labels, float64(v.count))
+	}
+}
+
+// gaugeSet 抓取时临时生成的一组同名仪表
+type gaugeSet struct {
+	name, help string
+	labels     []string
+	samples    []counterValue
+}
+
+func (s *gaugeSet) set(value float64, labels ...string) {
+	s.samples = append(s.samples, counterValue{labels: labels, value: value})
+}
+
+func (s *gaugeSet) write(w *bufio.Writer, kind string) {
+	writeMetricHeader(w, s.name, s.help, kind)
+	for _, sample := range s.samples {
+		writeSample(w, s.name, s.labels, sample.labels, sample.value)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// 文本格式
+// ---------------------------------------------------------------------------
+
+func writeMetricHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w *bufio.Writer, name string, names []string, values metricLabels, value float64) {
+	w.WriteString(name)
+	if len(names) > 0 {
+		w.WriteByte('{')
+		for i, label := range names {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, escapeLabelValue(values[i]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ---------------------------------------------------------------------------
+// 网关指标
+// ---------------------------------------------------------------------------
+
+// Metrics 请求结束与上游应答时累加的指标；仪表类指标在抓取时从网关状态读取
+type Metrics struct {
+	startTime time.Time
+
+	requests        *counterVec
+	latency         *histogramVec
+	firstToken      *histogramVec
+	errors          *counterVec
+	tokens          *counterVec
+	shared          *counterVec
+	upstream        *counterVec
+	upstreamLatency *histogramVec
+}
+
+// NewMetrics 创建空的指标集
+func NewMetrics() *Metrics {
+	return &Metrics{
+		startTime:       time.Now(),
+		requests:        newCounterVec("gateway_requests_total", "Requests handled, by endpoint, model and HTTP status.", "endpoint", "model", "status"),
+		latency:         newHistogramVec("gateway_request_duration_seconds", "Request latency from arrival to the last byte.", latencyBuckets, "endpoint", "model"),
+		firstToken:      newHistogramVec("gateway_time_to_first_token_seconds", "Time from arrival to the first output token.", firstTokenBuckets, "model", "stream"),
+		errors:          newCounterVec("gateway_request_errors_total", "Failed requests by error class.", "class"),
+		tokens:          newCounterVec("gateway_tokens_total", "Tokens processed, by model and direction (input/output).", "model", "direction"),
+		shared:          newCounterVec("gateway_shared_responses_total", "Responses served without an upstream call, by source (cache/coalesced).", "source"),
+		upstream:        newCounterVec("gateway_upstream_responses_total", "Upstream /api/chat responses by proxy and status; status is \"error\" for network failures.", "proxy", "status"),
+		upstreamLatency: newHistogramVec("gateway_upstream_header_seconds", "Time until upstream response headers arrive, by proxy.", latencyBuckets, "proxy"),
+	}
+}
+
+// metricModel 模型标签：未知模型统一记为 other，避免客户端随意填写模型名导致序列数膨胀
+func metricModel(model string) string {
+	if model == "" {
+		return ""
+	}
+	for _, upstream := range ModelMapping {
+		if model == upstream {
+			return model
+		}
+	}
+	return "other"
+}
+
+func metricProxy(proxyIndex int) string {
+	if proxyIndex == -1 {
+		return "direct"
+	}
+	return strconv.Itoa(proxyIndex)
+}
+
+// observeRequest 请求结束时累加请求数、耗时、错误和 token
+func (m *Metrics) observeRequest(rc *RequestContext, rec UsageRecord) {
+	if m == nil {
+		return
+	}
+	model := metricModel(rec.Model)
+	m.requests.add(1, rec.Endpoint, model, strconv.Itoa(rec.Status))
+	m.latency.observe(time.Since(rc.StartTime).Seconds(), rec.Endpoint, model)
+	if rc.FirstToken > 0 {
+		m.firstToken.observe(rc.FirstToken.Seconds(), model, strconv.FormatBool(rc.Stream))
+	}
+	if rec.ErrorClass != "" {
+		m.errors.add(1, rec.ErrorClass)
+	}
+	if rec.InputTokens > 0 {
+		m.tokens.add(float64(rec.InputTokens), model, "input")
+	}
+	if rec.OutputTokens > 0 {
+		m.tokens.add(float64(rec.OutputTokens), model, "output")
+	}
+	switch {
+	case rec.Cached:
+		m.shared.add(1, "cache")
+	case rec.Coalesced:
+		m.shared.add(1, "coalesced")
+	}
+}
+
+// observeUpstream 记录一次上游应答，err 不为空表示网络错误
+func (m *Metrics) observeUpstream(proxyIndex, status int, latency time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	proxy := metricProxy(proxyIndex)
+	if err != nil {
+		m.upstream.add(1, proxy, "error")
+		return
+	}
+	m.upstream.add(1, proxy, strconv.Itoa(status))
+	m.upstreamLatency.observe(latency.Seconds(), proxy)
+}
+
+// markFirstToken 记录首个输出 token 的耗时，只记录第一次
+func (rc *RequestContext) markFirstToken() {
+	if rc.FirstToken == 0 {
+		rc.FirstToken = time.Since(rc.StartTime)
+		rc.span.addEvent("first_token")
+	}
+}
+
+// writeMetrics 输出全部指标
+func (g *Gateway) writeMetrics(w *bufio.Writer) {
+	m := g.metrics
+	m.requests.write(w)
+	m.latency.write(w)
+	m.firstToken.write(w)
+	m.errors.write(w)
+	m.tokens.write(w)
+	m.shared.write(w)
+	m.upstream.write(w)
+	m.upstreamLatency.write(w)
+
+	start := &gaugeSet{name: "gateway_start_time_seconds", help: "Unix time the gateway started."}
+	start.set(float64(m.startTime.Unix()))
+	start.write(w, "gauge")
+
+	// 处理中的请求
+	inflight := &gaugeSet{name: "gateway_requests_in_flight", help: "Requests currently being handled, by endpoint.", labels: []string{"endpoint"}}
+	byEndpoint := make(map[string]int)
+	g.inflightMu.Lock()
+	for rc := range g.inflight {
+		byEndpoint[rc.Endpoint]++
+	}
+	g.inflightMu.Unlock()
+	for _, endpoint := range sortedKeys(byEndpoint) {
+		inflight.set(float64(byEndpoint[endpoint]), endpoint)
+	}
+	inflight.write(w, "gauge")
+
+	// 会话池
+	tenantLabels := []string{"tenant"}
+	poolSize := &gaugeSet{name: "gateway_pool_size", help: "Session slots per proxy, by tenant.", labels: tenantLabels}
+	sessions := &gaugeSet{name: "gateway_pool_sessions", help: "Upstream sessions created and alive, by tenant.", labels: tenantLabels}
+	poolInflight := &gaugeSet{name: "gateway_pool_in_flight", help: "Requests holding a pooled session, by tenant.", labels: tenantLabels}
+	queued := &gaugeSet{name: "gateway_pool_queued", help: "Requests waiting for a free session, by tenant.", labels: tenantLabels}
+	created := &gaugeSet{name: "gateway_pool_sessions_created_total", help: "Sessions created, by tenant.", labels: tenantLabels}
+	evicted := &gaugeSet{name: "gateway_pool_sessions_evicted_total", help: "Idle sessions evicted, by tenant.", labels: tenantLabels}
+	waits := &gaugeSet{name: "gateway_pool_waits_total", help: "Requests that had to queue for a session, by tenant.", labels: tenantLabels}
+	timeouts := &gaugeSet{name: "gateway_pool_timeouts_total", help: "Requests that timed out waiting for a session, by tenant.", labels: tenantLabels}
+	for _, status := range g.poolStatus() {
+		poolSize.set(float64(status.PoolSize), status.Tenant)
+		sessions.set(float64(status.Sessions), status.Tenant)
+		poolInflight.set(float64(status.InFlight), status.Tenant)
+		queued.set(float64(status.Queued), status.Tenant)
+		created.set(float64(status.Created), status.Tenant)
+		evicted.set(float64(status.Evicted), status.Tenant)
+		waits.set(float64(status.Waits), status.Tenant)
+		timeouts.set(float64(status.Timeouts), status.Tenant)
+	}
+	for _, s := range []*gaugeSet{poolSize, sessions, poolInflight, queued} {
+		s.write(w, "gauge")
+	}
+	for _, s := range []*gaugeSet{created, evicted, waits, timeouts} {
+		s.write(w, "counter")
+	}
+
+	// 代理与出口
+	proxyLabels := []string{"proxy", "container"}
+	active := &gaugeSet{name: "gateway_proxy_active", help: "1 for the WARP proxy currently used for new sessions.", labels: proxyLabels}
+	_, current := g.proxyMgr.GetCurrentProxy()
+	for i := range g.proxyMgr.proxies {
+		value := 0.0
+		if i == current {
+			value = 1
+		}
+		active.set(value, metricProxy(i), g.proxyMgr.containerName(i))
+	}
+	active.write(w, "gauge")
+
+	egress := &gaugeSet{name: "gateway_egress_healthy", help: "1 if the last egress connectivity check succeeded.", labels: []string{"proxy"}}
+	for _, status := range g.egressHealth.list() {
+		value := 0.0
+		if status.Healthy {
+			value = 1
+		}
+		egress.set(value, metricProxy(status.ProxyIndex))
+	}
+	egress.write(w, "gauge")
+
+	// 熔断
+	if g.breakers != nil {
+		state := &gaugeSet{name: "gateway_circuit_state", help: "1 for the current circuit breaker state of each upstream proxy.", labels: []string{"proxy", "state"}}
+		errorRate := &gaugeSet{name: "gateway_circuit_error_rate", help: "Error rate in the circuit breaker window.", labels: []string{"proxy"}}
+		rejected := &gaugeSet{name: "gateway_circuit_rejected_total", help: "Requests rejected while the circuit was open.", labels: []string{"proxy"}}
+		for _, b := range g.breakers.all() {
+			status := b.status()
+			proxy := metricProxy(status.ProxyIndex)
+			for _, s := range []string{breakerClosed, breakerOpen, breakerHalfOpen} {
+				value := 0.0
+				if status.State == s {
+					value = 1
+				}
+				state.set(value, proxy, s)
+			}
+			errorRate.set(status.ErrorRate, proxy)
+			rejected.set(float64(status.Rejected), proxy)
+		}
+		state.write(w, "gauge")
+		errorRate.write(w, "gauge")
+		rejected.write(w, "counter")
+	}
+
+	// 模型可用性
+	if g.models != nil {
+		available := &gaugeSet{name: "gateway_model_available", help: "1 if the upstream model is not cooling down.", labels: []string{"model"}}
+		for _, status := range g.models.status() {
+			value := 0.0
+			if status.Available {
+				value = 1
+			}
+			available.set(value, metricModel(status.Model))
+		}
+		available.write(w, "gauge")
+	}
+
+	// 响应缓存
+	if g.cache != nil {
+		stats := g.cache.Stats()
+		entries := &gaugeSet{name: "gateway_cache_entries", help: "Responses held in the in-memory cache."}
+		entries.set(float64(stats.Entries))
+		entries.write(w, "gauge")
+		lookups := &gaugeSet{name: "gateway_cache_lookups_total", help: "Response cache lookups by result.", labels: []string{"result"}}
+		lookups.set(float64(stats.Hits), "hit")
+		lookups.set(float64(stats.Misses), "miss")
+		lookups.write(w, "counter")
+	}
+}
+
+// HandleMetrics GET /metrics：Prometheus 文本格式；配置了 METRICS_TOKEN 时需要 Bearer 令牌
+func (g *Gateway) HandleMetrics(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				http.Error(w, "invalid metrics token", http.StatusUnauthorized)
+				return
+			}
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		g.writeMetrics(bw)
+		bw.Flush()
+	}
+}
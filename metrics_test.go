@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	sampleLineRe = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(?:\{(.*)\})? (\S+)$`)
+	labelPairRe  = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)="((?:[^"\\]|\\[\\"n])*)"(,|$)`)
+)
+
+// expoSample 解析后的一条样本
+type expoSample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// parseExposition 按 Prometheus 文本格式（0.0.4）解析并校验：每个指标族先 HELP 后 TYPE 且只声明一次，
+// 样本紧跟所属指标族，标签值转义正确，同一序列不重复
+func parseExposition(t *testing.T, text string) (map[string]string, []expoSample) {
+	t.Helper()
+	types := make(map[string]string)
+	var samples []expoSample
+	seen := make(map[string]bool)
+	family, pendingHelp := "", ""
+
+	if !strings.HasSuffix(text, "\n") {
+		t.Fatal("输出应以换行结尾")
+	}
+	for i, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		fail := func(format string, args ...interface{}) {
+			t.Fatalf("第 %d 行 %q: %s", i+1, line, fmt.Sprintf(format, args...))
+		}
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			fields := strings.SplitN(strings.TrimPrefix(line, "# HELP "), " ", 2)
+			if len(fields) != 2 || !metricNameRe.MatchString(fields[0]) || fields[1] == "" {
+				fail("HELP 格式错误")
+			}
+			pendingHelp = fields[0]
+		case strings.HasPrefix(line, "# TYPE "):
+			fields := strings.Fields(strings.TrimPrefix(line, "# TYPE "))
+			if len(fields) != 2 || fields[0] != pendingHelp {
+				fail("TYPE 应紧跟同名的 HELP")
+			}
+			switch fields[1] {
+			case "counter", "gauge", "histogram":
+			default:
+				fail("未知类型 %s", fields[1])
+			}
+			if _, dup := types[fields[0]]; dup {
+				fail("指标族重复声明")
+			}
+			if fields[1] == "counter" && !strings.HasSuffix(fields[0], "_total") {
+				fail("计数器名应以 _total 结尾")
+			}
+			family, pendingHelp = fields[0], ""
+			types[family] = fields[1]
+		case strings.HasPrefix(line, "#") || line == "":
+			fail("不应出现其他注释或空行")
+		default:
+			m := sampleLineRe.FindStringSubmatch(line)
+			if m == nil {
+				fail("样本格式错误")
+			}
+			name := m[1]
+			allowed := name == family
+			if types[family] == "histogram" {
+				allowed = name == family+"_bucket" || name == family+"_sum" || name == family+"_count"
+			}
+			if family == "" || !allowed {
+				fail("样本不属于当前指标族 %s", family)
+			}
+			labels := make(map[string]string)
+			for rest := m[2]; rest != ""; {
+				pair := labelPairRe.FindStringSubmatch(rest)
+				if pair == nil {
+					fail("标签格式错误: %s", rest)
+				}
+				if _, dup := labels[pair[1]]; dup {
+					fail("标签 %s 重复", pair[1])
+				}
+				labels[pair[1]] = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n").Replace(pair[2])
+				rest = rest[len(pair[0]):]
+			}
+			value, err := strconv.ParseFloat(m[3], 64)
+			if err != nil {
+				fail("数值无效")
+			}
+			series := name + "{" + m[2] + "}"
+			if seen[series] {
+				fail("序列重复")
+			}
+			seen[series] = true
+			samples = append(samples, expoSample{name: name, labels: labels, value: value})
+		}
+	}
+	return types, samples
+}
+
+// checkHistograms 分桶按 le 递增、计数单调不减，+Inf 分桶等于 _count
+func checkHistograms(t *testing.T, types map[string]string, samples []expoSample) {
+	t.Helper()
+	for family, kind := range types {
+		if kind != "histogram" {
+			continue
+		}
+		type series struct {
+			les, counts []float64
+			count       float64
+			hasSum      bool
+		}
+		bySeries := make(map[string]*series)
+		get := func(labels map[string]string) *series {
+			var parts []string
+			for k, v := range labels {
+				if k != "le" {
+					parts = append(parts, k+"="+v)
+				}
+			}
+			sort.Strings(parts)
+			key := strings.Join(parts, ",")
+			if bySeries[key] == nil {
+				bySeries[key] = &series{}
+			}
+			return bySeries[key]
+		}
+		for _, s := range samples {
+			switch s.name {
+			case family + "_bucket":
+				le, err := strconv.ParseFloat(s.labels["le"], 64)
+				if err != nil {
+					t.Fatalf("%s: le 无效 %q", family, s.labels["le"])
+				}
+				sr := get(s.labels)
+				sr.les, sr.counts = append(sr.les, le), append(sr.counts, s.value)
+			case family + "_sum":
+				get(s.labels).hasSum = true
+			case family + "_count":
+				get(s.labels).count = s.value
+			}
+		}
+		for key, sr := range bySeries {
+			n := len(sr.les)
+			if n == 0 || !math.IsInf(sr.les[n-1], 1) || !sr.hasSum || sr.counts[n-1] != sr.count {
+				t.Fatalf("%s{%s}: 缺少 +Inf 分桶、_sum 或 +Inf 与 _count 不一致", family, key)
+			}
+			for i := 1; i < n; i++ {
+				if sr.les[i] <= sr.les[i-1] || sr.counts[i] < sr.counts[i-1] {
+					t.Fatalf("%s{%s}: 分桶未按 le 递增或计数减少", family, key)
+				}
+			}
+		}
+	}
+}
+
+func TestMetricsExposition(t *testing.T) {
+	g := newTestGateway()
+	g.metrics = NewMetrics()
+	g.breakers = NewBreakerSet(testBreakerConfig())
+	g.breakers.get(-1)
+
+	rc := &RequestContext{StartTime: time.Now().Add(-1500 * time.Millisecond), FirstToken: 300 * time.Millisecond, Stream: true}
+	g.metrics.observeRequest(rc, UsageRecord{Endpoint: "/v1/chat/completions", Model: "openai/gpt-5.2", Status: 200, InputTokens: 12, OutputTokens: 34})
+	g.metrics.observeRequest(rc, UsageRecord{Endpoint: "/v1/\"odd\"\\path\n", Model: "made-up", Status: 502, ErrorClass: errClassUpstreamNetwork, Cached: true})
+	g.metrics.observeUpstream(-1, 200, 800*time.Millisecond, nil)
+	g.metrics.observeUpstream(0, 0, 0, fmt.Errorf("dial tcp: refused"))
+
+	w := httptest.NewRecorder()
+	g.HandleMetrics("")(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type: %q", ct)
+	}
+	types, samples := parseExposition(t, w.Body.String())
+	checkHistograms(t, types, samples)
+
+	find := func(name string, labels map[string]string) (float64, bool) {
+		for _, s := range samples {
+			if s.name != name {
+				continue
+			}
+			match := true
+			for k, v := range labels {
+				if s.labels[k] != v {
+					match = false
+				}
+			}
+			if match {
+				return s.value, true
+			}
+		}
+		return 0, false
+	}
+	checks := []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"gateway_requests_total", map[string]string{"endpoint": "/v1/chat/completions", "model": "openai/gpt-5.2", "status": "200"}, 1},
+		{"gateway_requests_total", map[string]string{"endpoint": "/v1/\"odd\"\\path\n", "model": "other", "status": "502"}, 1},
+		{"gateway_tokens_total", map[string]string{"model": "openai/gpt-5.2", "direction": "output"}, 34},
+		{"gateway_shared_responses_total", map[string]string{"source": "cache"}, 1},
+		{"gateway_upstream_responses_total", map[string]string{"proxy": "0", "status": "error"}, 1},
+		{"gateway_request_duration_seconds_count", map[string]string{"model": "openai/gpt-5.2"}, 1},
+		{"gateway_request_duration_seconds_bucket", map[string]string{"model": "openai/gpt-5.2", "le": "1"}, 0},
+		{"gateway_request_duration_seconds_bucket", map[string]string{"model": "openai/gpt-5.2", "le": "2.5"}, 1},
+	}
+	for _, c := range checks {
+		if got, ok := find(c.name, c.labels); !ok || got != c.want {
+			t.Errorf("%s%v = %v (存在: %v), 期望 %v", c.name, c.labels, got, ok, c.want)
+		}
+	}
+}
+
+func TestMetricsToken(t *testing.T) {
+	g := newTestGateway()
+	g.metrics = NewMetrics()
+	handler := g.HandleMetrics("secret")
+	for _, tt := range []struct {
+		auth string
+		want int
+	}{{"", http.StatusUnauthorized}, {"Bearer wrong", http.StatusUnauthorized}, {"Bearer secret", http.StatusOK}} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		handler(w, req)
+		if w.Code != tt.want {
+			t.Errorf("Authorization %q: 状态 %d, 期望 %d", tt.auth, w.Code, tt.want)
+		}
+	}
+}
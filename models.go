@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// 模型可用性
+// ============================================================================
+
+// ModelHealthConfig 模型可用性参数
+type ModelHealthConfig struct {
+	FailureThreshold int           `json:"failure_threshold"` // 连续失败多少次后下线
+	Cooldown         time.Duration `json:"cooldown"`          // 下线时长
+	Recheck          bool          `json:"recheck"`           // 冷却结束后是否主动发送试探请求
+}
+
+type modelState struct {
+	consecutive int
+	downUntil   time.Time // 零值表示可用
+	rechecking  bool
+	lastRecheck time.Time // 最近一次主动试探的时间
+	lastError   string
+	successes   uint64
+	failures    uint64
+}
+
+// ModelTracker 按上游模型名统计真实请求结果
+type ModelTracker struct {
+	cfg    ModelHealthConfig
+	models map[string]*modelState
+	mu     sync.Mutex
+}
+
+func NewModelTracker(cfg ModelHealthConfig) *ModelTracker {
+	if cfg.FailureThreshold < 1 {
+		cfg.FailureThreshold = 1
+	}
+	return &ModelTracker{cfg: cfg, models: make(map[string]*modelState)}
+}
+
+func (mt *ModelTracker) stateLocked(model string) *modelState {
+	state, exists := mt.models[model]
+	if !exists {
+		state = &modelState{}
+		mt.models[model] = state
+	}
+	return state
+}
+
+// record 记录一次请求结果。冷却结束后的第一个请求相当于试探，失败会立即重新下线
+func (mt *ModelTracker) record(model string, failed bool, reason string) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	state := mt.stateLocked(model)
+	if !failed {
+		state.successes++
+		if !state.downUntil.IsZero() {
+			logInfo("模型恢复可用 | 模型: %s", model)
+		}
+		state.consecutive = 0
+		state.downUntil = time.Time{}
+		return
+	}
+
+	state.failures++
+	state.consecutive++
+	state.lastError = reason
+	if state.consecutive >= mt.cfg.FailureThreshold && !time.Now().Before(state.downUntil) {
+		state.downUntil = time.Now().Add(mt.cfg.Cooldown)
+		logWarn("模型暂时下线 | 模型: %s, 连续失败: %d, 冷却: %v, 最近错误: %s",
+			model, state.consecutive, mt.cfg.Cooldown, reason)
+	}
+}
+
+// available 模型是否可用；不可用时返回剩余冷却时间
+func (mt *ModelTracker) available(model string) (bool, time.Duration) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	state, exists := mt.models[model]
+	if !exists {
+		return true, 0
+	}
+	if remaining := time.Until(state.downUntil); remaining > 0 {
+		return false, remaining
+	}
+	return true, 0
+}
+
+// dueForRecheck 返回冷却已结束、尚未恢复且没有试探中的模型。
+// 试探没有得到结论（4xx、无可用会话）时模型保持待试探，每个冷却周期最多试探一次
+func (mt *ModelTracker) dueForRecheck() []string {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	now := time.Now()
+	var list []string
+	for model, state := range mt.models {
+		if !state.downUntil.IsZero() && !now.Before(state.downUntil) && !state.rechecking &&
+			now.Sub(state.lastRecheck) >= mt.cfg.Cooldown {
+			state.rechecking = true
+			state.lastRecheck = now
+			list = append(list, model)
+		}
+	}
+	return list
+}
+
+func (mt *ModelTracker) recheckDone(model string) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.stateLocked(model).rechecking = false
+}
+
+// ModelStatus 模型可用性概要
+type ModelStatus struct {
+	Model               string     `json:"model"`
+	Available           bool       `json:"available"`
+	UnavailableUntil    *time.Time `json:"unavailable_until,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	Successes           uint64     `json:"successes"`
+	Failures            uint64     `json:"failures"`
+}
+
+func (mt *ModelTracker) status() []ModelStatus {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	now := time.Now()
+	list := make([]ModelStatus, 0, len(mt.models))
+	for model, state := range mt.models {
+		status := ModelStatus{
+			Model:               model,
+			Available:           !now.Before(state.downUntil),
+			ConsecutiveFailures: state.consecutive,
+			LastError:           state.lastError,
+			Successes:           state.successes,
+			Failures:            state.failures,
+		}
+		if !status.Available {
+			until := state.downUntil
+			status.UnavailableUntil = &until
+		}
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Model < list[j].Model })
+	return list
+}
+
+// ---------------------------------------------------------------------------
+// 网关集成
+// ---------------------------------------------------------------------------
+
+// recordModel 根据 /api/chat 的结果更新模型可用性。
+// 只有 5xx 和网络错误计为失败；4xx 多为请求本身的问题（格式错误、内容过长等），
+// 不能因为个别调用方的请求让所有租户都用不了该模型
+func (g *Gateway) recordModel(model string, status int, err error) {
+	if g.models == nil {
+		return
+	}
+	switch {
+	case err != nil:
+		g.models.record(model, true, err.Error())
+	case status == http.StatusOK:
+		g.models.record(model, false, "")
+	case status >= 500:
+		g.models.record(model, true, fmt.Sprintf("状态 %d", status))
+	}
+}
+
+// modelAvailable 模型名（别名或上游模型名）当前是否可用
+func (g *Gateway) modelAvailable(model string) bool {
+	if g.models == nil {
+		return true
+	}
+	ok, _ := g.models.available(g.convertModel(model))
+	return ok
+}
+
+// checkModelAvailable 模型冷却中时直接返回 503
+func (g *Gateway) checkModelAvailable(w http.ResponseWriter, rc *RequestContext, model string, protocol apiProtocol) bool {
+	if g.models == nil {
+		return true
+	}
+	ok, remaining := g.models.available(g.convertModel(model))
+	if ok {
+		return true
+	}
+	logWarn("%s | 模型暂时不可用 | 模型: %s, 剩余冷却: %v", rc.ID, model, remaining.Round(time.Second))
+	rc.ErrorClass = errClassModelUnavailable
+	w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+	writeAPIError(w, protocol, http.StatusServiceUnavailable, "model_unavailable",
+		fmt.Sprintf("Model %s is temporarily unavailable, please retry later or use another model", model))
+	return false
+}
+
+// recheckModel 冷却结束后用默认租户的会话发送一个最小请求，结果由 postChat 记录。
+// 上游没有不消耗额度的模型探测接口，试探是一次真实对话，计入默认租户的额度
+func (g *Gateway) recheckModel(model string) {
+	defer g.models.recheckDone(model)
+
+	rc := &RequestContext{ID: logger.nextRequestID(), StartTime: time.Now(), Model: model}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, sk, release, err := g.acquireClient(ctx, "")
+	if err != nil {
+		logWarn("%s | 模型试探失败，无可用会话 | 模型: %s, 错误: %v", rc.ID, model, err)
+		return
+	}
+	defer release()
+
+	chatReq := ChatRequest{
+		ID: uuid.New().String(),
+		Message: Message{
+			Role:  "user",
+			Parts: []MessagePart{{Type: "text", Text: "Reply with OK."}},
+			ID:    uuid.New().String(),
+		},
+		SelectedChatModel:      model,
+		SelectedVisibilityType: "private",
+	}
+	logInfo("%s | 模型试探 | 模型: %s", rc.ID, model)
+	resp, err := g.postChat(client, sk, chatReq, rc)
+	if err != nil {
+		logWarn("%s | 模型试探请求失败 | 模型: %s, 错误: %v", rc.ID, model, err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	logInfo("%s | 模型试探完成 | 模型: %s, 状态: %d", rc.ID, model, resp.StatusCode)
+}
+
+// modelRecheckLoop 定期试探冷却结束的模型
+func (g *Gateway) modelRecheckLoop() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, model := range g.models.dueForRecheck() {
+			go g.recheckModel(model)
+		}
+	}
+}
+
+// handleModelHealth GET /admin/models 查看模型可用性
+func (a *AdminServer) handleModelHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	mt := a.gateway.models
+	if mt == nil {
+		writeAdminError(w, http.StatusNotFound, "model health tracking disabled")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"config": mt.cfg, "models": mt.status()})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModelTrackerCooldown(t *testing.T) {
+	mt := NewModelTracker(ModelHealthConfig{FailureThreshold: 2, Cooldown: 50 * time.Millisecond})
+	const model = "google/gemini-3-pro-preview"
+
+	mt.record(model, true, "状态 502")
+	if ok, _ := mt.available(model); !ok {
+		t.Fatal("未达到阈值时应保持可用")
+	}
+	mt.record(model, false, "")
+	mt.record(model, true, "状态 502")
+	if ok, _ := mt.available(model); !ok {
+		t.Fatal("成功后应重新计数")
+	}
+	mt.record(model, true, "状态 503")
+	ok, remaining := mt.available(model)
+	if ok || remaining <= 0 || remaining > 50*time.Millisecond {
+		t.Fatalf("连续失败达到阈值后应下线: ok=%v, 剩余 %v", ok, remaining)
+	}
+
+	// 冷却结束后的第一个请求相当于试探，失败立即重新下线
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := mt.available(model); !ok {
+		t.Fatal("冷却结束后应恢复可用")
+	}
+	mt.record(model, true, "状态 500")
+	if ok, _ := mt.available(model); ok {
+		t.Fatal("冷却结束后的试探失败应立即下线")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	mt.record(model, false, "")
+	status := mt.status()
+	if len(status) != 1 || !status[0].Available || status[0].ConsecutiveFailures != 0 ||
+		status[0].Successes != 2 || status[0].Failures != 4 || status[0].LastError != "状态 500" {
+		t.Fatalf("恢复后的状态不符: %+v", status)
+	}
+}
+
+func TestModelRecheckOncePerCooldown(t *testing.T) {
+	mt := NewModelTracker(ModelHealthConfig{FailureThreshold: 1, Cooldown: 50 * time.Millisecond})
+	const model = "openai/gpt-5.2"
+	mt.record(model, true, "状态 500")
+	if due := mt.dueForRecheck(); len(due) != 0 {
+		t.Fatalf("冷却中不应试探: %v", due)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if due := mt.dueForRecheck(); len(due) != 1 || due[0] != model {
+		t.Fatalf("冷却结束后应试探: %v", due)
+	}
+	if due := mt.dueForRecheck(); len(due) != 0 {
+		t.Fatalf("试探进行中不应重复试探: %v", due)
+	}
+
+	// 试探没有结论（如 4xx）时，同一冷却周期内不再试探
+	mt.recheckDone(model)
+	if due := mt.dueForRecheck(); len(due) != 0 {
+		t.Fatalf("同一冷却周期内不应再次试探: %v", due)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if due := mt.dueForRecheck(); len(due) != 1 {
+		t.Fatalf("下一个冷却周期应再次试探: %v", due)
+	}
+}
+
+// 只有 5xx 和网络错误计为模型失败，4xx 属于调用方的问题
+func TestRecordModelStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		failed bool
+		counts bool
+	}{
+		{"成功", http.StatusOK, nil, false, true},
+		{"上游错误", http.StatusBadGateway, nil, true, true},
+		{"服务不可用", http.StatusServiceUnavailable, nil, true, true},
+		{"网络错误", 0, errors.New("connection reset by peer"), true, true},
+		{"请求格式错误", http.StatusBadRequest, nil, false, false},
+		{"模型不存在", http.StatusNotFound, nil, false, false},
+		{"请求过大", http.StatusRequestEntityTooLarge, nil, false, false},
+		{"限流", http.StatusTooManyRequests, nil, false, false},
+		{"会话失效", http.StatusUnauthorized, nil, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGateway()
+			g.models = NewModelTracker(ModelHealthConfig{FailureThreshold: 1, Cooldown: time.Minute})
+			g.recordModel("openai/gpt-5.2", tt.status, tt.err)
+
+			status := g.models.status()
+			if !tt.counts {
+				if len(status) != 0 {
+					t.Fatalf("不应计入: %+v", status)
+				}
+				return
+			}
+			if len(status) != 1 || status[0].Available == tt.failed {
+				t.Fatalf("状态不符: %+v", status)
+			}
+		})
+	}
+}
+
+func TestModelUnavailableResponses(t *testing.T) {
+	g := newTestGateway()
+	g.models = NewModelTracker(ModelHealthConfig{FailureThreshold: 1, Cooldown: time.Minute})
+	g.recordModel(g.convertModel("gemini-3-pro-preview"), http.StatusInternalServerError, nil)
+
+	// /v1/models 不列出下线的模型
+	w := httptest.NewRecorder()
+	g.HandleModels(w, httptest.NewRequest("GET", "/v1/models", nil))
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, m := range list.Data {
+		ids = append(ids, m.ID)
+	}
+	if len(ids) != len(ModelMapping)-1 || strings.Contains(strings.Join(ids, ","), "gemini-3-pro-preview") {
+		t.Fatalf("模型列表不符: %v", ids)
+	}
+
+	// 请求下线的模型直接返回 503
+	for _, tt := range []struct {
+		path string
+		body string
+	}{
+		{"/v1/chat/completions", `{"model":"gemini-3-pro-preview","messages":[{"role":"user","content":"hi"}]}`},
+		{"/v1/messages", `{"model":"gemini-3-pro-preview","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+		if tt.path == "/v1/messages" {
+			g.HandleAnthropicMessages(w, r)
+		} else {
+			g.HandleChatCompletion(w, r)
+		}
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" ||
+			!strings.Contains(w.Body.String(), "temporarily unavailable") {
+			t.Fatalf("%s: 状态 %d, Retry-After %q, 响应 %s", tt.path, w.Code, w.Header().Get("Retry-After"), w.Body.String())
+		}
+	}
+}
+
+// 上游的 400 不让模型下线，5xx 会
+func TestPostChatRecordsModel(t *testing.T) {
+	status := http.StatusBadRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	g := NewGateway(srv.URL, NewProxyManager("", ""), false)
+	g.models = NewModelTracker(ModelHealthConfig{FailureThreshold: 1, Cooldown: time.Minute})
+	send := func() {
+		t.Helper()
+		rc := &RequestContext{ID: "req"}
+		chatReq := ChatRequest{Message: Message{Parts: []MessagePart{{Type: "text", Text: "hi"}}}, SelectedChatModel: "openai/gpt-5.2"}
+		resp, err := g.postChat(srv.Client(), sessionKey{ProxyIndex: -1}, chatReq, rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	send()
+	if !g.modelAvailable("gpt-5.2") {
+		t.Fatal("400 不应让模型下线")
+	}
+	status = http.StatusBadGateway
+	send()
+	if g.modelAvailable("gpt-5.2") {
+		t.Fatal("502 应让模型下线")
+	}
+}
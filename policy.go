@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// ============================================================================
+// 请求策略
+// ============================================================================
+
+// 策略动作
+const (
+	policyPass    = "pass"    // 放行，不再匹配后续规则
+	policyReject  = "reject"  // 返回错误
+	policyRespond = "respond" // 直接返回固定回复，不请求上游
+	policyReroute = "reroute" // 改用其他模型
+)
+
+// PolicyMatch 匹配条件，所有已填写的条件都满足才算命中
+type PolicyMatch struct {
+	Models      []string `json:"models,omitempty"`       // 模型别名或上游模型名
+	Keys        []string `json:"keys,omitempty"`         // API Key 的 key_id，名称可能重复，不按名称匹配
+	MinMessages int      `json:"min_messages,omitempty"` // 非 system 消息数下限
+	MaxMessages int      `json:"max_messages,omitempty"` // 非 system 消息数上限
+	Role        string   `json:"role,omitempty"`         // length / pattern 检查的角色，默认 user
+	MinLength   int      `json:"min_length,omitempty"`   // 该角色最后一条消息的字符数下限
+	MaxLength   int      `json:"max_length,omitempty"`   // 该角色最后一条消息的字符数上限
+	Pattern     string   `json:"pattern,omitempty"`      // 该角色最后一条消息需匹配的正则
+}
+
+// PolicyRule 一条策略规则，按配置顺序匹配，第一条命中的规则生效
+type PolicyRule struct {
+	Name   string      `json:"name"`
+	Match  PolicyMatch `json:"match"`
+	Action string      `json:"action"`
+
+	Status   int    `json:"status,omitempty"`   // reject：状态码，默认 400
+	Code     string `json:"code,omitempty"`     // reject：错误码，默认 policy_violation
+	Message  string `json:"message,omitempty"`  // reject：错误信息
+	Response string `json:"response,omitempty"` // respond：回复内容
+	Model    string `json:"model,omitempty"`    // reroute：目标模型
+
+	pattern *regexp.Regexp
+}
+
+// PolicyEngine 请求策略
+type PolicyEngine struct {
+	rules []*PolicyRule
+}
+
+// NewPolicyEngine 校验并编译 CONFIG_FILE 中的 policies
+func NewPolicyEngine(rules []PolicyRule, convert func(string) string) (*PolicyEngine, error) {
+	pe := &PolicyEngine{}
+	for i := range rules {
+		rule := rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		switch rule.Action {
+		case policyPass, policyRespond:
+		case policyReject:
+			if rule.Status == 0 {
+				rule.Status = http.StatusBadRequest
+			}
+			if rule.Code == "" {
+				rule.Code = "policy_violation"
+			}
+			if rule.Message == "" {
+				rule.Message = "Request rejected by policy"
+			}
+		case policyReroute:
+			if rule.Model == "" {
+				return nil, fmt.Errorf("策略 %s: reroute 需要 model", rule.Name)
+			}
+		default:
+			return nil, fmt.Errorf("策略 %s: 未知动作 %q", rule.Name, rule.Action)
+		}
+		for _, id := range rule.Match.Keys {
+			if !strings.HasPrefix(id, "key-") {
+				return nil, fmt.Errorf("策略 %s: keys 需要填写 key_id（key- 开头），不支持 Key 名称: %s", rule.Name, id)
+			}
+		}
+		if rule.Match.Role == "" {
+			rule.Match.Role = "user"
+		}
+		if rule.Match.Pattern != "" {
+			re, err := regexp.Compile(rule.Match.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("策略 %s: 正则无效: %w", rule.Name, err)
+			}
+			rule.pattern = re
+		}
+		models := make([]string, len(rule.Match.Models))
+		for j, model := range rule.Match.Models {
+			models[j] = convert(model)
+		}
+		rule.Match.Models = models
+		pe.rules = append(pe.rules, &rule)
+	}
+	return pe, nil
+}
+
+// matches 规则是否命中
+func (rule *PolicyRule) matches(model string, key *APIKey, messages []OpenAIMessage, extract func(interface{}) string) bool {
+	m := rule.Match
+	if len(m.Models) > 0 && !containsString(m.Models, model) {
+		return false
+	}
+	if len(m.Keys) > 0 && (key == nil || !containsString(m.Keys, key.id())) {
+		return false
+	}
+
+	count := 0
+	last, found := "", false
+	for _, msg := range messages {
+		if msg.Role != "system" {
+			count++
+		}
+		if msg.Role == m.Role {
+			last, found = extract(msg.Content), true
+		}
+	}
+	if m.MinMessages > 0 && count < m.MinMessages {
+		return false
+	}
+	if m.MaxMessages > 0 && count > m.MaxMessages {
+		return false
+	}
+
+	if m.MinLength > 0 || m.MaxLength > 0 || rule.pattern != nil {
+		if !found {
+			return false
+		}
+		length := utf8.RuneCountInString(strings.TrimSpace(last))
+		if m.MinLength > 0 && length < m.MinLength {
+			return false
+		}
+		if m.MaxLength > 0 && length > m.MaxLength {
+			return false
+		}
+		if rule.pattern != nil && !rule.pattern.MatchString(last) {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluate 返回第一条命中的规则，没有命中时返回 nil
+func (pe *PolicyEngine) evaluate(model string, key *APIKey, messages []OpenAIMessage, extract func(interface{}) string) *PolicyRule {
+	if pe == nil {
+		return nil
+	}
+	for _, rule := range pe.rules {
+		if rule.matches(model, key, messages, extract) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPolicy 在转发前执行策略，请求已处理（拒绝或固定回复）时返回 false。
+// reroute 会修改 req.Model；目标模型同样要经过 Key 的模型权限和可用性检查，不满足时保持原模型
+func (g *Gateway) applyPolicy(w http.ResponseWriter, rc *RequestContext, req *OpenAIRequest, protocol apiProtocol) bool {
+	span := rc.startSpan("policy")
+	defer span.end(nil)
+	rule := g.policies.evaluate(g.convertModel(req.Model), rc.Key, req.Messages, g.extractContent)
+	if rule == nil {
+		logDebug("%s | 策略未命中，放行", rc.ID)
+		return true
+	}
+
+	switch rule.Action {
+	case policyPass:
+		logInfo("%s | 策略命中 | 规则: %s, 动作: 放行", rc.ID, rule.Name)
+	case policyReject:
+		logInfo("%s | 策略命中 | 规则: %s, 动作: 拒绝, 状态: %d", rc.ID, rule.Name, rule.Status)
+		rc.ErrorClass = errClassPolicy
+		writeAPIError(w, protocol, rule.Status, rule.Code, rule.Message)
+		return false
+	case policyRespond:
+		logInfo("%s | 策略命中 | 规则: %s, 动作: 固定回复", rc.ID, rule.Name)
+		if protocol == protocolAnthropic {
+			g.respondAnthropicCanned(w, req.Stream, req.Model, rule.Response)
+		} else {
+			g.respondCanned(w, req.Stream, req.Model, rule.Response)
+		}
+		return false
+	case policyReroute:
+		if !rc.Key.allowsModel(rule.Model, g.convertModel) {
+			logWarn("%s | 策略命中但 Key 无权使用目标模型，保持原模型 | 规则: %s, 目标模型: %s", rc.ID, rule.Name, rule.Model)
+			return true
+		}
+		if !g.modelAvailable(rule.Model) {
+			logWarn("%s | 策略命中但目标模型暂时不可用，保持原模型 | 规则: %s, 目标模型: %s", rc.ID, rule.Name, rule.Model)
+			return true
+		}
+		logInfo("%s | 策略命中 | 规则: %s, 动作: 改用模型 %s -> %s", rc.ID, rule.Name, req.Model, rule.Model)
+		req.Model = rule.Model
+		// rc 已登记为处理中的请求，/admin/requests 会在 inflightMu 下读取 Model
+		g.inflightMu.Lock()
+		rc.Model = rule.Model
+		g.inflightMu.Unlock()
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPolicyMatchKeys(t *testing.T) {
+	a := &APIKey{Key: "sk-first-key-0001", Name: "ci"}
+	b := &APIKey{Key: "sk-second-key-0002", Name: "ci"}
+	pe, err := NewPolicyEngine([]PolicyRule{{Name: "ci-bot", Match: PolicyMatch{Keys: []string{a.id()}}, Action: policyPass}}, newTestGateway().convertModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []OpenAIMessage{{Role: "user", Content: "hi"}}
+	extract := newTestGateway().extractContent
+
+	if pe.evaluate("openai/gpt-5.2", a, messages, extract) == nil {
+		t.Fatal("key_id 相同时应命中")
+	}
+	if pe.evaluate("openai/gpt-5.2", b, messages, extract) != nil {
+		t.Fatal("同名的其他 Key 不应命中")
+	}
+	if pe.evaluate("openai/gpt-5.2", nil, messages, extract) != nil {
+		t.Fatal("未鉴权的请求不应命中按 Key 匹配的规则")
+	}
+
+	if _, err := NewPolicyEngine([]PolicyRule{{Match: PolicyMatch{Keys: []string{"ci"}}, Action: policyPass}}, newTestGateway().convertModel); err == nil {
+		t.Fatal("keys 填写名称时应报错")
+	}
+}
+
+func TestApplyPolicyReroute(t *testing.T) {
+	g := newTestGateway()
+	var err error
+	g.policies, err = NewPolicyEngine([]PolicyRule{{
+		Name:   "to-sonnet",
+		Match:  PolicyMatch{Models: []string{"claude-opus-4.5"}},
+		Action: policyReroute,
+		Model:  "claude-sonnet-4.5",
+	}}, g.convertModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  *APIKey
+		want string
+	}{
+		{"未限制模型", &APIKey{Key: "sk-a"}, "claude-sonnet-4.5"},
+		{"允许目标模型", &APIKey{Key: "sk-b", AllowedModels: []string{"claude-opus-4.5", "claude-sonnet-4.5"}}, "claude-sonnet-4.5"},
+		{"无权使用目标模型", &APIKey{Key: "sk-c", AllowedModels: []string{"claude-opus-4.5"}}, "claude-opus-4.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &RequestContext{ID: "req", Key: tt.key, Model: "claude-opus-4.5"}
+			req := &OpenAIRequest{Model: "claude-opus-4.5", Messages: []OpenAIMessage{{Role: "user", Content: "hi"}}}
+			if !g.applyPolicy(httptest.NewRecorder(), rc, req, protocolOpenAI) {
+				t.Fatal("reroute 不应结束请求")
+			}
+			if req.Model != tt.want || rc.Model != tt.want {
+				t.Fatalf("模型 %s / %s, 期望 %s", req.Model, rc.Model, tt.want)
+			}
+		})
+	}
+}
+
+// 改写模型时请求已登记为处理中，与 /admin/requests 并发读取不应产生数据竞争（go test -race）
+func TestApplyPolicyRerouteInflight(t *testing.T) {
+	g := newTestGateway()
+	var err error
+	g.policies, err = NewPolicyEngine([]PolicyRule{{Name: "to-sonnet", Action: policyReroute, Model: "claude-sonnet-4.5"}}, g.convertModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := &AdminServer{gateway: g}
+
+	var requests []*RequestContext
+	for i := 0; i < 20; i++ {
+		rc := &RequestContext{ID: "req", Key: &APIKey{Key: "sk-a"}, Model: "claude-opus-4.5"}
+		defer g.trackRequest(rc)()
+		requests = append(requests, rc)
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				admin.handleRequests(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin/requests", nil))
+			}
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	for _, rc := range requests {
+		req := &OpenAIRequest{Model: "claude-opus-4.5", Messages: []OpenAIMessage{{Role: "user", Content: "hi"}}}
+		g.applyPolicy(httptest.NewRecorder(), rc, req, protocolOpenAI)
+		if rc.Model != "claude-sonnet-4.5" {
+			t.Fatalf("模型 %s, 期望 claude-sonnet-4.5", rc.Model)
+		}
+	}
+	close(stop)
+	<-done
+}
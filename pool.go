@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ============================================================================
+// 上游会话池
+// ============================================================================
+
+// errPoolExhausted 租户会话池全部满载且排队超时
+var errPoolExhausted = errors.New("会话池已满，排队超时")
+
+// PoolConfig 会话池参数
+type PoolConfig struct {
+	MaxConcurrency int           `json:"max_concurrency"` // 单个会话的最大并发请求数，0 表示不限制
+	QueueTimeout   time.Duration `json:"queue_timeout"`   // 会话池满载时的最长排队时间
+	IdleTimeout    time.Duration `json:"idle_timeout"`    // 空闲会话的回收时间，0 表示不回收
+}
+
+// PoolStats 租户会话池计数
+type PoolStats struct {
+	Created  uint64 `json:"created"`  // 新建会话数
+	Evicted  uint64 `json:"evicted"`  // 空闲回收数
+	Waits    uint64 `json:"waits"`    // 排队次数
+	Timeouts uint64 `json:"timeouts"` // 排队超时次数
+	Queued   int    `json:"queued"`   // 当前排队请求数
+}
+
+// poolStatsLocked 返回租户的计数，调用方需持有 sessionMu
+func (g *Gateway) poolStatsLocked(tenant string) *PoolStats {
+	stats, exists := g.poolStats[tenant]
+	if !exists {
+		stats = &PoolStats{}
+		g.poolStats[tenant] = stats
+	}
+	return stats
+}
+
+// slotLoadLocked 返回槽位上会话的处理中请求数（含正在创建时占用和等待的请求），空槽位为 0
+func (g *Gateway) slotLoadLocked(key sessionKey) int {
+	n := 0
+	if pending, creating := g.pending[key]; creating {
+		n = pending.reserved
+	}
+	if g.useAuth {
+		if account, exists := g.accounts[key]; exists {
+			n += account.inflight
+		}
+		return n
+	}
+	if session, exists := g.sessions[key]; exists {
+		n += session.inflight
+	}
+	return n
+}
+
+// pendingSlot 正在创建会话的槽位。创建（注册、登录）在 sessionMu 之外进行，
+// 期间选中同一槽位的请求等待创建结束后重新选择，不会重复创建
+type pendingSlot struct {
+	reserved int           // 创建者与等待者数量，计入槽位负载
+	done     chan struct{} // 创建结束（无论成败）时关闭
+}
+
+// reserveSlotLocked 占用槽位准备创建会话，创建结束后需调用 publishSlotLocked
+func (g *Gateway) reserveSlotLocked(key sessionKey) *pendingSlot {
+	pending := &pendingSlot{reserved: 1, done: make(chan struct{})}
+	g.pending[key] = pending
+	return pending
+}
+
+// publishSlotLocked 创建结束，唤醒等待该槽位和排队中的请求
+func (g *Gateway) publishSlotLocked(key sessionKey, pending *pendingSlot) {
+	delete(g.pending, key)
+	close(pending.done)
+	g.notifyPoolLocked()
+}
+
+// waitPendingLocked 等待槽位上的会话创建结束。调用方需持有 sessionMu，等待期间会临时释放
+func (g *Gateway) waitPendingLocked(ctx context.Context, pending *pendingSlot) error {
+	pending.reserved++
+	g.sessionMu.Unlock()
+	defer func() {
+		g.sessionMu.Lock()
+		pending.reserved--
+	}()
+
+	select {
+	case <-pending.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notifyPoolLocked 唤醒排队中的请求
+func (g *Gateway) notifyPoolLocked() {
+	close(g.poolFreed)
+	g.poolFreed = make(chan struct{})
+}
+
+// waitForSlotLocked 选出租户在指定代理上负载最低且未满载的槽位，全部满载时排队等待。
+// 调用方需持有 sessionMu，等待期间会临时释放
+func (g *Gateway) waitForSlotLocked(ctx context.Context, tenant string, proxyIndex int) (sessionKey, error) {
+	var timer *time.Timer
+	for {
+		key, ok := g.tenants.next(tenant, proxyIndex, g.slotLoadLocked, g.pool.MaxConcurrency)
+		if ok {
+			if timer != nil {
+				timer.Stop()
+			}
+			return key, nil
+		}
+
+		stats := g.poolStatsLocked(tenant)
+		if timer == nil {
+			timer = time.NewTimer(g.pool.QueueTimeout)
+			stats.Waits++
+			logDebug("会话池已满，排队等待 | 租户: %s, 代理: [%d]", tenant, proxyIndex)
+		}
+		stats.Queued++
+		freed := g.poolFreed
+		g.sessionMu.Unlock()
+
+		var err error
+		select {
+		case <-freed:
+		case <-timer.C:
+			err = errPoolExhausted
+		case <-ctx.Done():
+			timer.Stop()
+			err = ctx.Err()
+		}
+
+		g.sessionMu.Lock()
+		stats.Queued--
+		if err != nil {
+			if err == errPoolExhausted {
+				stats.Timeouts++
+			}
+			return sessionKey{}, err
+		}
+	}
+}
+
+// releaseAccount 请求结束后归还账户
+func (g *Gateway) releaseAccount(account *Account) {
+	g.sessionMu.Lock()
+	defer g.sessionMu.Unlock()
+	account.inflight--
+	account.mu.Lock()
+	account.LastUsedAt = time.Now()
+	account.mu.Unlock()
+	g.notifyPoolLocked()
+}
+
+// releaseSession 请求结束后归还游客会话
+func (g *Gateway) releaseSession(session *GuestSession) {
+	g.sessionMu.Lock()
+	defer g.sessionMu.Unlock()
+	session.inflight--
+	session.mu.Lock()
+	session.LastUsedAt = time.Now()
+	session.mu.Unlock()
+	g.notifyPoolLocked()
+}
+
+// evictIdleSessions 回收空闲超时且没有处理中请求的会话，返回回收数量
+func (g *Gateway) evictIdleSessions() int {
+	cutoff := time.Now().Add(-g.pool.IdleTimeout)
+
+	g.sessionMu.Lock()
+	defer g.sessionMu.Unlock()
+
+	n := 0
+	for key, account := range g.accounts {
+		account.mu.Lock()
+		idle := account.inflight == 0 && account.LastUsedAt.Before(cutoff)
+		account.mu.Unlock()
+		if idle {
+			delete(g.accounts, key)
+			g.poolStatsLocked(key.Tenant).Evicted++
+			logInfo("回收空闲账户 | %s, 代理: [%d]", key, key.ProxyIndex)
+			n++
+		}
+	}
+	for key, session := range g.sessions {
+		session.mu.Lock()
+		idle := session.inflight == 0 && session.LastUsedAt.Before(cutoff)
+		session.mu.Unlock()
+		if idle {
+			delete(g.sessions, key)
+			g.poolStatsLocked(key.Tenant).Evicted++
+			logInfo("回收空闲会话 | %s, 代理: [%d]", key, key.ProxyIndex)
+			n++
+		}
+	}
+	if n > 0 {
+		g.notifyPoolLocked()
+	}
+	return n
+}
+
+// poolEvictLoop 定期回收空闲会话
+func (g *Gateway) poolEvictLoop() {
+	interval := g.pool.IdleTimeout / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		g.evictIdleSessions()
+	}
+}
+
+// PoolStatus 租户会话池概要
+type PoolStatus struct {
+	Tenant   string `json:"tenant"`
+	PoolSize int    `json:"pool_size"` // 每个代理上的槽位数
+	Sessions int    `json:"sessions"`  // 已创建的会话数（所有代理）
+	InFlight int    `json:"in_flight"` // 处理中的请求数
+	PoolStats
+}
+
+// poolStatus 汇总每个租户的会话池状态
+func (g *Gateway) poolStatus() []PoolStatus {
+	g.sessionMu.RLock()
+	defer g.sessionMu.RUnlock()
+
+	byTenant := make(map[string]*PoolStatus)
+	get := func(tenant string) *PoolStatus {
+		status, exists := byTenant[tenant]
+		if !exists {
+			status = &PoolStatus{Tenant: tenant, PoolSize: g.tenants.size(tenant)}
+			byTenant[tenant] = status
+		}
+		return status
+	}
+	for tenant, stats := range g.poolStats {
+		get(tenant).PoolStats = *stats
+	}
+	for key, account := range g.accounts {
+		status := get(key.Tenant)
+		status.Sessions++
+		status.InFlight += account.inflight
+	}
+	for key, session := range g.sessions {
+		status := get(key.Tenant)
+		status.Sessions++
+		status.InFlight += session.inflight
+	}
+
+	list := make([]PoolStatus, 0, len(byTenant))
+	for _, status := range byTenant {
+		list = append(list, *status)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Tenant < list[j].Tenant })
+	return list
+}
+
+// handlePool GET /admin/pool 查看会话池状态
+func (a *AdminServer) handlePool(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"config":  a.gateway.pool,
+		"tenants": a.gateway.poolStatus(),
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 会话创建访问上游，期间不能持有 sessionMu；同一槽位的并发请求只创建一次
+func TestSessionCreationOutsideLock(t *testing.T) {
+	entered := make(chan struct{}, 4)
+	unblock := make(chan struct{})
+	var creates atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			creates.Add(1)
+			entered <- struct{}{}
+			<-unblock
+		}
+	}))
+	defer srv.Close()
+
+	g := NewGateway(srv.URL, NewProxyManager("", ""), false)
+	g.pool.QueueTimeout = 5 * time.Second
+	client, _ := g.createHTTPClient("")
+	fast := &GuestSession{Client: client, Tenant: "fast", ProxyIndex: -1, LastUsedAt: time.Now()}
+	g.sessions[sessionKey{Tenant: "fast", ProxyIndex: -1}] = fast
+
+	type result struct {
+		session *GuestSession
+		err     error
+	}
+	results := make(chan result, 2)
+	acquire := func() {
+		s, err := g.getOrCreateSession(context.Background(), "slow")
+		results <- result{s, err}
+	}
+	go acquire()
+	<-entered
+	go acquire() // 同一槽位，等待第一个请求创建完成
+
+	// 慢租户创建期间，其他租户获取和归还会话不受影响
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s, err := g.getOrCreateSession(context.Background(), "fast")
+		if err != nil || s != fast {
+			t.Errorf("fast 租户获取会话: %v, %v", s, err)
+			return
+		}
+		g.releaseSession(s)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		close(unblock)
+		t.Fatal("会话创建期间其他租户被阻塞")
+	}
+
+	close(unblock)
+	var sessions []*GuestSession
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		sessions = append(sessions, r.session)
+	}
+	if creates.Load() != 1 || sessions[0] != sessions[1] {
+		t.Fatalf("创建次数 %d, 两个请求共用会话 %v", creates.Load(), sessions[0] == sessions[1])
+	}
+	if sessions[0].inflight != 2 || len(g.pending) != 0 {
+		t.Fatalf("inflight=%d, pending=%d", sessions[0].inflight, len(g.pending))
+	}
+}
+
+// 等待创建中的槽位时客户端断开，不留下占用
+func TestWaitPendingCancelled(t *testing.T) {
+	g := newTestGateway()
+	key := sessionKey{Tenant: "t", ProxyIndex: -1}
+
+	g.sessionMu.Lock()
+	pending := g.reserveSlotLocked(key)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := g.waitPendingLocked(ctx, pending)
+	load := g.slotLoadLocked(key)
+	g.publishSlotLocked(key, pending)
+	after := g.slotLoadLocked(key)
+	g.sessionMu.Unlock()
+
+	if err != context.Canceled || load != 1 || after != 0 {
+		t.Fatalf("err=%v, 取消后负载=%d, 发布后负载=%d", err, load, after)
+	}
+}
+
+func TestPoolQueueTimeout(t *testing.T) {
+	g := newTestGateway()
+	g.pool = PoolConfig{MaxConcurrency: 1, QueueTimeout: 50 * time.Millisecond}
+	client, _ := g.createHTTPClient("")
+	busy := &GuestSession{Client: client, Tenant: "t", ProxyIndex: -1, inflight: 1, LastUsedAt: time.Now()}
+	g.sessions[sessionKey{Tenant: "t", ProxyIndex: -1}] = busy
+
+	if _, err := g.getOrCreateSession(context.Background(), "t"); err != errPoolExhausted {
+		t.Fatalf("满载时 err=%v, 期望 errPoolExhausted", err)
+	}
+
+	// 归还后排队的请求获得会话
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		g.releaseSession(busy)
+	}()
+	g.pool.QueueTimeout = time.Second
+	s, err := g.getOrCreateSession(context.Background(), "t")
+	if err != nil || s != busy {
+		t.Fatalf("归还后获取: %v, %v", s, err)
+	}
+	if stats := g.poolStats["t"]; stats.Waits != 2 || stats.Timeouts != 1 {
+		t.Fatalf("排队计数 %+v", *stats)
+	}
+}
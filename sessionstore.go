@@ -0,0 +1,471 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ============================================================================
+// 上游会话持久化
+// ============================================================================
+
+// sessionStoreMagic 会话文件头，用于识别格式版本
+const sessionStoreMagic = "CGS2"
+
+// scrypt 参数（N=2^15, r=8, p=1），派生一次约 50ms，只在启动和读取新盐值时执行
+const (
+	kdfSaltSize = 16
+	kdfN        = 1 << 15
+	kdfR        = 8
+	kdfP        = 1
+)
+
+// sessionSaveInterval 定期保存间隔，避免异常退出时丢失全部会话
+const sessionSaveInterval = time.Minute
+
+// ---------------------------------------------------------------------------
+// 可导出的 cookie jar
+// ---------------------------------------------------------------------------
+
+// recordingJar 在标准 cookiejar 之上记录完整 cookie（含过期时间），
+// 标准库的 Cookies() 只返回名称和值，无法用于持久化
+type recordingJar struct {
+	*cookiejar.Jar
+	cookies map[string]savedCookie // URL + 名称 + 路径 -> cookie
+	mu      sync.Mutex
+}
+
+// savedCookie 持久化的 cookie 及其来源 URL
+type savedCookie struct {
+	URL      string    `json:"url"`
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Path     string    `json:"path,omitempty"`
+	Domain   string    `json:"domain,omitempty"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Secure   bool      `json:"secure,omitempty"`
+	HttpOnly bool      `json:"http_only,omitempty"`
+}
+
+func newRecordingJar() *recordingJar {
+	jar, _ := cookiejar.New(nil)
+	return &recordingJar{Jar: jar, cookies: make(map[string]savedCookie)}
+}
+
+func (j *recordingJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	origin := u.Scheme + "://" + u.Host
+	for _, c := range cookies {
+		key := origin + "|" + c.Name + "|" + c.Path
+		// MaxAge < 0 表示删除
+		if c.MaxAge < 0 {
+			delete(j.cookies, key)
+			continue
+		}
+		expires := c.Expires
+		if c.MaxAge > 0 {
+			expires = time.Now().Add(time.Duration(c.MaxAge) * time.Second)
+		}
+		if !expires.IsZero() && expires.Before(time.Now()) {
+			delete(j.cookies, key)
+			continue
+		}
+		j.cookies[key] = savedCookie{
+			URL:      origin,
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			Expires:  expires,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+	}
+}
+
+// export 返回未过期的 cookie
+func (j *recordingJar) export() []savedCookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	list := make([]savedCookie, 0, len(j.cookies))
+	for _, c := range j.cookies {
+		if c.Expires.IsZero() || c.Expires.After(now) {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// restore 写回持久化的 cookie，返回实际恢复的数量（过期的丢弃）
+func (j *recordingJar) restore(cookies []savedCookie) int {
+	now := time.Now()
+	restored := 0
+	for _, c := range cookies {
+		if !c.Expires.IsZero() && !c.Expires.After(now) {
+			continue
+		}
+		u, err := url.Parse(c.URL)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		j.SetCookies(u, []*http.Cookie{{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			Expires:  c.Expires,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}})
+		restored++
+	}
+	return restored
+}
+
+// ---------------------------------------------------------------------------
+// 加密文件
+// ---------------------------------------------------------------------------
+
+// storedSession 单个上游会话的持久化记录
+type storedSession struct {
+	Kind       string        `json:"kind"` // account / guest
+	Tenant     string        `json:"tenant"`
+	ProxyIndex int           `json:"proxy_index"`
+	Slot       int           `json:"slot"`
+	Email      string        `json:"email,omitempty"`
+	Password   string        `json:"password,omitempty"`
+	Credential bool          `json:"credential,omitempty"` // 是否使用运维凭据登录
+	CreatedAt  time.Time     `json:"created_at"`
+	LastUsedAt time.Time     `json:"last_used_at"`
+	Cookies    []savedCookie `json:"cookies"`
+}
+
+type sessionFile struct {
+	BaseURL  string          `json:"base_url"`
+	SavedAt  time.Time       `json:"saved_at"`
+	Sessions []storedSession `json:"sessions"`
+}
+
+// newSalt 生成随机盐值
+func newSalt() ([]byte, error) {
+	salt := make([]byte, kdfSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// newPassphraseAEAD 用 scrypt 从口令和盐值派生 AES-256-GCM 密钥
+func newPassphraseAEAD(secret string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(secret), salt, kdfN, kdfR, kdfP, 32)
+	if err != nil {
+		return nil, err
+	}
+	return newAESGCM(key)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SessionStore 使用 AES-256-GCM 加密的会话文件，密钥由口令经 scrypt 派生，盐值写在文件头
+type SessionStore struct {
+	path   string
+	secret string
+	salt   []byte
+	aead   cipher.AEAD // 由 secret 和 salt 派生
+	mu     sync.Mutex
+}
+
+// NewSessionStore 创建会话文件，密钥为任意口令
+func NewSessionStore(path, secret string) (*SessionStore, error) {
+	if secret == "" {
+		return nil, errors.New("未设置会话文件密钥")
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newPassphraseAEAD(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionStore{path: path, secret: secret, salt: salt, aead: aead}, nil
+}
+
+// 文件格式：magic + 盐值 + nonce + 密文，magic 与盐值作为附加数据参与认证
+func (s *SessionStore) save(file sessionFile) error {
+	plain, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	header := append([]byte(sessionStoreMagic), s.salt...)
+	data := append(append([]byte{}, header...), nonce...)
+	data = s.aead.Seal(data, nonce, plain, header)
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// load 读取并解密会话文件，文件不存在时返回空。之后的保存沿用文件中的盐值
+func (s *SessionStore) load() (sessionFile, error) {
+	var file sessionFile
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return file, nil
+	}
+	if err != nil {
+		return file, err
+	}
+
+	if len(data) < len(sessionStoreMagic)+kdfSaltSize || string(data[:len(sessionStoreMagic)]) != sessionStoreMagic {
+		return file, errors.New("文件格式无法识别")
+	}
+	header := data[:len(sessionStoreMagic)+kdfSaltSize]
+	salt := header[len(sessionStoreMagic):]
+	s.mu.Lock()
+	aead := s.aead
+	if string(salt) != string(s.salt) {
+		if aead, err = newPassphraseAEAD(s.secret, salt); err != nil {
+			s.mu.Unlock()
+			return file, err
+		}
+		s.salt, s.aead = append([]byte{}, salt...), aead
+	}
+	s.mu.Unlock()
+
+	body := data[len(header):]
+	if len(body) < aead.NonceSize() {
+		return file, errors.New("文件格式无法识别")
+	}
+	nonce := body[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, body[aead.NonceSize():], header)
+	if err != nil {
+		return file, errors.New("解密失败（密钥错误或文件损坏）")
+	}
+	if err := json.Unmarshal(plain, &file); err != nil {
+		return file, fmt.Errorf("解析失败: %w", err)
+	}
+	return file, nil
+}
+
+// ---------------------------------------------------------------------------
+// 网关集成
+// ---------------------------------------------------------------------------
+
+// saveSessions 把当前所有上游会话写入会话文件
+func (g *Gateway) saveSessions() {
+	if g.sessionStore == nil {
+		return
+	}
+
+	file := sessionFile{BaseURL: g.baseURL, SavedAt: time.Now()}
+	g.sessionMu.RLock()
+	for _, account := range g.accounts {
+		jar, ok := account.Client.Jar.(*recordingJar)
+		if !ok {
+			continue
+		}
+		account.mu.Lock()
+		file.Sessions = append(file.Sessions, storedSession{
+			Kind:       "account",
+			Tenant:     account.Tenant,
+			ProxyIndex: account.ProxyIndex,
+			Slot:       account.Slot,
+			Email:      account.Email,
+			Password:   account.Password,
+			Credential: account.Credential != nil,
+			CreatedAt:  account.CreatedAt,
+			LastUsedAt: account.LastUsedAt,
+			Cookies:    jar.export(),
+		})
+		account.mu.Unlock()
+	}
+	for _, session := range g.sessions {
+		jar, ok := session.Client.Jar.(*recordingJar)
+		if !ok {
+			continue
+		}
+		session.mu.Lock()
+		file.Sessions = append(file.Sessions, storedSession{
+			Kind:       "guest",
+			Tenant:     session.Tenant,
+			ProxyIndex: session.ProxyIndex,
+			Slot:       session.Slot,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			Cookies:    jar.export(),
+		})
+		session.mu.Unlock()
+	}
+	g.sessionMu.RUnlock()
+
+	if err := g.sessionStore.save(file); err != nil {
+		logError("会话文件保存失败: %v", err)
+		return
+	}
+	logDebug("会话文件已保存 | 数量: %d", len(file.Sessions))
+}
+
+// restoreSessions 启动时从会话文件恢复上游会话，恢复的会话在首次使用时校验
+func (g *Gateway) restoreSessions() {
+	if g.sessionStore == nil {
+		return
+	}
+
+	file, err := g.sessionStore.load()
+	if err != nil {
+		logError("会话文件读取失败，忽略已保存的会话: %v", err)
+		return
+	}
+	if len(file.Sessions) == 0 {
+		return
+	}
+	if file.BaseURL != g.baseURL {
+		logWarn("会话文件属于其他上游 (%s)，忽略", file.BaseURL)
+		return
+	}
+
+	restored, discarded := 0, 0
+	g.sessionMu.Lock()
+	defer g.sessionMu.Unlock()
+	for _, entry := range file.Sessions {
+		if err := g.restoreSession(entry); err != nil {
+			logDebug("丢弃已保存的会话 | %s, 原因: %v",
+				sessionKey{Tenant: entry.Tenant, ProxyIndex: entry.ProxyIndex, Slot: entry.Slot}, err)
+			discarded++
+			continue
+		}
+		restored++
+	}
+	logInfo("上游会话已恢复 | 恢复: %d, 丢弃: %d", restored, discarded)
+}
+
+// restoreSession 恢复单个会话，调用方需持有 sessionMu
+func (g *Gateway) restoreSession(entry storedSession) error {
+	key := sessionKey{Tenant: entry.Tenant, ProxyIndex: entry.ProxyIndex, Slot: entry.Slot}
+	proxyURL, ok := g.proxyMgr.proxyURL(entry.ProxyIndex)
+	if !ok {
+		return errors.New("代理已不存在")
+	}
+	if entry.Slot >= g.tenants.size(entry.Tenant) {
+		return errors.New("超出租户会话池大小")
+	}
+
+	client, err := g.createHTTPClient(proxyURL)
+	if err != nil {
+		return err
+	}
+	if client.Jar.(*recordingJar).restore(entry.Cookies) == 0 {
+		return errors.New("cookie 已全部过期")
+	}
+
+	switch entry.Kind {
+	case "account":
+		if !g.useAuth {
+			return errors.New("未启用账户模式")
+		}
+		// 凭据配置变化后旧账户不再可用
+		cred := g.credentialFor(entry.Tenant)
+		if entry.Credential != (cred != nil) {
+			return errors.New("运维凭据配置已变化")
+		}
+		if !g.hasSessionCookie(client) {
+			return errors.New("session token 已过期")
+		}
+		g.accounts[key] = &Account{
+			Email:      entry.Email,
+			Password:   entry.Password,
+			Client:     client,
+			Credential: cred,
+			Tenant:     entry.Tenant,
+			ProxyIndex: entry.ProxyIndex,
+			Slot:       entry.Slot,
+			CreatedAt:  entry.CreatedAt,
+			LastUsedAt: entry.LastUsedAt,
+			restored:   true,
+		}
+	case "guest":
+		if g.useAuth {
+			return errors.New("未启用游客模式")
+		}
+		g.sessions[key] = &GuestSession{
+			Client:     client,
+			Tenant:     entry.Tenant,
+			ProxyIndex: entry.ProxyIndex,
+			Slot:       entry.Slot,
+			CreatedAt:  entry.CreatedAt,
+			LastUsedAt: entry.LastUsedAt,
+			restored:   true,
+		}
+	default:
+		return fmt.Errorf("未知会话类型 %q", entry.Kind)
+	}
+	return nil
+}
+
+// validateRestoredUnlocked 恢复的会话首次使用前向上游确认仍然有效。
+// 调用方持有 sessionMu，校验需要访问上游，期间临时释放，避免阻塞其他租户和归还会话；
+// 调用前需先占用会话（inflight），防止被回收
+func (g *Gateway) validateRestoredUnlocked(client *http.Client, guest bool) error {
+	g.sessionMu.Unlock()
+	defer g.sessionMu.Lock()
+	_, userType, err := g.fetchSession(client)
+	if err != nil {
+		return err
+	}
+	if !guest && userType == "guest" {
+		return errors.New("账户会话已降级为游客")
+	}
+	return nil
+}
+
+// sessionSaveLoop 定期保存会话文件
+func (g *Gateway) sessionSaveLoop() {
+	ticker := time.NewTicker(sessionSaveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		g.saveSessions()
+	}
+}
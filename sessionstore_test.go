@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testSessionFile() sessionFile {
+	return sessionFile{
+		BaseURL: "https://upstream.example",
+		SavedAt: time.Now().UTC().Truncate(time.Second),
+		Sessions: []storedSession{{
+			Kind:    "guest",
+			Tenant:  "team",
+			Cookies: []savedCookie{{URL: "https://upstream.example", Name: "sid", Value: "v"}},
+		}},
+	}
+}
+
+func TestSessionStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.enc")
+	s, err := NewSessionStore(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.save(testSessionFile()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(sessionStoreMagic)) || bytes.Contains(data, []byte("upstream.example")) {
+		t.Fatal("文件应以 magic 开头且不含明文")
+	}
+
+	// 新实例的盐值不同，仍能用文件头中的盐值解密
+	other, err := NewSessionStore(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(other.salt, s.salt) {
+		t.Fatal("每个实例应生成不同的盐值")
+	}
+	file, err := other.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Sessions) != 1 || file.Sessions[0].Tenant != "team" || file.Sessions[0].Cookies[0].Value != "v" {
+		t.Fatalf("解密内容不符: %+v", file)
+	}
+	if !bytes.Equal(other.salt, s.salt) {
+		t.Fatal("读取后应沿用文件中的盐值")
+	}
+
+	wrong, err := NewSessionStore(path, "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.load(); err == nil {
+		t.Fatal("口令错误时应解密失败")
+	}
+}
+
+func TestSessionStoreRejectsTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.enc")
+	s, err := NewSessionStore(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.save(testSessionFile()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+
+	for _, offset := range []int{len(sessionStoreMagic), len(data) - 1} { // 盐值、密文
+		tampered := append([]byte{}, data...)
+		tampered[offset] ^= 1
+		os.WriteFile(path, tampered, 0600)
+		fresh, _ := NewSessionStore(path, "passphrase")
+		if _, err := fresh.load(); err == nil {
+			t.Fatalf("修改第 %d 字节后应解密失败", offset)
+		}
+	}
+
+	os.WriteFile(path, []byte("garbage"), 0600)
+	if _, err := s.load(); err == nil {
+		t.Fatal("无法识别的格式应返回错误")
+	}
+}
+
+func TestRecordingJarExportRestore(t *testing.T) {
+	jar := newRecordingJar()
+	u, _ := url.Parse("https://upstream.example/")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "keep", Value: "1", Path: "/", MaxAge: 3600},
+		{Name: "session", Value: "2", Path: "/"},
+		{Name: "expired", Value: "3", Path: "/", Expires: time.Now().Add(-time.Hour)},
+	})
+	jar.SetCookies(u, []*http.Cookie{{Name: "session", Path: "/", MaxAge: -1}})
+
+	exported := jar.export()
+	if len(exported) != 1 || exported[0].Name != "keep" || exported[0].Expires.IsZero() {
+		t.Fatalf("导出的 cookie 不符: %+v", exported)
+	}
+
+	restored := newRecordingJar()
+	stale := savedCookie{URL: "https://upstream.example", Name: "old", Value: "x", Expires: time.Now().Add(-time.Minute)}
+	if n := restored.restore(append(exported, stale)); n != 1 {
+		t.Fatalf("恢复数量 %d, 期望 1", n)
+	}
+	if cookies := restored.Cookies(u); len(cookies) != 1 || cookies[0].Value != "1" {
+		t.Fatalf("恢复后的 cookie 不符: %+v", cookies)
+	}
+}
+
+// 校验恢复的会话需要访问上游，期间不能持有 sessionMu
+func TestValidateRestoredReleasesLock(t *testing.T) {
+	var g *Gateway
+	var lockFree, created atomic.Bool
+	valid := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/auth/session":
+			if g.sessionMu.TryLock() {
+				lockFree.Store(true)
+				g.sessionMu.Unlock()
+			}
+			if !valid {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"user":{"type":"guest"}}`))
+		case "/":
+			created.Store(true)
+		}
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name  string
+		valid bool
+	}{{"有效", true}, {"已失效", false}} {
+		t.Run(tt.name, func(t *testing.T) {
+			valid = tt.valid
+			lockFree.Store(false)
+			created.Store(false)
+			g = NewGateway(srv.URL, NewProxyManager("", ""), false)
+			key := sessionKey{Tenant: "team", ProxyIndex: -1} // 未配置代理时直连
+			client, err := g.createHTTPClient("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			restored := &GuestSession{Client: client, Tenant: "team", ProxyIndex: -1, restored: true, LastUsedAt: time.Now()}
+			g.sessions[key] = restored
+
+			session, err := g.getOrCreateSession(context.Background(), "team")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !lockFree.Load() {
+				t.Fatal("校验期间仍持有 sessionMu")
+			}
+			if (session == restored) != tt.valid || created.Load() == tt.valid {
+				t.Fatalf("有效=%v 时复用=%v, 新建=%v", tt.valid, session == restored, created.Load())
+			}
+			if session.inflight != 1 || restored.restored {
+				t.Fatalf("inflight=%d, restored=%v", session.inflight, restored.restored)
+			}
+		})
+	}
+}
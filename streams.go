@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// 断线续传
+// ============================================================================
+
+// StreamConfig 流式响应续传参数
+type StreamConfig struct {
+	Enabled   bool          `json:"enabled"`
+	Retention time.Duration `json:"retention"` // 流结束后保留的时间
+	MaxBytes  int           `json:"max_bytes"` // 单个流缓存的上限，超出后该流不再支持续传
+}
+
+// streamBuffer 一个流式响应已发出的 SSE 事件（含 id 行），第 n 个事件的 id 为 <流 ID>:<n>
+type streamBuffer struct {
+	id       string
+	owner    string // API Key，未启用鉴权时为空
+	protocol apiProtocol
+	model    string
+
+	mu     sync.Mutex
+	events [][]byte
+	size   int
+	done   bool
+	notify chan struct{} // 有新事件或流结束时关闭并替换
+}
+
+// StreamStore 按流 ID 保存进行中和刚结束的流
+type StreamStore struct {
+	cfg     StreamConfig
+	mu      sync.Mutex
+	streams map[string]*streamBuffer
+}
+
+// NewStreamStore 创建空的流缓存
+func NewStreamStore(cfg StreamConfig) *StreamStore {
+	return &StreamStore{cfg: cfg, streams: make(map[string]*streamBuffer)}
+}
+
+func (ss *StreamStore) get(id string) *streamBuffer {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.streams[id]
+}
+
+func (ss *StreamStore) remove(id string) {
+	ss.mu.Lock()
+	delete(ss.streams, id)
+	ss.mu.Unlock()
+}
+
+// streamOwner 流的归属，续传时必须使用同一个 API Key
+func streamOwner(key *APIKey) string {
+	if key == nil {
+		return ""
+	}
+	return key.Key
+}
+
+// eventStream 写出 SSE 事件；启用续传时给事件加上 id 并缓存
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	store   *StreamStore
+	buf     *streamBuffer // nil 表示不支持续传
+	rc      *RequestContext
+}
+
+// newEventStream 开始一个流式响应，启用续传时登记流并写入 X-Stream-ID 响应头（须在首次写出前调用）
+func (g *Gateway) newEventStream(w http.ResponseWriter, flusher http.Flusher, rc *RequestContext, protocol apiProtocol, model string) *eventStream {
+	es := &eventStream{w: w, flusher: flusher, store: g.streams, rc: rc}
+	if g.streams == nil {
+		return es
+	}
+	es.buf = &streamBuffer{
+		id:       uuid.New().String(),
+		owner:    streamOwner(rc.Key),
+		protocol: protocol,
+		model:    model,
+		notify:   make(chan struct{}),
+	}
+	g.streams.mu.Lock()
+	g.streams.streams[es.buf.id] = es.buf
+	g.streams.mu.Unlock()
+	w.Header().Set("X-Stream-ID", es.buf.id)
+	return es
+}
+
+// send 写出一个事件，event 为空时不写 event 行
+func (es *eventStream) send(event string, data []byte) {
+	var b bytes.Buffer
+	if sb := es.buf; sb != nil {
+		sb.mu.Lock()
+		fmt.Fprintf(&b, "id: %s:%d\n", sb.id, len(sb.events)+1)
+		sb.mu.Unlock()
+	}
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	fmt.Fprintf(&b, "data: %s\n\n", data)
+
+	// 客户端断开后写出失败，事件仍然缓存，供重连后补发
+	es.w.Write(b.Bytes())
+	es.flusher.Flush()
+	es.append(b.Bytes())
+}
+
+func (es *eventStream) append(event []byte) {
+	sb := es.buf
+	if sb == nil {
+		return
+	}
+	sb.mu.Lock()
+	if sb.size+len(event) > es.store.cfg.MaxBytes {
+		sb.mu.Unlock()
+		logWarn("%s | 流缓存超出上限 %d 字节，该流不再支持续传 | 流: %s", es.rc.ID, es.store.cfg.MaxBytes, sb.id)
+		es.store.remove(sb.id)
+		es.buf = nil
+		es.finish(sb)
+		return
+	}
+	sb.events = append(sb.events, event)
+	sb.size += len(event)
+	close(sb.notify)
+	sb.notify = make(chan struct{})
+	sb.mu.Unlock()
+}
+
+// close 流结束，保留 Retention 后删除
+func (es *eventStream) close() {
+	sb := es.buf
+	if sb == nil {
+		return
+	}
+	es.finish(sb)
+	time.AfterFunc(es.store.cfg.Retention, func() { es.store.remove(sb.id) })
+}
+
+func (es *eventStream) finish(sb *streamBuffer) {
+	sb.mu.Lock()
+	if !sb.done {
+		sb.done = true
+		close(sb.notify)
+	}
+	sb.mu.Unlock()
+}
+
+// parseEventID 解析 <流 ID>:<序号>
+func parseEventID(s string) (string, int, bool) {
+	id, seq, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok || id == "" {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(seq)
+	if err != nil || n < 0 {
+		return "", 0, false
+	}
+	return id, n, true
+}
+
+// resumeFromHeader 请求带有本网关签发的 Last-Event-ID 时补发之后的事件并继续实时输出，返回 true 表示已处理。
+// 客户端重连时可以原样重发请求，请求体不会再次处理，也不会再次计费
+func (g *Gateway) resumeFromHeader(w http.ResponseWriter, r *http.Request, rc *RequestContext, protocol apiProtocol) bool {
+	if g.streams == nil {
+		return false
+	}
+	id, after, ok := parseEventID(r.Header.Get("Last-Event-ID"))
+	if !ok {
+		return false
+	}
+	g.resumeStream(w, r, rc, id, after, protocol)
+	return true
+}
+
+// resumeStream 从第 after 个事件之后补发，流未结束时继续等待新事件
+func (g *Gateway) resumeStream(w http.ResponseWriter, r *http.Request, rc *RequestContext, id string, after int, protocol apiProtocol) {
+	sb := g.streams.get(id)
+	if sb == nil || sb.owner != streamOwner(rc.Key) {
+		logWarn("%s | 续传失败，流不存在或已过期 | 流: %s", rc.ID, id)
+		rc.ErrorClass = errClassBadRequest
+		writeAPIError(w, protocol, http.StatusNotFound, "stream_not_found", "Stream not found or expired, please send the request again without Last-Event-ID")
+		return
+	}
+	rc.Model = sb.model
+	rc.Stream = true
+
+	sb.mu.Lock()
+	total := len(sb.events)
+	sb.mu.Unlock()
+	if after > total {
+		after = total
+	}
+	logInfo("%s | 续传流 | 流: %s, 已收到事件: %d, 已缓存事件: %d", rc.ID, id, after, total)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Stream-ID", id)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		sb.mu.Lock()
+		events := sb.events[after:]
+		done := sb.done
+		notify := sb.notify
+		sb.mu.Unlock()
+
+		for _, event := range events {
+			if _, err := w.Write(event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		after += len(events)
+		if done {
+			return
+		}
+
+		select {
+		case <-notify:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// HandleStreamResume GET /v1/streams/{id}：按 Last-Event-ID 请求头或 ?after=N 补发事件并继续实时输出
+func (g *Gateway) HandleStreamResume(w http.ResponseWriter, r *http.Request) {
+	rc := newRequestContext(w, r)
+	rc.Endpoint = "/v1/streams"
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	defer g.finishRequest(rc, sw)
+
+	protocol := protocolOpenAI
+	if r.Header.Get("x-api-key") != "" {
+		protocol = protocolAnthropic
+	}
+	if !g.authenticate(w, r, rc, protocol) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		rc.ErrorClass = errClassBadRequest
+		writeAPIError(w, protocol, http.StatusMethodNotAllowed, "method_not_allowed", "Use GET to resume a stream")
+		return
+	}
+	if g.streams == nil {
+		rc.ErrorClass = errClassBadRequest
+		writeAPIError(w, protocol, http.StatusNotFound, "stream_not_found", "Stream resumption is disabled")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/streams/")
+	after := 0
+	if eventID, seq, ok := parseEventID(r.Header.Get("Last-Event-ID")); ok && eventID == id {
+		after = seq
+	}
+	if s := r.URL.Query().Get("after"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			rc.ErrorClass = errClassBadRequest
+			writeAPIError(w, protocol, http.StatusBadRequest, "invalid_request_error", "after must be a non-negative integer")
+			return
+		}
+		after = n
+	}
+	if sb := g.streams.get(id); sb != nil && sb.owner == streamOwner(rc.Key) {
+		protocol = sb.protocol
+	}
+	g.resumeStream(w, r, rc, id, after, protocol)
+}
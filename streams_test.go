@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testStreamConfig() StreamConfig {
+	return StreamConfig{Enabled: true, Retention: time.Minute, MaxBytes: 1 << 20}
+}
+
+// newStreamGateway 启用续传和鉴权的网关，sk-a 和 sk-b 两个 Key
+func newStreamGateway(t *testing.T, cfg StreamConfig) *Gateway {
+	t.Helper()
+	ks, err := NewKeyStore("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"sk-a", "sk-b"} {
+		if _, err := ks.Put(APIKey{Key: key, Name: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g := newTestGateway()
+	g.keys = ks
+	g.streams = NewStreamStore(cfg)
+	return g
+}
+
+// startStream 以 key 的身份开始一个流并发出 n 个事件
+func startStream(g *Gateway, key string, n int) *eventStream {
+	k, _ := g.keys.Lookup(key)
+	es := g.newEventStream(httptest.NewRecorder(), nopFlusher{}, &RequestContext{ID: "req", Key: k}, protocolOpenAI, "gpt-5.2")
+	for i := 1; i <= n; i++ {
+		es.send("", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+	return es
+}
+
+type nopFlusher struct{}
+
+func (nopFlusher) Flush() {}
+
+// streamEventData 按顺序取出 SSE 响应中的 data 行
+func streamEventData(body string) []string {
+	var data []string
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "data: ") {
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	return data
+}
+
+func TestStreamResumeReplay(t *testing.T) {
+	g := newStreamGateway(t, testStreamConfig())
+	es := startStream(g, "sk-a", 5)
+	es.close()
+	id := es.buf.id
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		want   string
+	}{
+		{"after 参数", http.MethodGet, "/v1/streams/" + id + "?after=2", "", `{"n":3},{"n":4},{"n":5}`},
+		{"Last-Event-ID", http.MethodGet, "/v1/streams/" + id, id + ":4", `{"n":5}`},
+		{"原样重发请求", http.MethodPost, "/v1/chat/completions", id + ":1", `{"n":2},{"n":3},{"n":4},{"n":5}`},
+		{"序号超出", http.MethodGet, "/v1/streams/" + id + "?after=9", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 原样重发时请求体不会再被处理
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader("not json"))
+			r.Header.Set("Authorization", "Bearer sk-a")
+			if tt.header != "" {
+				r.Header.Set("Last-Event-ID", tt.header)
+			}
+			w := httptest.NewRecorder()
+			if tt.method == http.MethodGet {
+				g.HandleStreamResume(w, r)
+			} else {
+				g.HandleChatCompletion(w, r)
+			}
+			if w.Code != http.StatusOK || w.Header().Get("X-Stream-ID") != id {
+				t.Fatalf("状态 %d, X-Stream-ID %q: %s", w.Code, w.Header().Get("X-Stream-ID"), w.Body.String())
+			}
+			if got := strings.Join(streamEventData(w.Body.String()), ","); got != tt.want {
+				t.Fatalf("补发事件 %s, 期望 %s", got, tt.want)
+			}
+			if tt.want != "" && !strings.Contains(w.Body.String(), "id: "+id+":5\n") {
+				t.Fatalf("补发的事件应保留原 id:\n%s", w.Body.String())
+			}
+		})
+	}
+}
+
+// 流未结束时补发已缓存的事件后继续实时输出
+func TestStreamResumeLive(t *testing.T) {
+	g := newStreamGateway(t, testStreamConfig())
+	es := startStream(g, "sk-a", 2)
+	srv := httptest.NewServer(http.HandlerFunc(g.HandleStreamResume))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/streams/"+es.buf.id+"?after=1", nil)
+	req.Header.Set("Authorization", "Bearer sk-a")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				lines <- data
+			}
+		}
+	}()
+	next := func() string {
+		t.Helper()
+		select {
+		case data := <-lines:
+			return data
+		case <-time.After(2 * time.Second):
+			t.Fatal("等待事件超时")
+			return ""
+		}
+	}
+
+	if data := next(); data != `{"n":2}` {
+		t.Fatalf("应先补发已缓存的事件: %s", data)
+	}
+	es.send("", []byte(`{"n":3}`))
+	if data := next(); data != `{"n":3}` {
+		t.Fatalf("应实时输出新事件: %s", data)
+	}
+	es.close()
+	select {
+	case _, ok := <-lines:
+		if ok {
+			t.Fatal("流结束后不应再有事件")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("流结束后续传连接应关闭")
+	}
+}
+
+func TestStreamResumeNotFound(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  StreamConfig
+		key  string
+		run  func(es *eventStream)
+	}{
+		{"其他 Key", testStreamConfig(), "sk-b", func(es *eventStream) { es.close() }},
+		{"超过缓存上限", StreamConfig{Enabled: true, Retention: time.Minute, MaxBytes: 64}, "sk-a", func(es *eventStream) {
+			es.send("", []byte(strings.Repeat("x", 64)))
+			if es.buf != nil {
+				t.Fatal("超过上限后该流不应再缓存事件")
+			}
+		}},
+		{"保留期已过", StreamConfig{Enabled: true, Retention: 20 * time.Millisecond, MaxBytes: 1 << 20}, "sk-a", func(es *eventStream) {
+			es.close()
+			time.Sleep(50 * time.Millisecond)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newStreamGateway(t, tt.cfg)
+			es := startStream(g, "sk-a", 1)
+			id := es.buf.id
+			tt.run(es)
+
+			for _, path := range []string{"/v1/streams/" + id, "/v1/chat/completions"} {
+				r := httptest.NewRequest(http.MethodGet, path, nil)
+				r.Header.Set("Authorization", "Bearer "+tt.key)
+				r.Header.Set("Last-Event-ID", id+":1")
+				w := httptest.NewRecorder()
+				if strings.HasPrefix(path, "/v1/streams/") {
+					g.HandleStreamResume(w, r)
+				} else {
+					r.Method = http.MethodPost
+					g.HandleChatCompletion(w, r)
+				}
+				if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "stream_not_found") {
+					t.Fatalf("%s: 状态 %d, 期望 404: %s", path, w.Code, w.Body.String())
+				}
+			}
+		})
+	}
+}
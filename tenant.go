@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ============================================================================
+// 租户会话隔离
+// ============================================================================
+
+// sessionKey 上游会话的分区键，不同租户永远不会共用同一个会话
+type sessionKey struct {
+	Tenant     string
+	ProxyIndex int
+	Slot       int // 租户会话池内的槽位
+}
+
+func (k sessionKey) String() string {
+	tenant := k.Tenant
+	if tenant == "" {
+		tenant = "default"
+	}
+	return fmt.Sprintf("租户: %s#%d", tenant, k.Slot)
+}
+
+func (a *Account) sessionKey() sessionKey {
+	return sessionKey{Tenant: a.Tenant, ProxyIndex: a.ProxyIndex, Slot: a.Slot}
+}
+
+func (s *GuestSession) sessionKey() sessionKey {
+	return sessionKey{Tenant: s.Tenant, ProxyIndex: s.ProxyIndex, Slot: s.Slot}
+}
+
+// tenant 返回 Key 所属租户，未配置时每个 Key 自成一个租户；未启用鉴权时为默认租户。
+// 不能用 label：同名或脱敏后相同的 Key 会共用会话、响应缓存和合并范围
+func (k *APIKey) tenant() string {
+	if k == nil {
+		return ""
+	}
+	if k.Tenant != "" {
+		return k.Tenant
+	}
+	return k.id()
+}
+
+// TenantConfig 租户配置
+type TenantConfig struct {
+	SessionPoolSize int                 `json:"session_pool_size,omitempty"` // 每个代理上的会话数
+	Credential      *UpstreamCredential `json:"credential,omitempty"`        // 租户专用的上游服务账户
+}
+
+// TenantPools 租户会话池大小与轮询游标
+type TenantPools struct {
+	defaultSize int
+	configs     map[string]TenantConfig
+	cursors     map[string]uint64
+	mu          sync.Mutex
+}
+
+func NewTenantPools(defaultSize int, configs map[string]TenantConfig) *TenantPools {
+	if defaultSize < 1 {
+		defaultSize = 1
+	}
+	return &TenantPools{
+		defaultSize: defaultSize,
+		configs:     configs,
+		cursors:     make(map[string]uint64),
+	}
+}
+
+func (tp *TenantPools) size(tenant string) int {
+	if cfg, exists := tp.configs[tenant]; exists && cfg.SessionPoolSize > 0 {
+		return cfg.SessionPoolSize
+	}
+	return tp.defaultSize
+}
+
+// next 选出租户在指定代理上负载最低的会话槽位，负载相同时轮询；
+// limit > 0 时跳过负载已达上限的槽位，全部满载返回 false
+func (tp *TenantPools) next(tenant string, proxyIndex int, load func(sessionKey) int, limit int) (sessionKey, bool) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	size := tp.size(tenant)
+	start := int(tp.cursors[tenant] % uint64(size))
+	best, bestLoad := sessionKey{}, -1
+	for i := 0; i < size; i++ {
+		key := sessionKey{Tenant: tenant, ProxyIndex: proxyIndex, Slot: (start + i) % size}
+		n := load(key)
+		if limit > 0 && n >= limit {
+			continue
+		}
+		if bestLoad < 0 || n < bestLoad {
+			best, bestLoad = key, n
+		}
+	}
+	if bestLoad < 0 {
+		return sessionKey{}, false
+	}
+	tp.cursors[tenant]++
+	return best, true
+}
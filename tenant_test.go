@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestKeyTenant(t *testing.T) {
+	var none *APIKey
+	if got := none.tenant(); got != "" {
+		t.Fatalf("未启用鉴权时租户为 %q, 期望默认租户", got)
+	}
+
+	named := &APIKey{Key: "sk-shared-tenant-1", Name: "a", Tenant: "team"}
+	sibling := &APIKey{Key: "sk-shared-tenant-2", Name: "b", Tenant: "team"}
+	if named.tenant() != "team" || sibling.tenant() != "team" {
+		t.Fatal("配置了 tenant 的 Key 应使用该租户")
+	}
+
+	tests := []struct {
+		name string
+		a, b *APIKey
+	}{
+		{"同名", &APIKey{Key: "sk-first-key-0001", Name: "bot"}, &APIKey{Key: "sk-second-key-0002", Name: "bot"}},
+		// 脱敏后都是 sk-a...zzzz
+		{"未命名且首尾相同", &APIKey{Key: "sk-aaaaaaaa-zzzz"}, &APIKey{Key: "sk-abbbbbbb-zzzz"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.a.label() != tt.b.label() {
+				t.Fatalf("用例前提不成立: label %q != %q", tt.a.label(), tt.b.label())
+			}
+			if tt.a.tenant() == tt.b.tenant() {
+				t.Fatalf("不同的 Key 共用了租户 %q", tt.a.tenant())
+			}
+		})
+	}
+}
+
+func TestResponseCacheKeyIsolatesTenants(t *testing.T) {
+	g := newTestGateway()
+	messages := []OpenAIMessage{{Role: "user", Content: "hello"}}
+	key := func(k *APIKey) string {
+		return g.responseCacheKey(&RequestContext{Key: k}, "gpt-5.2", messages)
+	}
+
+	a := &APIKey{Key: "sk-first-key-0001", Name: "bot"}
+	b := &APIKey{Key: "sk-second-key-0002", Name: "bot"}
+	if key(a) == "" || key(a) == key(b) {
+		t.Fatal("同名的不同 Key 不应共用缓存键")
+	}
+	if key(a) != key(a) {
+		t.Fatal("相同请求的缓存键应稳定")
+	}
+	shared1 := &APIKey{Key: "sk-x", Tenant: "team"}
+	shared2 := &APIKey{Key: "sk-y", Tenant: "team"}
+	if key(shared1) != key(shared2) {
+		t.Fatal("同一租户的 Key 应共用缓存键")
+	}
+}
+
+func TestTenantPoolsNext(t *testing.T) {
+	tp := NewTenantPools(1, map[string]TenantConfig{"team": {SessionPoolSize: 3}})
+	load := map[sessionKey]int{}
+	loadOf := func(k sessionKey) int { return load[k] }
+
+	// 负载相同时轮询
+	seen := map[int]bool{}
+	for i := 0; i < 3; i++ {
+		k, ok := tp.next("team", 0, loadOf, 0)
+		if !ok || k.Tenant != "team" {
+			t.Fatalf("next 返回 %+v, %v", k, ok)
+		}
+		seen[k.Slot] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("轮询覆盖的槽位 %v, 期望 3 个", seen)
+	}
+
+	// 优先选择负载最低的槽位，达到上限的跳过
+	load[sessionKey{Tenant: "team", Slot: 0}] = 2
+	load[sessionKey{Tenant: "team", Slot: 1}] = 1
+	load[sessionKey{Tenant: "team", Slot: 2}] = 2
+	if k, ok := tp.next("team", 0, loadOf, 2); !ok || k.Slot != 1 {
+		t.Fatalf("next 返回槽位 %d, 期望 1", k.Slot)
+	}
+	load[sessionKey{Tenant: "team", Slot: 1}] = 2
+	if _, ok := tp.next("team", 0, loadOf, 2); ok {
+		t.Fatal("全部满载时应返回 false")
+	}
+
+	// 未配置的租户使用默认大小
+	if k, ok := tp.next("other", 0, loadOf, 0); !ok || k.Slot != 0 {
+		t.Fatalf("默认租户 next 返回 %+v", k)
+	}
+}
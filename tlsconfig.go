@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// 上游 TLS
+// ============================================================================
+
+// tlsReloadCheckInterval 两次检查证书文件是否变化的最小间隔，测试中缩短
+var tlsReloadCheckInterval = 5 * time.Second
+
+// UpstreamTLS 上游 TLS 配置
+type UpstreamTLS struct {
+	CAFile     string   `json:"ca_file,omitempty"`     // 额外信任的 CA（PEM），为空时使用系统根证书
+	CertFile   string   `json:"cert_file,omitempty"`   // mTLS 客户端证书
+	KeyFile    string   `json:"key_file,omitempty"`    // mTLS 客户端私钥
+	MinVersion string   `json:"min_version,omitempty"` // 最低 TLS 版本：1.0 / 1.1 / 1.2 / 1.3
+	ServerName string   `json:"server_name,omitempty"` // 覆盖 SNI 与证书校验使用的主机名
+	SPKIPins   []string `json:"spki_pins,omitempty"`   // 证书链中任一证书公钥的 SHA-256（base64），为空时不固定
+}
+
+// configured 是否配置了任一项；只配置了证书或私钥之一也算，交给后续检查报错
+func (t UpstreamTLS) configured() bool {
+	return t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || t.MinVersion != "" || t.ServerName != "" || len(t.SPKIPins) > 0
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsReloader 按文件修改时间重新加载 CA 和客户端证书
+type tlsReloader struct {
+	cfg UpstreamTLS
+
+	roots     *x509.CertPool
+	cert      *tls.Certificate
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+	mu        sync.Mutex
+}
+
+// load 读取证书文件，任一文件有变化时整体重新加载
+func (r *tlsReloader) load(force bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !force && time.Since(r.lastCheck) < tlsReloadCheckInterval {
+		return nil
+	}
+	r.lastCheck = time.Now()
+
+	changed := force
+	for _, path := range []string{r.cfg.CAFile, r.cfg.CertFile, r.cfg.KeyFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Equal(r.modTimes[path]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	var roots *x509.CertPool
+	if r.cfg.CAFile != "" {
+		data, err := os.ReadFile(r.cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("读取 CA 失败: %w", err)
+		}
+		if roots, err = x509.SystemCertPool(); err != nil || roots == nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(data) {
+			return fmt.Errorf("CA 文件中没有有效证书: %s", r.cfg.CAFile)
+		}
+	}
+
+	var cert *tls.Certificate
+	if r.cfg.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("读取客户端证书失败: %w", err)
+		}
+		cert = &pair
+	}
+
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{r.cfg.CAFile, r.cfg.CertFile, r.cfg.KeyFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+
+	if !force {
+		logInfo("上游 TLS 证书已重新加载 | CA: %s, 客户端证书: %s", r.cfg.CAFile, r.cfg.CertFile)
+	}
+	r.roots, r.cert, r.modTimes = roots, cert, modTimes
+	return nil
+}
+
+// current 返回当前的根证书和客户端证书，文件有变化时先重新加载；加载失败时继续使用旧证书
+func (r *tlsReloader) current() (*x509.CertPool, *tls.Certificate) {
+	if err := r.load(false); err != nil {
+		logError("上游 TLS 证书重新加载失败，继续使用旧证书: %v", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.roots, r.cert
+}
+
+// verify 使用当前根证书校验服务端证书链，并检查 SPKI 固定
+func (r *tlsReloader) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("上游未提供证书")
+	}
+	roots, _ := r.current()
+
+	serverName := r.cfg.ServerName
+	if serverName == "" {
+		serverName = cs.ServerName
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(r.cfg.SPKIPins) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			pin := spkiPin(cert)
+			for _, want := range r.cfg.SPKIPins {
+				if pin == want {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("上游证书公钥与 SPKI 固定不匹配（服务端证书: %s）", spkiPin(cs.PeerCertificates[0]))
+}
+
+// spkiPin 证书公钥（SubjectPublicKeyInfo）的 SHA-256，base64 编码
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// buildTLSConfig 生成 tls.Config。证书链在 VerifyConnection 中用最新加载的根证书校验，
+// 因此关闭标准库的默认校验
+func buildTLSConfig(cfg UpstreamTLS) (*tls.Config, error) {
+	reloader := &tlsReloader{cfg: cfg}
+	if err := reloader.load(true); err != nil {
+		return nil, err
+	}
+
+	tlsCfg := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: true,
+		VerifyConnection:   reloader.verify,
+	}
+	if cfg.MinVersion != "" {
+		version, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("未知的 TLS 版本: %s", cfg.MinVersion)
+		}
+		tlsCfg.MinVersion = version
+	}
+	if cfg.CertFile != "" {
+		tlsCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			_, cert := reloader.current()
+			return cert, nil
+		}
+	}
+	return tlsCfg, nil
+}
+
+// upstreamTLSFor 根据上游主机选择 TLS 配置：CONFIG_FILE 中按主机配置的优先，否则使用环境变量配置
+func upstreamTLSFor(baseURL string, defaults UpstreamTLS, byHost map[string]UpstreamTLS) UpstreamTLS {
+	if u, err := url.Parse(baseURL); err == nil {
+		if hostCfg, exists := byHost[u.Hostname()]; exists {
+			return hostCfg
+		}
+	}
+	return defaults
+}
+
+// loadUpstreamTLS 生成上游的 TLS 配置，不需要自定义时返回 nil
+func loadUpstreamTLS(baseURL string, defaults UpstreamTLS, byHost map[string]UpstreamTLS) (*tls.Config, error) {
+	cfg := upstreamTLSFor(baseURL, defaults, byHost)
+	if !cfg.configured() {
+		return nil, nil
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("客户端证书和私钥需要同时配置")
+	}
+	return buildTLSConfig(cfg)
+}
+
+// loadProxyTLS 生成与 https 出口代理握手使用的 TLS 配置：只沿用上游配置中的 CA 和最低版本，
+// 主机名覆盖、SPKI 固定和客户端证书只对上游生效。不需要自定义时返回 nil
+func loadProxyTLS(baseURL string, defaults UpstreamTLS, byHost map[string]UpstreamTLS) (*tls.Config, error) {
+	cfg := upstreamTLSFor(baseURL, defaults, byHost)
+	cfg = UpstreamTLS{CAFile: cfg.CAFile, MinVersion: cfg.MinVersion}
+	if !cfg.configured() {
+		return nil, nil
+	}
+	return buildTLSConfig(cfg)
+}
+
+// splitList 按逗号拆分并去掉空白
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// runSPKIPin 命令行：打印 PEM 证书的 SPKI 固定值
+func runSPKIPin(args []string) error {
+	if len(args) == 0 {
+		return errors.New("用法: spki-pin <证书.pem> ...")
+	}
+	for _, path := range args {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			fmt.Printf("%s  %s\n", spkiPin(cert), cert.Subject.String())
+		}
+	}
+	return nil
+}
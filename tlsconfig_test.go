@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeServerCA 把 httptest 服务端的自签名证书写成 CA 文件
+func writeServerCA(t testing.TB, srv *httptest.Server) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUpstreamTLSVerify(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	ca := writeServerCA(t, srv)
+	pin := spkiPin(srv.Certificate())
+
+	tests := []struct {
+		name string
+		cfg  UpstreamTLS
+		ok   bool
+	}{
+		{"自定义 CA 信任", UpstreamTLS{CAFile: ca}, true},
+		{"未配置 CA 时不信任自签名证书", UpstreamTLS{MinVersion: "1.2"}, false},
+		{"固定匹配", UpstreamTLS{CAFile: ca, SPKIPins: []string{"AAAA", pin}}, true},
+		{"固定不匹配", UpstreamTLS{CAFile: ca, SPKIPins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}, false},
+		{"固定不能绕过证书链校验", UpstreamTLS{SPKIPins: []string{pin}}, false},
+		{"覆盖校验主机名", UpstreamTLS{CAFile: ca, ServerName: "example.com"}, true},
+		{"主机名不在证书中", UpstreamTLS{CAFile: ca, ServerName: "other.test"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsCfg, err := loadUpstreamTLS(srv.URL, tt.cfg, nil)
+			if err != nil || tlsCfg == nil {
+				t.Fatalf("加载配置: %v, %v", tlsCfg, err)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+			resp, err := client.Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("期望成功=%v, 错误: %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestLoadUpstreamTLSConfig(t *testing.T) {
+	if cfg, err := loadUpstreamTLS("https://upstream.example", UpstreamTLS{}, nil); cfg != nil || err != nil {
+		t.Fatalf("未配置时应返回 nil: %v, %v", cfg, err)
+	}
+	for _, cfg := range []UpstreamTLS{{KeyFile: "client.key"}, {CertFile: "client.crt"}} {
+		if _, err := loadUpstreamTLS("https://upstream.example", cfg, nil); err == nil {
+			t.Fatalf("%+v: 证书和私钥只配置一个时应报错", cfg)
+		}
+	}
+	if _, err := loadUpstreamTLS("https://upstream.example", UpstreamTLS{MinVersion: "1.4"}, nil); err == nil {
+		t.Fatal("未知的 TLS 版本应报错")
+	}
+
+	// 按主机的配置优先于默认配置
+	byHost := map[string]UpstreamTLS{"upstream.example": {MinVersion: "1.3"}}
+	cfg, err := loadUpstreamTLS("https://upstream.example/api", UpstreamTLS{MinVersion: "1.2"}, byHost)
+	if err != nil || cfg.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("按主机配置未生效: %v, %v", cfg, err)
+	}
+}
+
+// testCert 生成自签名证书（同时可作为 CA），写出 PEM 文件
+type testCert struct {
+	tls      tls.Certificate
+	certFile string
+	keyFile  string
+	pem      []byte
+}
+
+func newTestCert(t *testing.T, name string, template x509.Certificate) testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	c := testCert{
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+		pem:      pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(c.certFile, c.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c.keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if c.tls, err = tls.X509KeyPair(c.pem, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (c testCert) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(c.pem)
+	return pool
+}
+
+// replaceFile 改写证书文件并推后修改时间，确保重新加载能发现变化
+func replaceFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+}
+
+func tlsGet(cfg *tls.Config, url string) error {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(url)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+// 上游要求客户端证书时出示配置的证书，证书文件更新后使用新证书
+func TestUpstreamTLSClientCertReload(t *testing.T) {
+	clientAuth := x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	trusted := newTestCert(t, "trusted-client", clientAuth)
+	untrusted := newTestCert(t, "untrusted-client", clientAuth)
+
+	var subjects []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subjects = append(subjects, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: trusted.pool()}
+	srv.StartTLS()
+	defer srv.Close()
+
+	old := tlsReloadCheckInterval
+	tlsReloadCheckInterval = 0
+	defer func() { tlsReloadCheckInterval = old }()
+
+	// 先用不受信任的证书，服务端拒绝握手
+	cert, key := filepath.Join(t.TempDir(), "client.crt"), filepath.Join(t.TempDir(), "client.key")
+	replaceFile(t, cert, untrusted.pem)
+	keyPEM, _ := os.ReadFile(untrusted.keyFile)
+	replaceFile(t, key, keyPEM)
+	cfg, err := loadUpstreamTLS(srv.URL, UpstreamTLS{CAFile: writeServerCA(t, srv), CertFile: cert, KeyFile: key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tlsGet(cfg, srv.URL); err == nil {
+		t.Fatal("不受信任的客户端证书应被拒绝")
+	}
+
+	replaceFile(t, cert, trusted.pem)
+	keyPEM, _ = os.ReadFile(trusted.keyFile)
+	replaceFile(t, key, keyPEM)
+	if err := tlsGet(cfg, srv.URL); err != nil {
+		t.Fatalf("更新客户端证书后应握手成功: %v", err)
+	}
+	if len(subjects) != 1 || subjects[0] != "trusted-client" {
+		t.Fatalf("服务端收到的客户端证书: %v", subjects)
+	}
+
+	// 读取失败时继续使用旧证书
+	replaceFile(t, cert, []byte("broken"))
+	if err := tlsGet(cfg, srv.URL); err != nil {
+		t.Fatalf("重新加载失败时应继续使用旧证书: %v", err)
+	}
+}
+
+func TestUpstreamTLSCAReload(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	old := tlsReloadCheckInterval
+	tlsReloadCheckInterval = 0
+	defer func() { tlsReloadCheckInterval = old }()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	replaceFile(t, ca, newTestCert(t, "other-ca", x509.Certificate{}).pem)
+	cfg, err := loadUpstreamTLS(srv.URL, UpstreamTLS{CAFile: ca}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tlsGet(cfg, srv.URL); err == nil {
+		t.Fatal("CA 不匹配时应校验失败")
+	}
+	serverCA, _ := os.ReadFile(writeServerCA(t, srv))
+	replaceFile(t, ca, serverCA)
+	if err := tlsGet(cfg, srv.URL); err != nil {
+		t.Fatalf("CA 文件更新后应校验通过: %v", err)
+	}
+}
+
+// 经过 https 代理时，主机名覆盖、SPKI 固定和客户端证书只用于上游，与代理握手使用单独的配置
+func TestUpstreamTLSViaHTTPSProxy(t *testing.T) {
+	clientCert := newTestCert(t, "client", x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCert.pool()}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	// 代理的证书只包含 127.0.0.1，不含上游的 example.com
+	proxyCert := newTestCert(t, "proxy", x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	})
+	proxy := &testConnectProxy{}
+	proxy.Server = httptest.NewUnstartedServer(proxy.handler(upstream.Listener.Addr().String(), ""))
+	proxy.TLS = &tls.Config{Certificates: []tls.Certificate{proxyCert.tls}, ClientAuth: tls.RequestClientCert}
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	serverCA, _ := os.ReadFile(writeServerCA(t, upstream))
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	replaceFile(t, ca, append(serverCA, proxyCert.pem...))
+	upstreamTLS := UpstreamTLS{
+		CAFile:     ca,
+		CertFile:   clientCert.certFile,
+		KeyFile:    clientCert.keyFile,
+		ServerName: "example.com",
+		SPKIPins:   []string{spkiPin(upstream.Certificate())},
+	}
+
+	// 上游地址不能是回环地址，否则不走代理
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	baseURL := "https://upstream.test:" + port
+	g := NewGateway(baseURL, NewProxyManager("", ""), false)
+	g.egress = EgressConfig{ProxyURL: proxy.URL}
+	var err error
+	if g.upstreamTLS, err = loadUpstreamTLS(baseURL, upstreamTLS, nil); err != nil {
+		t.Fatal(err)
+	}
+	if g.proxyTLS, err = loadProxyTLS(baseURL, upstreamTLS, nil); err != nil {
+		t.Fatal(err)
+	}
+	client, err := g.createHTTPClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(baseURL)
+	if err != nil {
+		t.Fatalf("经过 https 代理访问上游失败: %v", err)
+	}
+	resp.Body.Close()
+	if auths := proxy.received(); len(auths) != 1 {
+		t.Fatalf("应经过代理: %v", auths)
+	}
+	if proxy.clientCerts != 0 {
+		t.Fatal("不应向代理出示上游的客户端证书")
+	}
+}
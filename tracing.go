@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// 链路追踪（OpenTelemetry）
+// ============================================================================
+
+// 导出批次参数
+const (
+	traceQueueSize     = 4096
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+	traceExportTimeout = 10 * time.Second
+)
+
+// Span 类型，取值与 OTLP 一致
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// spanStatusError Span 失败状态，取值与 OTLP 一致
+const spanStatusError = 2
+
+// TracingConfig 追踪导出参数，沿用 OpenTelemetry 的标准环境变量
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint"` // OTLP/HTTP traces 地址，为空时不追踪
+	Headers     map[string]string `json:"-"`        // 导出请求附加的请求头（可能含令牌）
+	ServiceName string            `json:"service_name"`
+	SampleRatio float64           `json:"sample_ratio"` // 没有上游 traceparent 时的采样比例
+}
+
+// loadTracingConfig 读取 OTEL_EXPORTER_OTLP_TRACES_ENDPOINT，未设置时使用 OTEL_EXPORTER_OTLP_ENDPOINT + /v1/traces
+func loadTracingConfig() TracingConfig {
+	cfg := TracingConfig{
+		Endpoint:    getEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", ""),
+		Headers:     make(map[string]string),
+		ServiceName: getEnv("OTEL_SERVICE_NAME", "chat-gateway"),
+		SampleRatio: getEnvFloat("OTEL_TRACES_SAMPLER_ARG", 1),
+	}
+	if cfg.Endpoint == "" {
+		if base := getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""); base != "" {
+			cfg.Endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		}
+	}
+	for _, pair := range splitList(getEnv("OTEL_EXPORTER_OTLP_HEADERS", "")) {
+		if name, value, ok := strings.Cut(pair, "="); ok {
+			cfg.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	return cfg
+}
+
+// ---------------------------------------------------------------------------
+// Span
+// ---------------------------------------------------------------------------
+
+// Span 一段耗时。nil 表示不追踪，所有方法都可以安全调用
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // 全零表示根 span
+
+	name  string
+	kind  int
+	start time.Time
+
+	mu        sync.Mutex
+	attrs     []otlpKeyValue
+	events    []otlpEvent
+	status    int
+	statusMsg string
+	ended     bool
+}
+
+// child 创建子 span
+func (s *Span) child(name string, kind int) *Span {
+	if s == nil {
+		return nil
+	}
+	c := &Span{tracer: s.tracer, traceID: s.traceID, parentID: s.spanID, name: name, kind: kind, start: time.Now()}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+// setAttr 设置属性，支持 string / int / int64 / bool / float64
+func (s *Span) setAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, otlpKeyValue{Key: key, Value: otlpValue(value)})
+	s.mu.Unlock()
+}
+
+// addEvent 记录一个时间点
+func (s *Span) addEvent(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.events = append(s.events, otlpEvent{TimeUnixNano: unixNano(time.Now()), Name: name})
+	s.mu.Unlock()
+}
+
+// setError 标记为失败
+func (s *Span) setError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.status, s.statusMsg = spanStatusError, msg
+	s.mu.Unlock()
+}
+
+// end 结束并提交导出，err 不为空时标记为失败。可重复调用
+func (s *Span) end(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.setError(err.Error())
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: unixNano(s.start),
+		EndTimeUnixNano:   unixNano(time.Now()),
+		Attributes:        s.attrs,
+		Events:            s.events,
+	}
+	if s.parentID != ([8]byte{}) {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.status != 0 {
+		span.Status = &otlpStatus{Code: s.status, Message: s.statusMsg}
+	}
+	s.mu.Unlock()
+	s.tracer.enqueue(&span)
+}
+
+// traceIDString 追踪 ID，未追踪时为空
+func (s *Span) traceIDString() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// startSpan 在请求的根 span 下创建子 span，未追踪时返回 nil
+func (rc *RequestContext) startSpan(name string) *Span {
+	return rc.span.child(name, spanKindInternal)
+}
+
+// ---------------------------------------------------------------------------
+// traceparent
+// ---------------------------------------------------------------------------
+
+// parseTraceparent 解析 W3C traceparent：00-<trace-id>-<parent-id>-<flags>
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	// 版本 00 只有四段，更高版本允许追加字段
+	if parts[0] == "00" && len(parts) != 4 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == ([16]byte{}) {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == ([8]byte{}) {
+		return traceID, parentID, false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+// ---------------------------------------------------------------------------
+// Tracer 与导出
+// ---------------------------------------------------------------------------
+
+// Tracer 创建请求的根 span，结束的 span 批量以 OTLP/HTTP JSON 导出
+type Tracer struct {
+	cfg      TracingConfig
+	resource otlpResource
+	client   *http.Client
+
+	mu     sync.RWMutex // 保护 closed 与 queue 的关闭
+	closed bool
+	queue  chan *otlpSpan
+	done   chan struct{}
+}
+
+// NewTracer 创建追踪器并启动导出协程，未配置导出地址时返回 nil
+func NewTracer(cfg TracingConfig) *Tracer {
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	attrs := []otlpKeyValue{{Key: "service.name", Value: otlpValue(cfg.ServiceName)}}
+	if host, err := os.Hostname(); err == nil {
+		attrs = append(attrs, otlpKeyValue{Key: "host.name", Value: otlpValue(host)})
+	}
+	t := &Tracer{
+		cfg:      cfg,
+		resource: otlpResource{Attributes: attrs},
+		client:   &http.Client{Timeout: traceExportTimeout},
+		queue:    make(chan *otlpSpan, traceQueueSize),
+		done:     make(chan struct{}),
+	}
+	go t.exportLoop()
+	return t
+}
+
+// startServer 为入站请求创建根 span：带有 traceparent 时沿用其 trace ID 与采样决定，否则按比例采样。
+// route 为路由模板，用作 span 名称
+func (t *Tracer) startServer(r *http.Request, route string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: r.Method + " " + route, kind: spanKindServer, start: time.Now()}
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		if !sampled {
+			return nil
+		}
+		s.traceID, s.parentID = traceID, parentID
+	} else {
+		if mathrand.Float64() >= t.cfg.SampleRatio {
+			return nil
+		}
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	s.setAttr("http.request.method", r.Method)
+	s.setAttr("http.route", route)
+	s.setAttr("url.path", r.URL.Path)
+	s.setAttr("user_agent.original", r.UserAgent())
+	return s
+}
+
+func (t *Tracer) enqueue(span *otlpSpan) {
+	if t == nil {
+		return
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- span:
+	default:
+		logWarn("追踪队列已满，丢弃 span: %s", span.Name)
+	}
+}
+
+// exportLoop 每批最多 traceBatchSize 个或每 traceFlushInterval 导出一次
+func (t *Tracer) exportLoop() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*otlpSpan
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			logWarn("追踪导出失败 | span 数: %d, 错误: %v", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (t *Tracer) export(spans []*otlpSpan) error {
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   t.resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: t.cfg.ServiceName}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("状态 %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Close 停止接收新的 span 并导出剩余的部分，最多等待 traceExportTimeout
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+	case <-time.After(traceExportTimeout):
+	}
+}
+
+// ---------------------------------------------------------------------------
+// 网关集成
+// ---------------------------------------------------------------------------
+
+type spanContextKey struct{}
+
+// traced 为处理函数创建根 span，放入请求 context，由 newRequestContext 取出
+func (g *Gateway) traced(route string, next http.HandlerFunc) http.HandlerFunc {
+	if g.tracer == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		span := g.tracer.startServer(r, route)
+		if span == nil {
+			next(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, r.WithContext(context.WithValue(r.Context(), spanContextKey{}, span)))
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.setAttr("http.response.status_code", status)
+		if status >= 500 {
+			span.setError(http.StatusText(status))
+		}
+		span.end(nil)
+	}
+}
+
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// ---------------------------------------------------------------------------
+// OTLP JSON 编码（opentelemetry-proto 的 JSON 映射，ID 为十六进制，64 位整数为字符串）
+// ---------------------------------------------------------------------------
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string `json:"timeUnixNano"`
+	Name         string `json:"name"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpValue(value interface{}) otlpAnyValue {
+	switch v := value.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case int:
+		s := strconv.Itoa(v)
+		return otlpAnyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpAnyValue{IntValue: &s}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return otlpAnyValue{StringValue: &s}
+	}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testCollector 记录收到的 OTLP/HTTP JSON 导出请求
+type testCollector struct {
+	srv     *httptest.Server
+	mu      sync.Mutex
+	spans   []*otlpSpan
+	headers []http.Header
+}
+
+func newTestCollector(t *testing.T) *testCollector {
+	c := &testCollector{}
+	c.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var traces otlpTraces
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad export request", http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.headers = append(c.headers, r.Header.Clone())
+		for _, rs := range traces.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(c.srv.Close)
+	return c
+}
+
+func (c *testCollector) byName() map[string]*otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	spans := make(map[string]*otlpSpan)
+	for _, s := range c.spans {
+		spans[s.Name] = s
+	}
+	return spans
+}
+
+// tracedGateway 按请求创建根 span、子 span 和孙 span 的网关处理函数，请求结束后关闭 Tracer 以导出
+func tracedGateway(t *testing.T, c *testCollector, status int) (*Gateway, http.HandlerFunc) {
+	g := newTestGateway()
+	g.tracer = NewTracer(TracingConfig{
+		Endpoint:    c.srv.URL + "/v1/traces",
+		Headers:     map[string]string{"Authorization": "Bearer collector-token"},
+		ServiceName: "chat-gateway-test",
+		SampleRatio: 1,
+	})
+	handler := g.traced("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		rc := newRequestContext(w, r)
+		policy := rc.startSpan("policy")
+		policy.end(nil)
+		upstream := rc.span.child("upstream.chat", spanKindClient)
+		upstream.child("response.decode", spanKindInternal).end(nil)
+		upstream.end(nil)
+		w.WriteHeader(status)
+	})
+	return g, handler
+}
+
+func TestTracingParentage(t *testing.T) {
+	c := newTestCollector(t)
+	g, handler := tracedGateway(t, c, http.StatusBadGateway)
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader("{}"))
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	handler(httptest.NewRecorder(), req)
+	g.tracer.Close()
+
+	spans := c.byName()
+	root, policy, upstream, decode := spans["POST /v1/chat/completions"], spans["policy"], spans["upstream.chat"], spans["response.decode"]
+	if len(spans) != 4 || root == nil || policy == nil || upstream == nil || decode == nil {
+		t.Fatalf("导出的 span: %v", spans)
+	}
+	for name, s := range spans {
+		if s.TraceID != traceID {
+			t.Errorf("%s: trace ID %s, 应沿用 traceparent 的 %s", name, s.TraceID, traceID)
+		}
+	}
+	if root.ParentSpanID != parentID || root.Kind != spanKindServer {
+		t.Fatalf("根 span 的父 span %q、类型 %d", root.ParentSpanID, root.Kind)
+	}
+	if policy.ParentSpanID != root.SpanID || upstream.ParentSpanID != root.SpanID || decode.ParentSpanID != upstream.SpanID {
+		t.Fatal("子 span 的父子关系不正确")
+	}
+	if upstream.Kind != spanKindClient || policy.Kind != spanKindInternal {
+		t.Fatalf("span 类型: upstream %d, policy %d", upstream.Kind, policy.Kind)
+	}
+	if root.Status == nil || root.Status.Code != spanStatusError {
+		t.Fatal("5xx 响应的根 span 应标记为失败")
+	}
+	if c.headers[0].Get("Authorization") != "Bearer collector-token" {
+		t.Fatal("导出请求应带上配置的请求头")
+	}
+}
+
+func TestTracingSampling(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		exported    int
+	}{
+		{"上游未采样", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", 0},
+		{"无 traceparent 时新建", "", 4},
+		{"traceparent 无效时新建", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCollector(t)
+			g, handler := tracedGateway(t, c, http.StatusOK)
+			req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+			if tt.traceparent != "" {
+				req.Header.Set("traceparent", tt.traceparent)
+			}
+			handler(httptest.NewRecorder(), req)
+			g.tracer.Close()
+
+			spans := c.byName()
+			if len(spans) != tt.exported {
+				t.Fatalf("导出 %d 个 span, 期望 %d", len(spans), tt.exported)
+			}
+			if root := spans["POST /v1/chat/completions"]; root != nil {
+				if root.ParentSpanID != "" || len(root.TraceID) != 32 || strings.Contains(tt.traceparent, root.TraceID) {
+					t.Fatalf("新建的根 span: trace %s, 父 span %q", root.TraceID, root.ParentSpanID)
+				}
+			}
+		})
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-xyz-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		_, _, sampled, ok := parseTraceparent(tt.header)
+		if ok != tt.ok || sampled != tt.sampled {
+			t.Errorf("parseTraceparent(%q) = %v, %v, 期望 %v, %v", tt.header, sampled, ok, tt.sampled, tt.ok)
+		}
+	}
+}
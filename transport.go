@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ============================================================================
+// 共享上游连接
+// ============================================================================
+
+// TransportConfig 上游连接池参数
+type TransportConfig struct {
+	MaxIdleConnsPerHost int           `json:"max_idle_conns_per_host"` // 每个出口保留的空闲连接数
+	MaxConnsPerHost     int           `json:"max_conns_per_host"`      // 每个出口的最大连接数，0 表示不限制
+	IdleConnTimeout     time.Duration `json:"idle_conn_timeout"`       // 空闲连接保留时间
+	DisableHTTP2        bool          `json:"disable_http2"`
+}
+
+// transportFor 返回出口对应的共享 transport，同一出口的所有会话复用连接池；
+// cookie 仍按会话隔离在各自的 http.Client 中
+func (g *Gateway) transportFor(proxyURL string) (*decompressingTransport, error) {
+	g.transportMu.Lock()
+	defer g.transportMu.Unlock()
+
+	if rt, exists := g.transports[proxyURL]; exists {
+		return rt, nil
+	}
+	transport, err := g.newTransport(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	rt := &decompressingTransport{base: transport}
+	g.transports[proxyURL] = rt
+	return rt, nil
+}
+
+// newTransport 按连接池参数创建 transport
+func (g *Gateway) newTransport(proxyURL string) (*http.Transport, error) {
+	cfg := g.transportCfg
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     !cfg.DisableHTTP2,
+		MaxIdleConns:          cfg.MaxIdleConnsPerHost * 4,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		// Accept-Encoding 由 setFirefoxHeaders 显式设置，解压在 decompressingTransport 中完成
+		DisableCompression: true,
+	}
+	if cfg.DisableHTTP2 {
+		// 非 nil 的空 map 会关闭标准库的 HTTP/2 升级
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	if err := g.configureProxy(transport, proxyURL); err != nil {
+		return nil, err
+	}
+	if g.upstreamTLS != nil {
+		transport.TLSClientConfig = g.upstreamTLS
+	}
+	return transport, nil
+}
+
+// closeIdleConns 关闭出口上的空闲连接，WARP 重启后旧连接已失效
+func (g *Gateway) closeIdleConns(proxyURL string) {
+	g.transportMu.Lock()
+	rt, exists := g.transports[proxyURL]
+	g.transportMu.Unlock()
+	if exists {
+		rt.base.CloseIdleConnections()
+	}
+}
+
+// ---------------------------------------------------------------------------
+// 响应解压
+// ---------------------------------------------------------------------------
+
+// decompressingTransport 按 Content-Encoding 解压响应体，支持 gzip / deflate / br / zstd
+type decompressingTransport struct {
+	base *http.Transport
+}
+
+func (t *decompressingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || req.Method == http.MethodHead {
+		return resp, nil
+	}
+	body, err := newDecoder(encoding, resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if body == nil {
+		return resp, nil // 未知编码原样返回
+	}
+
+	resp.Body = body
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+// newDecoder 创建解压读取器，未知编码返回 nil
+func newDecoder(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		// 延迟到第一次读取时再解析 gzip 头，避免流式响应在这里阻塞
+		return &lazyReader{body: body, open: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }}, nil
+	case "deflate":
+		return &lazyReader{body: body, open: openDeflate}, nil
+	case "br":
+		return &decodedBody{Reader: brotli.NewReader(body), body: body}, nil
+	case "zstd":
+		dec, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("创建 zstd 解码器失败: %w", err)
+		}
+		return &decodedBody{Reader: dec, body: body, release: dec.Close}, nil
+	}
+	return nil, nil
+}
+
+// openDeflate HTTP 的 deflate 按规范是 zlib 格式，但有些服务端直接发送原始 deflate 数据，按头部区分
+func openDeflate(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// decodedBody 解压后的响应体，关闭时同时关闭原始响应体
+type decodedBody struct {
+	io.Reader
+	body    io.ReadCloser
+	release func()
+}
+
+func (d *decodedBody) Close() error {
+	if d.release != nil {
+		d.release()
+	}
+	return d.body.Close()
+}
+
+// lazyReader 第一次读取时才创建解码器
+type lazyReader struct {
+	body io.ReadCloser
+	open func(io.Reader) (io.Reader, error)
+	r    io.Reader
+	err  error
+	once sync.Once
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	l.once.Do(func() { l.r, l.err = l.open(l.body) })
+	if l.err != nil {
+		return 0, l.err
+	}
+	return l.r.Read(p)
+}
+
+func (l *lazyReader) Close() error {
+	return l.body.Close()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNewDecoder(t *testing.T) {
+	payload := bytes.Repeat([]byte("data: {\"text\":\"你好\"}\n\n"), 50)
+	compress := func(newWriter func(io.Writer) io.WriteCloser) []byte {
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		w.Write(payload)
+		w.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		encoding string
+		body     []byte
+	}{
+		{"gzip", compress(func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })},
+		{"deflate", compress(func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) })},
+		// 不规范的服务端发送不带 zlib 头的原始 deflate 数据
+		{"deflate", compress(func(w io.Writer) io.WriteCloser { fw, _ := flate.NewWriter(w, flate.DefaultCompression); return fw })},
+		{"br", compress(func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) })},
+		{"zstd", compress(func(w io.Writer) io.WriteCloser { zw, _ := zstd.NewWriter(w); return zw })},
+	}
+	for _, tt := range tests {
+		body, err := newDecoder(tt.encoding, io.NopCloser(bytes.NewReader(tt.body)))
+		if err != nil || body == nil {
+			t.Fatalf("%s: 创建解码器 %v, %v", tt.encoding, body, err)
+		}
+		got, err := io.ReadAll(body)
+		body.Close()
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("%s: 解压结果不符, 错误: %v", tt.encoding, err)
+		}
+	}
+
+	if body, err := newDecoder("compress", io.NopCloser(bytes.NewReader(nil))); body != nil || err != nil {
+		t.Fatal("未知编码应返回 nil")
+	}
+}
+
+// benchGateway 指向本地 TLS 服务器的网关
+func benchGateway(b *testing.B) (*Gateway, string) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html></html>"))
+	}))
+	b.Cleanup(srv.Close)
+
+	g := NewGateway(srv.URL, NewProxyManager("", ""), false)
+	g.transportCfg = TransportConfig{MaxIdleConnsPerHost: 32, IdleConnTimeout: 90 * time.Second}
+	var err error
+	if g.upstreamTLS, err = loadUpstreamTLS(srv.URL, UpstreamTLS{CAFile: writeServerCA(b, srv)}, nil); err != nil {
+		b.Fatal(err)
+	}
+	return g, srv.URL + "/"
+}
+
+func benchGet(b *testing.B, client *http.Client, target string) {
+	req, _ := http.NewRequest("GET", target, nil)
+	setFirefoxHeaders(req, FirefoxAcceptHTML)
+	resp, err := client.Do(req)
+	if err != nil {
+		b.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// BenchmarkTransportPerRequest 旧行为：每个会话一个独立 transport，等价于每次都新建连接
+func BenchmarkTransportPerRequest(b *testing.B) {
+	g, target := benchGateway(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		transport, err := g.newTransport("")
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchGet(b, &http.Client{Transport: &decompressingTransport{base: transport}}, target)
+		transport.CloseIdleConnections()
+	}
+}
+
+// BenchmarkTransportShared 同一出口的会话共享 transport，复用连接
+func BenchmarkTransportShared(b *testing.B) {
+	g, target := benchGateway(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client, err := g.createHTTPClient("")
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchGet(b, client, target)
+	}
+}
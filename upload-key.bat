@@ -20,8 +20,8 @@ REM 创建远程目录
 ssh -i "%KEY_FILE%" %SERVER_USER%@%SERVER_IP% "mkdir -p /opt/chat-gateway"
 
 REM 上传主要文件
-echo [1/5] 上传 main.go...
-scp -i "%KEY_FILE%" main.go %SERVER_USER%@%SERVER_IP%:/opt/chat-gateway/
+echo [1/5] 上传 Go 源码...
+for %%f in (*.go) do scp -i "%KEY_FILE%" %%f %SERVER_USER%@%SERVER_IP%:/opt/chat-gateway/
 
 echo [2/5] 上传 Go 依赖文件...
 scp -i "%KEY_FILE%" go.mod go.sum %SERVER_USER%@%SERVER_IP%:/opt/chat-gateway/
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ============================================================================
+// 用量账本
+// ============================================================================
+
+var usageBucket = []byte("usage")
+
+// UsageRecord 单次请求的用量记录
+type UsageRecord struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"request_id"`
+	Key          string    `json:"key"`              // Key 名称，未启用鉴权时为空
+	KeyID        string    `json:"key_id,omitempty"` // Key 的稳定标识，名称可能重复，预算按它统计
+	Model        string    `json:"model"`
+	Endpoint     string    `json:"endpoint"`
+	Stream       bool      `json:"stream"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	LatencyMs    int64     `json:"latency_ms"`
+	Status       int       `json:"status"`
+	ErrorClass   string    `json:"error_class,omitempty"`
+	CostUSD      float64   `json:"cost_usd,omitempty"`
+	Cached       bool      `json:"cached,omitempty"`    // 由响应缓存返回，不计费
+	Coalesced    bool      `json:"coalesced,omitempty"` // 共享了相同并发请求的上游响应，不计费
+}
+
+// UsageStore 基于 bbolt 的用量账本，写入异步批量提交
+type UsageStore struct {
+	db      *bolt.DB
+	queue   chan UsageRecord
+	seq     uint64
+	dropped uint64
+	done    chan struct{}
+	closed  bool
+	mu      sync.RWMutex // 保护 closed，避免向已关闭的队列投递
+}
+
+// OpenUsageStore 打开（或创建）账本文件
+func OpenUsageStore(path string) (*UsageStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("打开用量账本失败: %w", err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usageBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	us := &UsageStore{
+		db:    db,
+		queue: make(chan UsageRecord, 4096),
+		done:  make(chan struct{}),
+	}
+	go us.writeLoop()
+	return us, nil
+}
+
+// openUsageStoreReadOnly 以只读方式打开账本，用于命令行导出
+func openUsageStoreReadOnly(path string) (*UsageStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 2 * time.Second, ReadOnly: true})
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, fmt.Errorf("账本被网关进程占用，请通过管理接口 /admin/usage?format=csv 导出")
+		}
+		return nil, fmt.Errorf("打开用量账本失败: %w", err)
+	}
+	return &UsageStore{db: db}, nil
+}
+
+// Record 投递一条记录，队列满时丢弃，不阻塞请求
+func (us *UsageStore) Record(rec UsageRecord) {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	if us.closed {
+		return
+	}
+	select {
+	case us.queue <- rec:
+	default:
+		if atomic.AddUint64(&us.dropped, 1)%100 == 1 {
+			logWarn("用量账本队列已满，丢弃记录 | 累计: %d", atomic.LoadUint64(&us.dropped))
+		}
+	}
+}
+
+// writeLoop 批量写入，每批最多 256 条或每秒一次
+func (us *UsageStore) writeLoop() {
+	defer close(us.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var batch []UsageRecord
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := us.write(batch); err != nil {
+			logError("用量账本写入失败 | 条数: %d, 错误: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case rec, ok := <-us.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) >= 256 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (us *UsageStore) write(batch []UsageRecord) error {
+	return us.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+		for _, rec := range batch {
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(us.recordKey(rec.Time), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// recordKey 时间（纳秒，大端）+ 序号，保证按时间有序且不重复
+func (us *UsageStore) recordKey(t time.Time) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], atomic.AddUint64(&us.seq, 1))
+	return key
+}
+
+// Close 写完队列中剩余记录后关闭
+func (us *UsageStore) Close() error {
+	if us.queue != nil {
+		us.mu.Lock()
+		if us.closed {
+			us.mu.Unlock()
+			return nil
+		}
+		us.closed = true
+		close(us.queue)
+		us.mu.Unlock()
+		<-us.done
+	}
+	return us.db.Close()
+}
+
+// Scan 按时间顺序遍历 [from, to) 区间内的记录
+func (us *UsageStore) Scan(from, to time.Time, fn func(UsageRecord) error) error {
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, uint64(from.UnixNano()))
+	end := make([]byte, 8)
+	binary.BigEndian.PutUint64(end, uint64(to.UnixNano()))
+
+	return us.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(usageBucket).Cursor()
+		for k, v := c.Seek(start); k != nil && string(k[:8]) < string(end); k, v = c.Next() {
+			var rec UsageRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				continue
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UsageGroup 分组汇总结果
+type UsageGroup struct {
+	KeyID        string  `json:"key_id,omitempty"` // 按 key 分组时的依据
+	Key          string  `json:"key,omitempty"`    // Key 名称，仅用于展示，取区间内最后一条记录的名称
+	Model        string  `json:"model,omitempty"`
+	Day          string  `json:"day,omitempty"`
+	Requests     int     `json:"requests"`
+	Errors       int     `json:"errors"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	AvgLatencyMs int64   `json:"avg_latency_ms"`
+	CostUSD      float64 `json:"cost_usd"`
+
+	totalLatency int64
+}
+
+// parseGroupBy 解析分组字段，支持 key、model、day 的任意组合
+func parseGroupBy(s string) ([]string, error) {
+	var fields []string
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		switch f {
+		case "":
+			continue
+		case "key", "model", "day":
+			fields = append(fields, f)
+		default:
+			return nil, fmt.Errorf("不支持的分组字段: %s", f)
+		}
+	}
+	return fields, nil
+}
+
+// Aggregate 按指定字段分组汇总；按 key 分组时以 key_id 区分，同名的 Key 分别汇总
+func (us *UsageStore) Aggregate(from, to time.Time, groupBy []string) ([]*UsageGroup, error) {
+	groups := make(map[string]*UsageGroup)
+	err := us.Scan(from, to, func(rec UsageRecord) error {
+		g := UsageGroup{}
+		for _, f := range groupBy {
+			switch f {
+			case "key":
+				g.KeyID, g.Key = rec.KeyID, rec.Key
+			case "model":
+				g.Model = rec.Model
+			case "day":
+				g.Day = rec.Time.Format("2006-01-02")
+			}
+		}
+		id := g.KeyID + "\x00" + g.Model + "\x00" + g.Day
+		if g.KeyID == "" {
+			// 未启用鉴权时没有 key_id
+			id = "\x00" + g.Key + id
+		}
+		group, exists := groups[id]
+		if !exists {
+			group = &g
+			groups[id] = group
+		}
+		group.Key = g.Key
+		group.Requests++
+		if rec.ErrorClass != "" || rec.Status >= 400 {
+			group.Errors++
+		}
+		group.InputTokens += rec.InputTokens
+		group.OutputTokens += rec.OutputTokens
+		group.totalLatency += rec.LatencyMs
+		group.CostUSD += rec.CostUSD
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*UsageGroup, 0, len(groups))
+	for _, g := range groups {
+		g.AvgLatencyMs = g.totalLatency / int64(g.Requests)
+		list = append(list, g)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		if a.KeyID != b.KeyID {
+			return a.KeyID < b.KeyID
+		}
+		return a.Model < b.Model
+	})
+	return list, nil
+}
+
+// finishRequest 请求结束时的统一收尾：计费并写入用量账本
+func (g *Gateway) finishRequest(rc *RequestContext, sw *statusWriter) {
+	status := sw.status
+	if status == 0 {
+		// 没有写出任何内容：出错时客户端收到的是空响应，按上游错误记录
+		status = http.StatusOK
+		if rc.ErrorClass != "" {
+			status = http.StatusBadGateway
+		}
+	}
+
+	rec := UsageRecord{
+		Time:         rc.StartTime,
+		RequestID:    rc.ID,
+		Endpoint:     rc.Endpoint,
+		Stream:       rc.Stream,
+		InputTokens:  rc.InputTokens,
+		OutputTokens: rc.OutputTokens,
+		LatencyMs:    time.Since(rc.StartTime).Milliseconds(),
+		Status:       status,
+		ErrorClass:   rc.ErrorClass,
+		Cached:       rc.CacheHit,
+		Coalesced:    rc.Coalesced,
+	}
+	if rc.Model != "" {
+		rec.Model = g.convertModel(rc.Model)
+	}
+	if rc.Key != nil {
+		rec.Key = rc.Key.label()
+		rec.KeyID = rc.Key.id()
+	}
+
+	// 只对收到上游 200 的请求计费：限流、上游错误、网络错误和网关拒绝都不收费
+	if g.budgets != nil && rc.UpstreamOK && !rec.Cached && !rec.Coalesced {
+		rec.CostUSD = g.budgets.Cost(rec.Model, rec.InputTokens, rec.OutputTokens)
+		g.budgets.Add(rc.Key, rec.CostUSD)
+	}
+
+	if g.usage != nil {
+		g.usage.Record(rec)
+	}
+	g.metrics.observeRequest(rc, rec)
+	logRequestDone(rec, rc.span.traceIDString())
+	g.recordAudit(rc, rec)
+
+	if span := rc.span; span != nil {
+		span.setAttr("gen_ai.request.model", rec.Model)
+		span.setAttr("gen_ai.usage.input_tokens", rec.InputTokens)
+		span.setAttr("gen_ai.usage.output_tokens", rec.OutputTokens)
+		span.setAttr("gateway.stream", rec.Stream)
+		if rec.Key != "" {
+			span.setAttr("gateway.key", rec.Key)
+		}
+		if rec.ErrorClass != "" {
+			span.setAttr("gateway.error_class", rec.ErrorClass)
+			span.setError(rec.ErrorClass)
+		}
+		if rec.Cached || rec.Coalesced {
+			span.setAttr("gateway.cached", rec.Cached)
+			span.setAttr("gateway.coalesced", rec.Coalesced)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// 查询与导出
+// ---------------------------------------------------------------------------
+
+// parseUsageRange 解析 from/to（YYYY-MM-DD 或 RFC3339），默认最近 30 天，to 为日期时包含当天
+func parseUsageRange(fromStr, toStr string) (time.Time, time.Time, error) {
+	to := time.Now().Add(time.Second)
+	from := to.AddDate(0, 0, -30)
+
+	if fromStr != "" {
+		t, err := parseUsageTime(fromStr)
+		if err != nil {
+			return from, to, fmt.Errorf("from 格式错误: %w", err)
+		}
+		from = t
+	}
+	if toStr != "" {
+		t, err := parseUsageTime(toStr)
+		if err != nil {
+			return from, to, fmt.Errorf("to 格式错误: %w", err)
+		}
+		if len(toStr) == len("2006-01-02") {
+			t = t.AddDate(0, 0, 1)
+		}
+		to = t
+	}
+	return from, to, nil
+}
+
+func parseUsageTime(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// writeUsageCSV 输出 CSV：groupBy 为空时输出明细，否则输出分组汇总；两种格式都带 key_id 列
+func (us *UsageStore) writeUsageCSV(out io.Writer, from, to time.Time, groupBy []string) error {
+	cw := csv.NewWriter(out)
+	defer cw.Flush()
+
+	if len(groupBy) == 0 {
+		cw.Write([]string{"time", "request_id", "key", "key_id", "model", "endpoint", "stream",
+			"input_tokens", "output_tokens", "latency_ms", "status", "error_class", "cost_usd", "cached", "coalesced"})
+		return us.Scan(from, to, func(rec UsageRecord) error {
+			return cw.Write([]string{
+				rec.Time.Format(time.RFC3339), rec.RequestID, rec.Key, rec.KeyID, rec.Model, rec.Endpoint,
+				strconv.FormatBool(rec.Stream), strconv.Itoa(rec.InputTokens), strconv.Itoa(rec.OutputTokens),
+				strconv.FormatInt(rec.LatencyMs, 10), strconv.Itoa(rec.Status), rec.ErrorClass,
+				strconv.FormatFloat(rec.CostUSD, 'f', 6, 64), strconv.FormatBool(rec.Cached),
+				strconv.FormatBool(rec.Coalesced),
+			})
+		})
+	}
+
+	groups, err := us.Aggregate(from, to, groupBy)
+	if err != nil {
+		return err
+	}
+	var header []string
+	for _, f := range groupBy {
+		header = append(header, f)
+		if f == "key" {
+			header = append(header, "key_id")
+		}
+	}
+	header = append(header, "requests", "errors", "input_tokens", "output_tokens", "avg_latency_ms", "cost_usd")
+	cw.Write(header)
+	for _, g := range groups {
+		var row []string
+		for _, f := range groupBy {
+			switch f {
+			case "key":
+				row = append(row, g.Key, g.KeyID)
+			case "model":
+				row = append(row, g.Model)
+			case "day":
+				row = append(row, g.Day)
+			}
+		}
+		row = append(row, strconv.Itoa(g.Requests), strconv.Itoa(g.Errors),
+			strconv.Itoa(g.InputTokens), strconv.Itoa(g.OutputTokens), strconv.FormatInt(g.AvgLatencyMs, 10),
+			strconv.FormatFloat(g.CostUSD, 'f', 6, 64))
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleUsage GET /admin/usage?group_by=key,model,day&from=2026-01-01&to=2026-01-31&format=json|csv
+func (a *AdminServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	us := a.gateway.usage
+	if us == nil {
+		writeAdminError(w, http.StatusNotFound, "usage ledger disabled (USAGE_DB not set)")
+		return
+	}
+
+	q := r.URL.Query()
+	from, to, err := parseUsageRange(q.Get("from"), q.Get("to"))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	groupBy, err := parseGroupBy(q.Get("group_by"))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=usage.csv")
+		if err := us.writeUsageCSV(w, from, to, groupBy); err != nil {
+			logError("管理接口 | 用量导出失败: %v", err)
+		}
+		return
+	}
+
+	if len(groupBy) == 0 {
+		groupBy = []string{"key"}
+	}
+	groups, err := us.Aggregate(from, to, groupBy)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"from":     from,
+		"to":       to,
+		"group_by": groupBy,
+		"groups":   groups,
+	})
+}
+
+// runExportUsage 命令行子命令：chat-gateway export-usage -db usage.db -from 2026-01-01 -to 2026-01-31 -group-by key,model -o usage.csv
+func runExportUsage(args []string) error {
+	fs := flag.NewFlagSet("export-usage", flag.ExitOnError)
+	dbPath := fs.String("db", getEnv("USAGE_DB", "usage.db"), "用量账本文件")
+	fromStr := fs.String("from", "", "开始日期（YYYY-MM-DD 或 RFC3339），默认 30 天前")
+	toStr := fs.String("to", "", "结束日期（含当天），默认当前")
+	groupByStr := fs.String("group-by", "", "分组字段：key,model,day 任意组合，为空输出明细")
+	output := fs.String("o", "", "输出文件，默认标准输出")
+	fs.Parse(args)
+
+	from, to, err := parseUsageRange(*fromStr, *toStr)
+	if err != nil {
+		return err
+	}
+	groupBy, err := parseGroupBy(*groupByStr)
+	if err != nil {
+		return err
+	}
+
+	us, err := openUsageStoreReadOnly(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer us.Close()
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	return us.writeUsageCSV(out, from, to, groupBy)
+}
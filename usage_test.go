@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageStoreAggregate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.db")
+	us, err := OpenUsageStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	// a1 与 a2 同名，按 key_id 分别汇总
+	records := []UsageRecord{
+		{Time: day, Key: "a", KeyID: "key-a1", Model: "openai/gpt-5.2", Status: 200, InputTokens: 10, OutputTokens: 20, LatencyMs: 100, CostUSD: 0.5},
+		{Time: day.Add(time.Minute), Key: "a", KeyID: "key-a1", Model: "openai/gpt-5.2", Status: 429, ErrorClass: errClassRateLimited, LatencyMs: 300},
+		{Time: day.Add(2 * time.Minute), Key: "a", KeyID: "key-a2", Model: "openai/gpt-5.2", Status: 200, InputTokens: 7, LatencyMs: 40, CostUSD: 0.25},
+		{Time: day.Add(time.Hour), Key: "b", KeyID: "key-b", Model: "openai/gpt-5.2", Status: 200, InputTokens: 1, OutputTokens: 2, LatencyMs: 50},
+		{Time: day.AddDate(0, 1, 0), Key: "a", KeyID: "key-a1", Model: "openai/gpt-5.2", Status: 200}, // 区间外
+	}
+	for _, rec := range records {
+		us.Record(rec)
+	}
+	if err := us.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 关闭后投递不应 panic
+	us.Record(UsageRecord{Time: day})
+
+	ro, err := openUsageStoreReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+
+	groups, err := ro.Aggregate(day.AddDate(0, 0, -1), day.AddDate(0, 0, 1), []string{"key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 {
+		t.Fatalf("分组数 %d, 期望 3", len(groups))
+	}
+	a1, a2 := groups[0], groups[1]
+	if a1.Key != "a" || a1.KeyID != "key-a1" || a1.Requests != 2 || a1.Errors != 1 || a1.InputTokens != 10 || a1.AvgLatencyMs != 200 || a1.CostUSD != 0.5 {
+		t.Fatalf("key-a1 汇总不符: %+v", *a1)
+	}
+	if a2.Key != "a" || a2.KeyID != "key-a2" || a2.Requests != 1 || a2.InputTokens != 7 || a2.CostUSD != 0.25 {
+		t.Fatalf("key-a2 汇总不符: %+v", *a2)
+	}
+
+	// 明细与汇总 CSV 都带 key_id
+	from, to := day.AddDate(0, 0, -1), day.AddDate(0, 0, 1)
+	for _, tt := range []struct {
+		groupBy []string
+		header  string
+		row     string
+	}{
+		{nil, "time,request_id,key,key_id,model,", ",a,key-a2,openai/gpt-5.2,"},
+		{[]string{"key", "model"}, "key,key_id,model,requests,", "a,key-a2,openai/gpt-5.2,1,0,7,0,40,0.250000"},
+	} {
+		var buf strings.Builder
+		if err := ro.writeUsageCSV(&buf, from, to, tt.groupBy); err != nil {
+			t.Fatal(err)
+		}
+		out := buf.String()
+		if !strings.HasPrefix(out, tt.header) || !strings.Contains(out, tt.row) {
+			t.Fatalf("group_by=%v 的 CSV 不符:\n%s", tt.groupBy, out)
+		}
+	}
+}
+
+func TestUsageStoreRecordAfterCloseConcurrent(t *testing.T) {
+	us, err := OpenUsageStore(filepath.Join(t.TempDir(), "usage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10000; i++ {
+			us.Record(UsageRecord{Time: time.Now()})
+		}
+	}()
+	if err := us.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
+
+func TestFinishRequestStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		written    int
+		errorClass string
+		want       int
+	}{
+		{"正常响应", http.StatusOK, "", http.StatusOK},
+		{"未写出且无错误", 0, "", http.StatusOK},
+		{"未写出但已出错", 0, errClassUpstreamNetwork, http.StatusBadGateway},
+		{"已写出错误状态", http.StatusTooManyRequests, errClassRateLimited, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "usage.db")
+			us, err := OpenUsageStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g := newTestGateway()
+			g.usage = us
+
+			rc := newRequestContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil))
+			rc.ErrorClass = tt.errorClass
+			g.finishRequest(rc, &statusWriter{status: tt.written})
+			if err := us.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			ro, err := openUsageStoreReadOnly(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ro.Close()
+			var got UsageRecord
+			if err := ro.Scan(time.Now().Add(-time.Hour), time.Now().Add(time.Hour), func(rec UsageRecord) error {
+				got = rec
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.want {
+				t.Fatalf("记录的状态码 %d, 期望 %d", got.Status, tt.want)
+			}
+		})
+	}
+}